@@ -0,0 +1,211 @@
+package binancesimulator
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+)
+
+const (
+	basePriceTicks   = 10000 // 100.00
+	levelsPerSide    = 50
+	initialLevels    = 20
+	firstUpdateID    = 1000
+	firstEventTime   = 1600000000000
+	snapshotHistory  = 128
+	maxChangesPerRun = 4
+)
+
+// feed is the exchange side of a single symbol: the true book, and the
+// deterministic sequence of depth updates that moves it forward
+type feed struct {
+	symbol string
+	market binancewebsocket.MarketType
+	rng    *rand.Rand
+
+	lastUpdateID int64
+	eventTime    int64
+	bids         map[int64]string // price in ticks -> quantity
+	asks         map[int64]string
+
+	lastEvent []byte
+	// snapshots[i] is the REST snapshot body after the i-th most recent event
+	snapshots [][]byte
+
+	staleSnapshots    int
+	staleEventsBehind int
+	snapshotRequests  int
+}
+
+func newFeed(symbol string, market binancewebsocket.MarketType, seed int64) *feed {
+	f := &feed{
+		symbol:       symbol,
+		market:       market,
+		rng:          rand.New(rand.NewSource(seed)),
+		lastUpdateID: firstUpdateID,
+		eventTime:    firstEventTime,
+		bids:         make(map[int64]string),
+		asks:         make(map[int64]string),
+	}
+
+	for i := int64(1); i <= initialLevels; i++ {
+		f.bids[basePriceTicks-i] = f.randomQuantity()
+		f.asks[basePriceTicks+i-1] = f.randomQuantity()
+	}
+	f.recordSnapshot()
+
+	return f
+}
+
+// next moves the book forward by one event and returns its payload
+func (f *feed) next() []byte {
+	previousLastUpdateID := f.lastUpdateID
+	firstUpdateID := f.lastUpdateID + 1
+	f.lastUpdateID += int64(f.rng.Intn(3) + 1)
+	f.eventTime += int64(f.rng.Intn(250) + 1)
+
+	var bidDepthDelta, askDepthDelta [][2]string
+	changes := f.rng.Intn(maxChangesPerRun) + 1
+	for i := 0; i < changes; i++ {
+		quantity := f.randomQuantity()
+		if f.rng.Intn(4) == 0 {
+			quantity = "0.000"
+		}
+
+		if f.rng.Intn(2) == 0 {
+			price := basePriceTicks - int64(f.rng.Intn(levelsPerSide)+1)
+			f.setLevel(f.bids, price, quantity)
+			bidDepthDelta = append(bidDepthDelta, [2]string{formatTicks(price), quantity})
+		} else {
+			price := basePriceTicks + int64(f.rng.Intn(levelsPerSide))
+			f.setLevel(f.asks, price, quantity)
+			askDepthDelta = append(askDepthDelta, [2]string{formatTicks(price), quantity})
+		}
+	}
+
+	var event interface{}
+	if f.market.IsFutures() {
+		event = binancewebsocket.DepthUpdate{
+			EventType:            "depthUpdate",
+			EventTime:            f.eventTime,
+			TransactionTime:      f.eventTime - 1,
+			Symbol:               f.symbol,
+			FirstUpdateID:        firstUpdateID,
+			LastUpdateID:         f.lastUpdateID,
+			PreviousLastUpdateID: previousLastUpdateID,
+			BidDepthDelta:        nonNil(bidDepthDelta),
+			AskDepthDelta:        nonNil(askDepthDelta),
+		}
+	} else {
+		event = spotDepthUpdate{
+			EventType:     "depthUpdate",
+			EventTime:     f.eventTime,
+			Symbol:        f.symbol,
+			FirstUpdateID: firstUpdateID,
+			LastUpdateID:  f.lastUpdateID,
+			BidDepthDelta: nonNil(bidDepthDelta),
+			AskDepthDelta: nonNil(askDepthDelta),
+		}
+	}
+
+	f.lastEvent, _ = json.Marshal(event)
+	f.recordSnapshot()
+
+	return f.lastEvent
+}
+
+// snapshot returns the REST depth snapshot body, honouring any injected staleness
+func (f *feed) snapshot() []byte {
+	f.snapshotRequests++
+
+	if f.staleSnapshots > 0 {
+		f.staleSnapshots--
+		behind := f.staleEventsBehind
+		if behind >= len(f.snapshots) {
+			behind = len(f.snapshots) - 1
+		}
+		return f.snapshots[behind]
+	}
+	return f.snapshots[0]
+}
+
+func (f *feed) recordSnapshot() {
+	depthSnapshot := struct {
+		LastUpdateID      int64       `json:"lastUpdateId"`
+		MessageOutputTime int64       `json:"E,omitempty"`
+		TransactionTime   int64       `json:"T,omitempty"`
+		Bids              [][2]string `json:"bids"`
+		Asks              [][2]string `json:"asks"`
+	}{
+		LastUpdateID: f.lastUpdateID,
+		Bids:         f.levels(f.bids, false),
+		Asks:         f.levels(f.asks, true),
+	}
+	if f.market.IsFutures() {
+		depthSnapshot.MessageOutputTime = f.eventTime
+		depthSnapshot.TransactionTime = f.eventTime - 1
+	}
+
+	data, _ := json.Marshal(depthSnapshot)
+	f.snapshots = append([][]byte{data}, f.snapshots...)
+	if len(f.snapshots) > snapshotHistory {
+		f.snapshots = f.snapshots[:snapshotHistory]
+	}
+}
+
+// levels returns one side of the true book, best price first
+func (f *feed) levels(side map[int64]string, ascending bool) [][2]string {
+	prices := make([]int64, 0, len(side))
+	for price := range side {
+		prices = append(prices, price)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		if ascending {
+			return prices[i] < prices[j]
+		}
+		return prices[i] > prices[j]
+	})
+
+	levels := make([][2]string, 0, len(prices))
+	for _, price := range prices {
+		levels = append(levels, [2]string{formatTicks(price), side[price]})
+	}
+	return levels
+}
+
+func (f *feed) setLevel(side map[int64]string, price int64, quantity string) {
+	if q, _ := strconv.ParseFloat(quantity, 64); q == 0 {
+		delete(side, price)
+		return
+	}
+	side[price] = quantity
+}
+
+func (f *feed) randomQuantity() string {
+	return fmt.Sprintf("%d.%03d", f.rng.Intn(10), f.rng.Intn(1000)+1)
+}
+
+func formatTicks(ticks int64) string {
+	return fmt.Sprintf("%d.%02d", ticks/100, ticks%100)
+}
+
+func nonNil(levels [][2]string) [][2]string {
+	if levels == nil {
+		return [][2]string{}
+	}
+	return levels
+}
+
+// spotDepthUpdate is the spot payload, which has no T or pu
+type spotDepthUpdate struct {
+	EventType     string      `json:"e"`
+	EventTime     int64       `json:"E"`
+	Symbol        string      `json:"s"`
+	FirstUpdateID int64       `json:"U"`
+	LastUpdateID  int64       `json:"u"`
+	BidDepthDelta [][2]string `json:"b"`
+	AskDepthDelta [][2]string `json:"a"`
+}
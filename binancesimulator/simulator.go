@@ -0,0 +1,473 @@
+/*
+  Package binancesimulator is a local stand-in for a Binance market, for tests.
+  It speaks the websocket live request protocol (SUBSCRIBE, UNSUBSCRIBE,
+  LIST_SUBSCRIPTIONS, SET_PROPERTY, GET_PROPERTY), on the raw and the combined
+  stream endpoints, and serves the REST depth snapshot endpoint. Depth updates are only published when the test asks
+  for them and are generated from a seeded source, so every run is identical.
+  Gaps, duplicates, disconnects, half-open connections and stale snapshots can
+  be injected at will.
+*/
+
+package binancesimulator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// ErrUnknownSymbol is wrapped by the error of a call about a symbol that was
+// never added
+var ErrUnknownSymbol = errors.New("binancesimulator: unknown symbol")
+
+// Simulator ...
+type Simulator struct {
+	Server *httptest.Server
+	Market binancewebsocket.MarketType
+
+	seed         int64
+	feeds        map[string]*feed
+	connections  map[*connection]struct{}
+	upgrader     websocket.Upgrader
+	unresponsive bool // Live requests are applied but not answered
+	sync.Mutex
+}
+
+// connection is a single client websocket connection and its subscriptions
+type connection struct {
+	conn     *websocket.Conn
+	streams  map[string]struct{}
+	combined bool // Payloads are wrapped in a binancewebsocket.CombinedStreamMessage
+
+	writeMutex sync.Mutex // Guards the field below
+	silent     bool       // Nothing is written, not even a pong
+}
+
+// liveResult always carries result, even when it is null
+type liveResult struct {
+	Result interface{} `json:"result"`
+	ID     int64       `json:"id"`
+}
+
+// New starts a simulator for the given market. Every symbol's feed is seeded
+// from seed, so the same seed always produces the same streams.
+func New(market binancewebsocket.MarketType, seed int64) *Simulator {
+	s := &Simulator{
+		Market:      market,
+		seed:        seed,
+		feeds:       make(map[string]*feed),
+		connections: make(map[*connection]struct{}),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/", s.handleWebsocket)
+	mux.HandleFunc("/stream", s.handleWebsocket)
+	mux.HandleFunc(market.DepthSnapshotEndpoint(), s.handleDepthSnapshot)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// WebsocketURL returns the raw stream endpoint, e.g. ws://127.0.0.1:1234/ws/
+func (s *Simulator) WebsocketURL() string {
+	return "ws" + strings.TrimPrefix(s.Server.URL, "http") + "/ws/"
+}
+
+// RESTBaseURL returns the base URL of the REST API
+func (s *Simulator) RESTBaseURL() string {
+	return s.Server.URL
+}
+
+// Close drops every connection and stops the server
+func (s *Simulator) Close() {
+	s.Disconnect()
+	s.Server.Close()
+}
+
+// AddSymbol starts a feed for a symbol
+func (s *Simulator) AddSymbol(symbol string) {
+	s.Lock()
+	defer s.Unlock()
+
+	symbol = strings.ToUpper(symbol)
+	if _, ok := s.feeds[symbol]; ok {
+		return
+	}
+	s.feeds[symbol] = newFeed(symbol, s.Market, s.seed+int64(len(s.feeds)))
+}
+
+// Publish generates n depth updates for a symbol and sends them to every
+// subscribed connection
+func (s *Simulator) Publish(symbol string, n int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := s.feed(symbol)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		s.broadcast(f.symbol, f.next())
+	}
+	return nil
+}
+
+// InjectGap moves the symbol's book forward by one event without publishing it
+func (s *Simulator) InjectGap(symbol string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := s.feed(symbol)
+	if err != nil {
+		return err
+	}
+	f.next()
+	return nil
+}
+
+// PublishDuplicate sends the last published depth update of a symbol again
+func (s *Simulator) PublishDuplicate(symbol string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := s.feed(symbol)
+	if err != nil {
+		return err
+	}
+	if f.lastEvent != nil {
+		s.broadcast(f.symbol, f.lastEvent)
+	}
+	return nil
+}
+
+// ServeStaleSnapshots makes the next count snapshot requests of a symbol return
+// the book as it was eventsBehind events ago
+func (s *Simulator) ServeStaleSnapshots(symbol string, count, eventsBehind int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := s.feed(symbol)
+	if err != nil {
+		return err
+	}
+	f.staleSnapshots = count
+	f.staleEventsBehind = eventsBehind
+	return nil
+}
+
+// Disconnect abruptly drops every websocket connection, without a close frame
+func (s *Simulator) Disconnect() {
+	s.Lock()
+	defer s.Unlock()
+
+	for c := range s.connections {
+		c.conn.Close()
+		delete(s.connections, c)
+	}
+}
+
+// DisconnectN abruptly drops n of the websocket connections, without a close frame
+func (s *Simulator) DisconnectN(n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	for c := range s.connections {
+		if n == 0 {
+			return
+		}
+		c.conn.Close()
+		delete(s.connections, c)
+		n--
+	}
+}
+
+// Silence makes the open websocket connections half-open: they stay up but
+// send nothing more, neither events nor responses nor pongs. Connections
+// opened later are not affected.
+func (s *Simulator) Silence() {
+	s.Lock()
+	defer s.Unlock()
+
+	for c := range s.connections {
+		c.writeMutex.Lock()
+		c.silent = true
+		c.writeMutex.Unlock()
+	}
+}
+
+// SetUnresponsive makes the connections stop answering live requests, which
+// are still applied, or answer them again
+func (s *Simulator) SetUnresponsive(unresponsive bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.unresponsive = unresponsive
+}
+
+// Connections returns the number of open websocket connections
+func (s *Simulator) Connections() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.connections)
+}
+
+// Subscriptions returns the sorted, de-duplicated streams subscribed across every connection
+func (s *Simulator) Subscriptions() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	unique := make(map[string]struct{})
+	for c := range s.connections {
+		for stream := range c.streams {
+			unique[stream] = struct{}{}
+		}
+	}
+
+	streams := make([]string, 0, len(unique))
+	for stream := range unique {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	return streams
+}
+
+// LastUpdateID returns the update ID of the symbol's true book
+func (s *Simulator) LastUpdateID(symbol string) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := s.feed(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return f.lastUpdateID, nil
+}
+
+// Book returns the symbol's true book, best price first
+func (s *Simulator) Book(symbol string) (bids, asks [][2]string, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := s.feed(symbol)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.levels(f.bids, false), f.levels(f.asks, true), nil
+}
+
+// SnapshotRequests returns how many depth snapshots of a symbol have been
+// served, none for an unknown symbol
+func (s *Simulator) SnapshotRequests(symbol string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := s.feed(symbol)
+	if err != nil {
+		return 0
+	}
+	return f.snapshotRequests
+}
+
+// feed expects the caller to hold the lock
+func (s *Simulator) feed(symbol string) (*feed, error) {
+	f, ok := s.feeds[strings.ToUpper(symbol)]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownSymbol, symbol)
+	}
+	return f, nil
+}
+
+// broadcast expects the caller to hold the lock
+func (s *Simulator) broadcast(symbol string, msg []byte) {
+	depthStream := strings.ToLower(symbol) + "@depth"
+
+	for c := range s.connections {
+		for stream := range c.streams {
+			if !strings.HasPrefix(stream, depthStream) {
+				continue
+			}
+			if c.combined {
+				c.writeJSON(binancewebsocket.CombinedStreamMessage{Stream: stream, Data: msg})
+			} else {
+				c.write(msg)
+			}
+			break
+		}
+	}
+}
+
+func (s *Simulator) handleDepthSnapshot(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	f, ok := s.feeds[strings.ToUpper(r.URL.Query().Get("symbol"))]
+	var data []byte
+	if ok {
+		data = f.snapshot()
+	}
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":-1121,"msg":"Invalid symbol."}`))
+		return
+	}
+	w.Write(data)
+}
+
+func (s *Simulator) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &connection{conn: conn, streams: make(map[string]struct{})}
+	conn.SetPingHandler(func(appData string) error {
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+
+		if c.silent {
+			return nil
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+	})
+
+	// Streams can also be subscribed from the URL, e.g. /ws/btcusdt@depth or
+	// /stream?streams=btcusdt@depth/ethusdt@depth
+	if r.URL.Path == "/stream" {
+		c.combined = true
+		for _, stream := range strings.Split(r.URL.Query().Get("streams"), "/") {
+			if stream != "" {
+				c.streams[stream] = struct{}{}
+			}
+		}
+	} else if stream := strings.TrimPrefix(r.URL.Path, "/ws/"); stream != "" {
+		c.streams[stream] = struct{}{}
+	}
+
+	s.Lock()
+	s.connections[c] = struct{}{}
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		delete(s.connections, c)
+		s.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.handleLiveRequest(c, msg)
+	}
+}
+
+func (s *Simulator) handleLiveRequest(c *connection, msg []byte) {
+	var request binancewebsocket.LiveRequest
+	err := json.Unmarshal(msg, &request)
+	if err != nil {
+		c.writeJSON(binancewebsocket.LiveResponse{ErrorCode: 3, ErrorMessage: "Invalid JSON: " + err.Error()})
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	response := s.applyLiveRequest(c, request)
+	if !s.unresponsive {
+		c.writeJSON(response)
+	}
+}
+
+// applyLiveRequest expects the caller to hold the lock
+func (s *Simulator) applyLiveRequest(c *connection, request binancewebsocket.LiveRequest) interface{} {
+	switch request.Method {
+	case binancewebsocket.MethodSubscribe, binancewebsocket.MethodUnsubscribe:
+		streams, ok := streamNames(request.Params)
+		if !ok {
+			return binancewebsocket.LiveResponse{ID: request.ID, ErrorCode: 2, ErrorMessage: "Invalid request: invalid stream name"}
+		}
+		for _, stream := range streams {
+			if request.Method == binancewebsocket.MethodSubscribe {
+				c.streams[stream] = struct{}{}
+			} else {
+				delete(c.streams, stream)
+			}
+		}
+		return liveResult{ID: request.ID}
+
+	case binancewebsocket.MethodListSubscriptions:
+		streams := make([]string, 0, len(c.streams))
+		for stream := range c.streams {
+			streams = append(streams, stream)
+		}
+		sort.Strings(streams)
+		return liveResult{Result: streams, ID: request.ID}
+
+	case binancewebsocket.MethodSetProperty:
+		if len(request.Params) != 2 || request.Params[0] != binancewebsocket.PropertyCombined {
+			return binancewebsocket.LiveResponse{ID: request.ID, ErrorCode: 0, ErrorMessage: "Unknown property"}
+		}
+		combined, ok := request.Params[1].(bool)
+		if !ok {
+			return binancewebsocket.LiveResponse{ID: request.ID, ErrorCode: 1, ErrorMessage: "Invalid value type: expected Boolean"}
+		}
+		c.combined = combined
+		return liveResult{ID: request.ID}
+
+	case binancewebsocket.MethodGetProperty:
+		if len(request.Params) != 1 || request.Params[0] != binancewebsocket.PropertyCombined {
+			return binancewebsocket.LiveResponse{ID: request.ID, ErrorCode: 0, ErrorMessage: "Unknown property"}
+		}
+		return liveResult{Result: c.combined, ID: request.ID}
+	}
+	return binancewebsocket.LiveResponse{ID: request.ID, ErrorCode: 2, ErrorMessage: "Invalid request: unknown method"}
+}
+
+// streamNames returns the params as stream names, which Binance only accepts
+// as strings with a lower-case symbol, e.g. btcusdt@markPrice
+func streamNames(params []interface{}) ([]string, bool) {
+	streams := make([]string, 0, len(params))
+	for _, param := range params {
+		stream, ok := param.(string)
+		symbol := strings.Split(stream, "@")[0]
+		if !ok || stream == "" || symbol != strings.ToLower(symbol) {
+			return nil, false
+		}
+		streams = append(streams, stream)
+	}
+	return streams, true
+}
+
+func (c *connection) writeJSON(v interface{}) {
+	data, _ := json.Marshal(v)
+	c.write(data)
+}
+
+func (c *connection) write(msg []byte) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.silent {
+		return
+	}
+	c.conn.WriteMessage(websocket.TextMessage, msg)
+}
@@ -0,0 +1,413 @@
+package binancewebsocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/hwebsocket"
+	"github.com/bensooraj/h-lob-service/metrics"
+)
+
+// Arbitrator runs several connections to the same streams, so the books stay
+// live while any one of them is up. Each depth update, identified by its
+// symbol and u, is forwarded from whichever connection delivers it first and
+// the copies delivered by the others are dropped. Other messages, e.g. the
+// responses to live requests, are forwarded from every connection.
+//
+// A connection only wins once it has caught up with what was forwarded, so a
+// connection that is ahead of the others, e.g. right after it reconnected,
+// cannot open a gap that they would have filled. What it delivers meanwhile is
+// held, and dropped as the others deliver the same updates. It is held back
+// for CatchUpTimeout at most, as the others may be up but silent, e.g.
+// half-open, or until they are all down. What it held is then forwarded first,
+// in order, so no update it delivered is lost. Only those it missed while down
+// leave a gap, which the book's sequence check resyncs.
+type Arbitrator struct {
+	Name           string // Labels the metrics, "binance" by default
+	Connections    []*BinanceWebsocket
+	Recorder       hwebsocket.FrameRecorder // Records what is forwarded, set before Open
+	CatchUpTimeout time.Duration            // DefaultCatchUpTimeout if 0
+
+	// Unlike a single connection's, these hooks are only called when every
+	// connection is down, and when the first one is back, with every stream
+	OnDisconnect  func(streams []string, err error)
+	OnReconnected func(streams []string)
+
+	url               string
+	messageHandleFunc func([]byte) error
+	doneChannel       chan struct{}
+
+	lock          sync.Mutex           // Serialises forwarding, guards the fields below
+	lastForwarded map[string]int64     // u forwarded last, per symbol
+	lastReceived  []map[string]int64   // u received last, per connection and symbol, cleared on disconnect
+	heldSince     map[string]time.Time // When a connection ahead was first held back, per symbol
+	held          map[string][]heldUpdate
+	connected     []bool
+	shardsDown    []int // Per connection, as each may shard its streams over several
+	wins          []int64
+	now           func() time.Time
+}
+
+// heldUpdate is a depth update from a connection that was held back
+type heldUpdate struct {
+	connection   int
+	lastUpdateID int64
+	msg          []byte
+}
+
+// DefaultCatchUpTimeout bounds the wait for the other connections to catch up
+// with one that is ahead
+const DefaultCatchUpTimeout = 1 * time.Second
+
+// NewArbitrator arbitrates between the connections, which are configured but
+// not opened yet. Their OnDisconnect, OnReconnected and Recorder are set by Open.
+func NewArbitrator(connections ...*BinanceWebsocket) *Arbitrator {
+	arbitrator := &Arbitrator{
+		Name:          "binance",
+		Connections:   connections,
+		doneChannel:   make(chan struct{}),
+		lastForwarded: make(map[string]int64),
+		lastReceived:  make([]map[string]int64, len(connections)),
+		heldSince:     make(map[string]time.Time),
+		held:          make(map[string][]heldUpdate),
+		connected:     make([]bool, len(connections)),
+		shardsDown:    make([]int, len(connections)),
+		wins:          make([]int64, len(connections)),
+		now:           time.Now,
+	}
+	for i := range connections {
+		arbitrator.lastReceived[i] = make(map[string]int64)
+	}
+
+	return arbitrator
+}
+
+// Open opens every connection to url. If one fails, the ones already open are closed.
+func (a *Arbitrator) Open(ctx context.Context, url string, messageHandleFunc func([]byte) error, errorHandleFunc func(error)) error {
+	a.url = url
+	a.messageHandleFunc = messageHandleFunc
+
+	for i, connection := range a.Connections {
+		i := i
+		connection.Recorder = nil
+		connection.OnDisconnect = func(streams []string, err error) { a.handleDisconnect(i, err) }
+		connection.OnReconnected = func(streams []string) { a.handleReconnect(i) }
+
+		err := connection.Open(ctx, url, func(msg []byte) error {
+			return a.handleMessage(i, msg)
+		}, func(err error) {
+			if errorHandleFunc != nil {
+				errorHandleFunc(fmt.Errorf("connection %d: %w", i, err))
+			}
+		})
+		if err != nil {
+			for _, opened := range a.Connections[:i] {
+				opened.Close()
+			}
+			return err
+		}
+
+		a.lock.Lock()
+		a.connected[i] = true
+		a.lock.Unlock()
+	}
+
+	var waitGroup sync.WaitGroup
+	for i, connection := range a.Connections {
+		waitGroup.Add(1)
+		go func(i int, connection *BinanceWebsocket) {
+			defer waitGroup.Done()
+
+			// A connection that gave up reconnecting does not come back
+			<-connection.Done()
+			a.handleDisconnect(i, hwebsocket.ErrClosed)
+		}(i, connection)
+	}
+	go func() {
+		waitGroup.Wait()
+		close(a.doneChannel)
+	}()
+
+	return nil
+}
+
+// Close closes every connection. Use Done or Wait to know when they have stopped.
+func (a *Arbitrator) Close() error {
+	var err error
+	for _, connection := range a.Connections {
+		closeErr := connection.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Done is closed once every connection has stopped
+func (a *Arbitrator) Done() <-chan struct{} {
+	return a.doneChannel
+}
+
+// Wait blocks until every connection has stopped
+func (a *Arbitrator) Wait() {
+	<-a.doneChannel
+}
+
+// IsRunning reports whether any connection is running
+func (a *Arbitrator) IsRunning() bool {
+	for _, connection := range a.Connections {
+		if connection.IsRunning() {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe subscribes every connection to the streams. It returns the first
+// error, after trying every connection.
+func (a *Arbitrator) Subscribe(streamList []string) error {
+	var err error
+	for _, connection := range a.Connections {
+		subscribeErr := connection.Subscribe(streamList)
+		if err == nil {
+			err = subscribeErr
+		}
+	}
+	return err
+}
+
+// Unsubscribe ...
+func (a *Arbitrator) Unsubscribe(streamList []string) error {
+	return a.UnsubscribeContext(context.Background(), streamList)
+}
+
+// UnsubscribeContext unsubscribes every connection from the streams, waiting
+// no longer than ctx allows. It returns the first error, after trying every
+// connection.
+func (a *Arbitrator) UnsubscribeContext(ctx context.Context, streamList []string) error {
+	var err error
+	for _, connection := range a.Connections {
+		unsubscribeErr := connection.UnsubscribeContext(ctx, streamList)
+		if err == nil {
+			err = unsubscribeErr
+		}
+	}
+	return err
+}
+
+// Subscriptions returns the subscribed streams, sorted
+func (a *Arbitrator) Subscriptions() []string {
+	return a.Connections[0].Subscriptions()
+}
+
+// Wins returns, per connection, the number of depth updates it delivered first
+func (a *Arbitrator) Wins() []int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	wins := make([]int64, len(a.wins))
+	copy(wins, a.wins)
+	return wins
+}
+
+// handleMessage is the message handler of connection i
+func (a *Arbitrator) handleMessage(i int, msg []byte) error {
+	symbol, lastUpdateID, ok := depthUpdateSequence(msg)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !ok {
+		return a.forward(msg)
+	}
+
+	previous, received := a.lastReceived[i][symbol]
+	a.lastReceived[i][symbol] = lastUpdateID
+
+	last, forwarded := a.lastForwarded[symbol]
+	if forwarded {
+		if lastUpdateID <= last {
+			// Another connection was faster
+			return nil
+		}
+		caughtUp := received && previous <= last
+		if !caughtUp && a.canCatchUp(i, symbol) && a.holdBack(i, symbol) {
+			// The message is only valid until the handler returns
+			held := heldUpdate{connection: i, lastUpdateID: lastUpdateID, msg: append([]byte(nil), msg...)}
+			a.held[symbol] = append(a.held[symbol], held)
+			return nil
+		}
+		if !caughtUp {
+			err := a.releaseHeld(symbol)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return a.forwardUpdate(i, symbol, lastUpdateID, msg)
+}
+
+// forwardUpdate forwards a depth update from connection i, dropping what was
+// held up to it. Expects the caller to hold the lock.
+func (a *Arbitrator) forwardUpdate(i int, symbol string, lastUpdateID int64, msg []byte) error {
+	delete(a.heldSince, symbol)
+	a.lastForwarded[symbol] = lastUpdateID
+	a.wins[i]++
+	metrics.ArbitrationWins.WithLabelValues(a.Name, strconv.Itoa(i)).Inc()
+
+	var held []heldUpdate
+	for _, update := range a.held[symbol] {
+		if update.lastUpdateID > lastUpdateID {
+			held = append(held, update)
+		}
+	}
+	if len(held) == 0 {
+		delete(a.held, symbol)
+	} else {
+		a.held[symbol] = held
+	}
+
+	return a.forward(msg)
+}
+
+// releaseHeld forwards what was held of symbol, in order, skipping what was
+// forwarded since. Expects the caller to hold the lock.
+func (a *Arbitrator) releaseHeld(symbol string) error {
+	held := a.held[symbol]
+	delete(a.held, symbol)
+
+	// Several connections may have been held, each in order
+	sort.SliceStable(held, func(j, k int) bool { return held[j].lastUpdateID < held[k].lastUpdateID })
+	for _, update := range held {
+		if update.lastUpdateID <= a.lastForwarded[symbol] {
+			continue
+		}
+		err := a.forwardUpdate(update.connection, symbol, update.lastUpdateID, update.msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canCatchUp reports whether a connection other than i is up and has not
+// received past what was forwarded of symbol, so it will deliver what comes
+// next. Expects the caller to hold the lock.
+func (a *Arbitrator) canCatchUp(i int, symbol string) bool {
+	for j := range a.Connections {
+		if j == i || !a.connected[j] {
+			continue
+		}
+		received, ok := a.lastReceived[j][symbol]
+		if ok && received <= a.lastForwarded[symbol] {
+			return true
+		}
+	}
+	return false
+}
+
+// holdBack reports whether connection i is still to be held back on symbol,
+// i.e. for less than CatchUpTimeout. Expects the caller to hold the lock.
+func (a *Arbitrator) holdBack(i int, symbol string) bool {
+	now := a.now()
+	since, ok := a.heldSince[symbol]
+	if !ok {
+		a.heldSince[symbol] = now
+		return true
+	}
+
+	timeout := a.CatchUpTimeout
+	if timeout <= 0 {
+		timeout = DefaultCatchUpTimeout
+	}
+	if now.Sub(since) < timeout {
+		return true
+	}
+	log.Printf("[ARBITRATOR][%s] No other connection caught up on %s within %s, forwarding what connection %d held", a.url, symbol, timeout, i)
+	return false
+}
+
+// forward expects the caller to hold the lock, which keeps messages in order
+func (a *Arbitrator) forward(msg []byte) error {
+	if a.Recorder != nil {
+		err := a.Recorder.RecordFrame(a.url, time.Now(), msg)
+		if err != nil {
+			log.Printf("[ARBITRATOR][%s] Error recording the message: %s", a.url, err.Error())
+		}
+	}
+
+	if a.messageHandleFunc == nil {
+		return nil
+	}
+	return a.messageHandleFunc(msg)
+}
+
+// handleDisconnect is the OnDisconnect hook of connection i, called for any of
+// its shards. What it received is forgotten, as it may miss events until it is
+// back.
+func (a *Arbitrator) handleDisconnect(i int, err error) {
+	a.lock.Lock()
+	wasConnected := a.connected[i]
+	a.connected[i] = false
+	a.shardsDown[i]++
+	a.lastReceived[i] = make(map[string]int64)
+	// What was held for connection i to catch up would otherwise wait for the next update
+	for symbol, held := range a.held {
+		if a.canCatchUp(held[0].connection, symbol) {
+			continue
+		}
+		err := a.releaseHeld(symbol)
+		if err != nil {
+			log.Printf("[ARBITRATOR][%s] Error forwarding what was held of %s: %s", a.url, symbol, err.Error())
+		}
+	}
+	up := a.up()
+	a.lock.Unlock()
+
+	if !wasConnected {
+		return
+	}
+	log.Printf("[ARBITRATOR][%s] Connection %d is down, %d of %d up", a.url, i, up, len(a.Connections))
+	if up == 0 && a.OnDisconnect != nil {
+		a.OnDisconnect(a.Subscriptions(), err)
+	}
+}
+
+// handleReconnect is the OnReconnected hook of connection i, which is back
+// once every shard that dropped is
+func (a *Arbitrator) handleReconnect(i int) {
+	a.lock.Lock()
+	if a.shardsDown[i] > 0 {
+		a.shardsDown[i]--
+	}
+	if a.shardsDown[i] > 0 {
+		a.lock.Unlock()
+		return
+	}
+	wasDown := a.up() == 0
+	a.connected[i] = true
+	up := a.up()
+	a.lock.Unlock()
+
+	log.Printf("[ARBITRATOR][%s] Connection %d is back, %d of %d up", a.url, i, up, len(a.Connections))
+	if wasDown && a.OnReconnected != nil {
+		a.OnReconnected(a.Subscriptions())
+	}
+}
+
+// up expects the caller to hold the lock
+func (a *Arbitrator) up() int {
+	up := 0
+	for _, connected := range a.connected {
+		if connected {
+			up++
+		}
+	}
+	return up
+}
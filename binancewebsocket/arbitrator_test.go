@@ -0,0 +1,205 @@
+package binancewebsocket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	deliver = iota
+	disconnect
+	reconnect
+	elapse
+)
+
+type arbitrationStep struct {
+	action       int
+	connection   int
+	lastUpdateID int64
+}
+
+func depthUpdateMessage(lastUpdateID int64) []byte {
+	return []byte(fmt.Sprintf(`{"e":"depthUpdate","E":%d,"s":"BTCUSDT","U":%d,"u":%d,"pu":%d,"b":[],"a":[]}`, lastUpdateID, lastUpdateID, lastUpdateID, lastUpdateID-1))
+}
+
+func TestArbitrator_HandleMessage(t *testing.T) {
+	testCases := []struct {
+		name                  string
+		steps                 []arbitrationStep
+		expectedForwarded     []int64
+		expectedWins          []int64
+		expectedDisconnects   int
+		expectedReconnections int
+	}{
+		{
+			"duplicates are dropped",
+			[]arbitrationStep{
+				{deliver, 0, 1}, {deliver, 1, 1},
+				{deliver, 1, 2}, {deliver, 0, 2},
+				{deliver, 0, 3}, {deliver, 1, 3},
+			},
+			[]int64{1, 2, 3},
+			[]int64{2, 1},
+			0, 0,
+		},
+		{
+			"a connection reconnecting ahead waits for the others",
+			[]arbitrationStep{
+				{deliver, 0, 1}, {deliver, 1, 1},
+				{disconnect, 1, 0},
+				{deliver, 0, 2},
+				{reconnect, 1, 0},
+				{deliver, 1, 4}, // Connection 0 has yet to deliver 3
+				{deliver, 0, 3}, {deliver, 0, 4},
+				{deliver, 1, 5}, // Caught up
+			},
+			[]int64{1, 2, 3, 4, 5},
+			[]int64{4, 1},
+			0, 0,
+		},
+		{
+			"all connections down then back",
+			[]arbitrationStep{
+				{deliver, 0, 1}, {deliver, 1, 1},
+				{disconnect, 0, 0}, {disconnect, 1, 0},
+				{reconnect, 1, 0},
+				{deliver, 1, 7}, // Nothing to wait for
+				{reconnect, 0, 0},
+				{deliver, 0, 8}, // Connection 1 is up and caught up
+				{deliver, 1, 8},
+				{deliver, 0, 9},
+			},
+			[]int64{1, 7, 8, 9},
+			[]int64{2, 2},
+			1, 1,
+		},
+		{
+			"a connection is back once every shard is",
+			[]arbitrationStep{
+				{deliver, 0, 1}, {deliver, 1, 1},
+				{disconnect, 0, 0}, {disconnect, 0, 0},
+				{reconnect, 0, 0},
+				{disconnect, 1, 0}, // A shard of connection 0 is still down
+				{reconnect, 0, 0},
+				{deliver, 0, 5},
+			},
+			[]int64{1, 5},
+			[]int64{2, 0},
+			1, 1,
+		},
+		{
+			"a silent connection holds the others back for CatchUpTimeout only",
+			[]arbitrationStep{
+				{deliver, 0, 1}, {deliver, 1, 1},
+				{disconnect, 0, 0}, {reconnect, 0, 0},
+				{deliver, 0, 2}, // Connection 1 is up but delivers nothing more
+				{elapse, 0, 0},
+				{deliver, 0, 3}, // 2 was held, not dropped
+				{deliver, 0, 4},
+			},
+			[]int64{1, 2, 3, 4},
+			[]int64{4, 0},
+			0, 0,
+		},
+		{
+			"what was held is forwarded without a gap when the connection it waited for drops",
+			[]arbitrationStep{
+				{deliver, 0, 1}, {deliver, 1, 1},
+				{disconnect, 1, 0}, {reconnect, 1, 0},
+				{deliver, 1, 2}, {deliver, 1, 3}, // Held for connection 0
+				{disconnect, 0, 0},
+				{deliver, 1, 4},
+			},
+			[]int64{1, 2, 3, 4},
+			[]int64{1, 3},
+			0, 0,
+		},
+		{
+			"what was held is dropped as the others deliver it",
+			[]arbitrationStep{
+				{deliver, 0, 1}, {deliver, 1, 1},
+				{disconnect, 1, 0}, {reconnect, 1, 0},
+				{deliver, 1, 3}, {deliver, 1, 4}, // Held, 2 was missed
+				{deliver, 0, 2}, {deliver, 0, 3},
+				{disconnect, 0, 0}, // 4 is still held
+				{deliver, 1, 5},
+			},
+			[]int64{1, 2, 3, 4, 5},
+			[]int64{3, 2},
+			0, 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			now := time.Unix(1600000000, 0)
+			arbitrator := NewArbitrator(NewBinanceWebsocket(), NewBinanceWebsocket())
+			arbitrator.now = func() time.Time { return now }
+			for i := range arbitrator.connected {
+				arbitrator.connected[i] = true
+			}
+
+			var forwarded []int64
+			arbitrator.messageHandleFunc = func(msg []byte) error {
+				_, lastUpdateID, _ := depthUpdateSequence(msg)
+				forwarded = append(forwarded, lastUpdateID)
+				return nil
+			}
+			disconnects, reconnections := 0, 0
+			arbitrator.OnDisconnect = func(streams []string, err error) { disconnects++ }
+			arbitrator.OnReconnected = func(streams []string) { reconnections++ }
+
+			for _, step := range testCase.steps {
+				switch step.action {
+				case deliver:
+					assert.NoError(arbitrator.handleMessage(step.connection, depthUpdateMessage(step.lastUpdateID)))
+				case disconnect:
+					arbitrator.handleDisconnect(step.connection, errors.New("connection reset by peer"))
+				case reconnect:
+					arbitrator.handleReconnect(step.connection)
+				case elapse:
+					now = now.Add(DefaultCatchUpTimeout)
+				}
+			}
+
+			assert.Equal(testCase.expectedForwarded, forwarded)
+			assert.Equal(testCase.expectedWins, arbitrator.Wins())
+			assert.Equal(testCase.expectedDisconnects, disconnects)
+			assert.Equal(testCase.expectedReconnections, reconnections)
+		})
+	}
+}
+
+func TestArbitrator_CanCatchUp(t *testing.T) {
+	testCases := []struct {
+		name         string
+		connected    []bool
+		lastReceived []map[string]int64
+		expected     bool
+	}{
+		{"behind", []bool{true, true, true}, []map[string]int64{{}, {"BTCUSDT": 9}, {}}, true},
+		{"level with what was forwarded", []bool{true, true, true}, []map[string]int64{{}, {"BTCUSDT": 10}, {}}, true},
+		{"past what was forwarded", []bool{true, true, true}, []map[string]int64{{}, {"BTCUSDT": 11}, {}}, false},
+		{"nothing received since reconnecting", []bool{true, true, true}, []map[string]int64{{}, {}, {}}, false},
+		{"down", []bool{true, false, true}, []map[string]int64{{}, {"BTCUSDT": 9}, {}}, false},
+		{"any one of several", []bool{true, true, true}, []map[string]int64{{}, {"BTCUSDT": 11}, {"BTCUSDT": 10}}, true},
+		{"the connection itself does not count", []bool{true, true, true}, []map[string]int64{{"BTCUSDT": 9}, {}, {}}, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			arbitrator := NewArbitrator(NewBinanceWebsocket(), NewBinanceWebsocket(), NewBinanceWebsocket())
+			arbitrator.connected = testCase.connected
+			arbitrator.lastReceived = testCase.lastReceived
+			arbitrator.lastForwarded["BTCUSDT"] = 10
+
+			assert.Equal(t, testCase.expected, arbitrator.canCatchUp(0, "BTCUSDT"))
+		})
+	}
+}
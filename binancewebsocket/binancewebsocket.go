@@ -1,75 +1,325 @@
 package binancewebsocket
 
 import (
+	"context"
+	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/bensooraj/h-lob-service/hwebsocket"
+	jsoniter "github.com/json-iterator/go"
 )
 
-// BinanceWebsocket ...
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// DefaultRotationInterval replaces the connection an hour before Binance
+// drops it, which it does to every connection after 24 hours
+const DefaultRotationInterval = 23 * time.Hour
+
+// Feed is a source of Binance stream messages: a BinanceWebsocket, or an
+// Arbitrator running several of them side by side
+type Feed interface {
+	Open(ctx context.Context, url string, messageHandleFunc func([]byte) error, errorHandleFunc func(error)) error
+	Close() error
+	Done() <-chan struct{}
+	Wait()
+	IsRunning() bool
+	Subscribe(streamList []string) error
+	Unsubscribe(streamList []string) error
+	UnsubscribeContext(ctx context.Context, streamList []string) error
+	Subscriptions() []string
+}
+
+// BinanceWebsocket is a feed from one or more connections to the same URL.
+// Binance caps the streams of a connection, so once every connection holds
+// MaxStreams, Subscribe opens another one for the streams that do not fit.
 type BinanceWebsocket struct {
-	BaseURL      string
-	Conn         *hwebsocket.WebsocketConnection
-	CloseChannel chan struct{}
+	Name     string // Labels the metrics, "binance" by default
+	BaseURL  string
+	Conn     *hwebsocket.WebsocketConnection // The first connection
+	Recorder hwebsocket.FrameRecorder        // Optional, set before Open
+
+	// Set before Open, see hwebsocket.WebsocketConfiguration. The hooks are
+	// called for every connection, OnDisconnect and OnReconnected with the
+	// streams of that connection only.
+	ConnectionRetryLimit int // Reconnect attempts before giving up, unless ReconnectPolicy is set
+	ReconnectPolicy      hwebsocket.ReconnectPolicy
+	OnDisconnect         func(streams []string, err error)
+	OnReconnecting       func(attempt int, delay time.Duration)
+	OnReconnected        func(streams []string) // Called once the streams are resubscribed
+	RotationInterval     time.Duration          // 0 to never replace the connection before Binance drops it
+	RotationOverlap      time.Duration
+	RequestTimeout       time.Duration // Wait for the response to a live request, DefaultRequestTimeout if 0
+	ReadDeadline         time.Duration // A connection silent for this long is reconnected, hwebsocket.DefaultReadDeadlineTime if 0. Pinged twice as often.
+	MessageRateLimit     float64       // Messages per second each connection may send, 0 for no limit
+	MessageBurst         int           // Messages each connection may send at once, within MessageRateLimit
+	MaxStreams           int           // Streams per connection, 0 for no cap
+
+	lastRequestID int64 // Accessed atomically
+
+	pendingLock sync.Mutex
+	pending     map[int64]chan []byte // Live requests waiting for their response, by ID
+
+	ctx               context.Context
+	messageHandleFunc func([]byte) error
+	errorHandleFunc   func(error)
+	handleLock        sync.Mutex // Keeps messageHandleFunc from being called concurrently by the connections
+	subscribeLock     sync.Mutex // Serialises Subscribe and Unsubscribe, which spread the streams over the connections
+
+	connectionsLock sync.Mutex // Guards the fields below
+	connections     []*hwebsocket.WebsocketConnection
+	running         int  // Connections not stopped yet
+	closed          bool // Close was called, no connection is opened any more
+	doneChannel     chan struct{}
 }
 
 // NewBinanceWebsocket ...
-func NewBinanceWebsocket(closeChannel chan struct{}) *BinanceWebsocket {
+func NewBinanceWebsocket() *BinanceWebsocket {
 	binanceWebsocket := &BinanceWebsocket{
-		CloseChannel: closeChannel,
+		Name:                 "binance",
+		ConnectionRetryLimit: 10,
+		RotationInterval:     DefaultRotationInterval,
+		RequestTimeout:       DefaultRequestTimeout,
+		MessageRateLimit:     MarketUSDMFutures.MessageRateLimit(),
+		MessageBurst:         1,
+		MaxStreams:           MarketUSDMFutures.MaxStreamsPerConnection(),
+		pending:              make(map[int64]chan []byte),
 	}
 
 	return binanceWebsocket
 }
 
-// Open ...
-func (bws *BinanceWebsocket) Open(url string, messageHandleFunc func([]byte) error, errorHandleFunc func(error)) {
+// Open connects to url and keeps the connections alive until ctx is cancelled
+// or Close is called. The responses to the live requests of Subscribe,
+// Unsubscribe etc. are returned to them instead of messageHandleFunc.
+func (bws *BinanceWebsocket) Open(ctx context.Context, url string, messageHandleFunc func([]byte) error, errorHandleFunc func(error)) error {
 	bws.BaseURL = url
+	if bws.pending == nil {
+		bws.pending = make(map[int64]chan []byte)
+	}
+	bws.ctx = ctx
+	bws.messageHandleFunc = messageHandleFunc
+	bws.errorHandleFunc = errorHandleFunc
+	bws.doneChannel = make(chan struct{})
+
+	conn, err := bws.openConnection()
+	if err != nil {
+		return err
+	}
+	bws.Conn = conn
+
+	return nil
+}
+
+// openConnection opens another connection to BaseURL. Should one give up
+// reconnecting, the others are closed too, so the feed stops as a whole.
+func (bws *BinanceWebsocket) openConnection() (*hwebsocket.WebsocketConnection, error) {
+	bws.connectionsLock.Lock()
+	closed := bws.closed
+	bws.connectionsLock.Unlock()
+	if closed {
+		return nil, hwebsocket.ErrClosed
+	}
 
-	bws.Conn = hwebsocket.
+	// The hooks need the connection, which is only known once built. It
+	// cannot drop any earlier.
+	var conn *hwebsocket.WebsocketConnection
+	connectionStreams := func() []string {
+		bws.connectionsLock.Lock()
+		built := conn
+		bws.connectionsLock.Unlock()
+		if built == nil {
+			return nil
+		}
+		return built.Subscriptions()
+	}
+	var onDisconnect func(err error)
+	if bws.OnDisconnect != nil {
+		onDisconnect = func(err error) { bws.OnDisconnect(connectionStreams(), err) }
+	}
+	var onReconnected func()
+	if bws.OnReconnected != nil {
+		onReconnected = func() { bws.OnReconnected(connectionStreams()) }
+	}
+
+	built, err := hwebsocket.
 		New().
-		SetWebsocketURL(url).
-		SetMessageHandleFunc(messageHandleFunc).
-		SetErrorHandleFunc(errorHandleFunc).
+		SetName(bws.Name).
+		SetWebsocketURL(bws.BaseURL).
+		SetMessageHandleFunc(bws.handleMessage).
+		SetErrorHandleFunc(bws.errorHandleFunc).
 		SetAutoReconnect(true).
-		SetConnectionRetryLimit(10).
-		Build()
+		SetConnectionRetryLimit(bws.ConnectionRetryLimit).
+		SetRecorder(bws.Recorder).
+		SetSubscriptionMessageFunc(bws.liveRequest).
+		SetReconnectPolicy(bws.ReconnectPolicy).
+		SetOnDisconnect(onDisconnect).
+		SetOnReconnecting(bws.OnReconnecting).
+		SetOnReconnected(onReconnected).
+		SetRotationInterval(bws.RotationInterval).
+		SetRotationOverlap(bws.RotationOverlap).
+		SetSequenceFunc(depthUpdateSequence).
+		SetRateLimit(bws.MessageRateLimit, bws.MessageBurst).
+		SetReadDeadlineTime(bws.readDeadline()).
+		Build(bws.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bws.connectionsLock.Lock()
+	if bws.closed {
+		bws.connectionsLock.Unlock()
+		built.Close()
+		return nil, hwebsocket.ErrClosed
+	}
+	conn = built
+	bws.connections = append(bws.connections, conn)
+	bws.running++
+	if len(bws.connections) > 1 {
+		log.Printf("[ws][%s] Opened connection %d for more streams", bws.BaseURL, len(bws.connections))
+	}
+	bws.connectionsLock.Unlock()
 
 	go func() {
-		ticker := time.NewTicker(30 * time.Second)
+		// The pongs keep a connection without events from reaching its read deadline
+		ticker := time.NewTicker(bws.readDeadline() / 2)
 		defer ticker.Stop()
 
 		for {
 			select {
-			case <-bws.CloseChannel:
-				bws.Conn.Close()
+			case <-conn.Done():
 				return
 			case tick := <-ticker.C:
-				bws.Conn.SendPingMessage([]byte(tick.String()))
+				conn.SendPingMessage([]byte(tick.String()))
 			}
 		}
 	}()
-	return
+	go func() {
+		<-conn.Done()
+		bws.Close()
+
+		bws.connectionsLock.Lock()
+		defer bws.connectionsLock.Unlock()
+
+		bws.running--
+		if bws.running == 0 {
+			close(bws.doneChannel)
+		}
+	}()
+
+	return conn, nil
 }
 
-// Subscribe ...
-func (bws *BinanceWebsocket) Subscribe(ID int64, streamList []string) {
-	subscribeRequest := LiveRequest{
-		Method: "SUBSCRIBE",
-		Params: streamList,
-		ID:     ID,
+func (bws *BinanceWebsocket) readDeadline() time.Duration {
+	if bws.ReadDeadline <= 0 {
+		return hwebsocket.DefaultReadDeadlineTime
 	}
-	bws.Conn.SendJSONMessage(subscribeRequest)
-	return
+	return bws.ReadDeadline
 }
 
-// Unsubscribe ...
-func (bws *BinanceWebsocket) Unsubscribe(ID int64, streamList []string) {
-	unsubscribeRequest := LiveRequest{
-		Method: "UNSUBSCRIBE",
-		Params: streamList,
-		ID:     ID,
+// handleMessage is the message handler of every connection
+func (bws *BinanceWebsocket) handleMessage(msg []byte) error {
+	if bws.handleResponse(msg) {
+		return nil
+	}
+	if bws.messageHandleFunc == nil {
+		return nil
+	}
+
+	bws.handleLock.Lock()
+	defer bws.handleLock.Unlock()
+
+	return bws.messageHandleFunc(msg)
+}
+
+// Close closes the connections. Use Done or Wait to know when they have stopped.
+func (bws *BinanceWebsocket) Close() error {
+	bws.connectionsLock.Lock()
+	bws.closed = true
+	connections := bws.connections
+	bws.connectionsLock.Unlock()
+
+	var err error
+	for _, conn := range connections {
+		closeErr := conn.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Done is closed once every connection has stopped
+func (bws *BinanceWebsocket) Done() <-chan struct{} {
+	return bws.doneChannel
+}
+
+// Wait blocks until every connection has stopped
+func (bws *BinanceWebsocket) Wait() {
+	<-bws.doneChannel
+}
+
+// IsRunning reports whether the connections are open and their goroutines are running
+func (bws *BinanceWebsocket) IsRunning() bool {
+	connections := bws.Connections()
+	if len(connections) == 0 {
+		return false
+	}
+	for _, conn := range connections {
+		if !conn.IsRunning() {
+			return false
+		}
+	}
+	return true
+}
+
+// Connections returns every connection opened, Conn first
+func (bws *BinanceWebsocket) Connections() []*hwebsocket.WebsocketConnection {
+	bws.connectionsLock.Lock()
+	defer bws.connectionsLock.Unlock()
+
+	connections := make([]*hwebsocket.WebsocketConnection, len(bws.connections))
+	copy(connections, bws.connections)
+	return connections
+}
+
+// Subscriptions returns the streams subscribed across the connections, sorted
+func (bws *BinanceWebsocket) Subscriptions() []string {
+	var streams []string
+	for _, conn := range bws.Connections() {
+		streams = append(streams, conn.Subscriptions()...)
+	}
+	sort.Strings(streams)
+
+	return streams
+}
+
+// depthUpdateSequence is the connection's SequenceFunc: depth updates are
+// sequenced per symbol by their last update ID, on the raw and the combined
+// stream endpoints alike
+func depthUpdateSequence(msg []byte) (string, int64, bool) {
+	var combined CombinedStreamMessage
+	err := json.Unmarshal(msg, &combined)
+	if err != nil {
+		return "", 0, false
+	}
+	if combined.Stream != "" {
+		msg = combined.Data
+	}
+
+	// The upper-case keys are declared so they are not matched to their
+	// lower-case namesakes
+	var event struct {
+		EventType     string `json:"e"`
+		EventTime     int64  `json:"E"`
+		Symbol        string `json:"s"`
+		FirstUpdateID int64  `json:"U"`
+		LastUpdateID  int64  `json:"u"`
+	}
+	err = json.Unmarshal(msg, &event)
+	if err != nil || event.EventType != EventTypeDepthUpdate {
+		return "", 0, false
 	}
-	bws.Conn.SendJSONMessage(unsubscribeRequest)
-	return
+	return event.Symbol, event.LastUpdateID, true
 }
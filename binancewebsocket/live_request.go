@@ -0,0 +1,293 @@
+package binancewebsocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/hwebsocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// DefaultRequestTimeout bounds the wait for the response to a live request
+const DefaultRequestTimeout = 10 * time.Second
+
+// Live request methods
+const (
+	MethodSubscribe         = "SUBSCRIBE"
+	MethodUnsubscribe       = "UNSUBSCRIBE"
+	MethodListSubscriptions = "LIST_SUBSCRIPTIONS"
+	MethodSetProperty       = "SET_PROPERTY"
+	MethodGetProperty       = "GET_PROPERTY"
+)
+
+// PropertyCombined is true when the payloads are wrapped in a
+// CombinedStreamMessage, as on the combined stream endpoint
+const PropertyCombined = "combined"
+
+// ErrRequestTimeout is wrapped by the error of a live request that got no
+// response within RequestTimeout. The request may still have been applied.
+var ErrRequestTimeout = errors.New("no response to the live request")
+
+// LiveError is the error response to a live request, e.g. to a SUBSCRIBE with
+// an invalid stream name. The request was not applied.
+type LiveError struct {
+	ID      int64
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *LiveError) Error() string {
+	return fmt.Sprintf("%s request %d failed: %d %s", e.Method, e.ID, e.Code, e.Message)
+}
+
+// Subscribe subscribes to the streams not already subscribed and waits for
+// Binance to confirm. They are resubscribed after a reconnect until
+// unsubscribed, or unless Binance returned a *LiveError. Streams go to the
+// first connection with room under MaxStreams, and to a new connection when
+// none has any. It returns the first error, after trying every stream.
+func (bws *BinanceWebsocket) Subscribe(streamList []string) error {
+	bws.subscribeLock.Lock()
+	defer bws.subscribeLock.Unlock()
+
+	subscribed := make(map[string]bool)
+	for _, stream := range bws.Subscriptions() {
+		subscribed[stream] = true
+	}
+	var newStreams []string
+	for _, stream := range streamList {
+		if !subscribed[stream] {
+			subscribed[stream] = true
+			newStreams = append(newStreams, stream)
+		}
+	}
+
+	var err error
+	connections := bws.Connections()
+	for i := 0; len(newStreams) > 0; i++ {
+		if i == len(connections) {
+			conn, openErr := bws.openConnection()
+			if openErr != nil {
+				if err == nil {
+					err = fmt.Errorf("opening a connection for %v: %w", newStreams, openErr)
+				}
+				return err
+			}
+			connections = append(connections, conn)
+		}
+		conn := connections[i]
+
+		n := len(newStreams)
+		if bws.MaxStreams > 0 {
+			room := bws.MaxStreams - len(conn.Subscriptions())
+			if room <= 0 {
+				continue
+			}
+			if room < n {
+				n = room
+			}
+		}
+
+		subscribeErr := bws.subscribe(conn, newStreams[:n])
+		if err == nil {
+			err = subscribeErr
+		}
+		newStreams = newStreams[n:]
+	}
+	return err
+}
+
+// subscribe subscribes conn to streams, which it does not track yet
+func (bws *BinanceWebsocket) subscribe(conn *hwebsocket.WebsocketConnection, streams []string) error {
+	conn.AddSubscriptions(streams...)
+
+	err := bws.request(context.Background(), conn, MethodSubscribe, toParams(streams), nil)
+	var liveError *LiveError
+	if errors.As(err, &liveError) {
+		conn.RemoveSubscriptions(streams...)
+	}
+	return err
+}
+
+// Unsubscribe unsubscribes from the streams and waits for Binance to confirm.
+// Streams not subscribed are ignored. Connections left without a stream stay
+// open for the next Subscribe.
+func (bws *BinanceWebsocket) Unsubscribe(streamList []string) error {
+	return bws.UnsubscribeContext(context.Background(), streamList)
+}
+
+// UnsubscribeContext is Unsubscribe, waiting for Binance no longer than ctx
+// allows. The streams are forgotten either way, and not resubscribed after a
+// reconnect.
+func (bws *BinanceWebsocket) UnsubscribeContext(ctx context.Context, streamList []string) error {
+	bws.subscribeLock.Lock()
+	defer bws.subscribeLock.Unlock()
+
+	var err error
+	for _, conn := range bws.Connections() {
+		activeStreams := conn.RemoveSubscriptions(streamList...)
+		if len(activeStreams) == 0 {
+			continue
+		}
+
+		unsubscribeErr := bws.request(ctx, conn, MethodUnsubscribe, toParams(activeStreams), nil)
+		var liveError *LiveError
+		if errors.As(unsubscribeErr, &liveError) {
+			conn.AddSubscriptions(activeStreams...)
+		}
+		if err == nil {
+			err = unsubscribeErr
+		}
+	}
+	return err
+}
+
+// ListSubscriptions asks Binance which streams the connections are subscribed to
+func (bws *BinanceWebsocket) ListSubscriptions() ([]string, error) {
+	var streams []string
+	for _, conn := range bws.Connections() {
+		var connectionStreams []string
+		err := bws.request(context.Background(), conn, MethodListSubscriptions, nil, &connectionStreams)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, connectionStreams...)
+	}
+	sort.Strings(streams)
+
+	return streams, nil
+}
+
+// SetProperty sets a property of every connection, e.g. PropertyCombined
+func (bws *BinanceWebsocket) SetProperty(name string, value interface{}) error {
+	for _, conn := range bws.Connections() {
+		err := bws.request(context.Background(), conn, MethodSetProperty, []interface{}{name, value}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetProperty decodes the value of a property of the first connection into value
+func (bws *BinanceWebsocket) GetProperty(name string, value interface{}) error {
+	return bws.request(context.Background(), bws.Conn, MethodGetProperty, []interface{}{name}, value)
+}
+
+// request sends a live request on conn and waits for its response, whose
+// result is decoded into result unless it is nil. It fails at once with
+// hwebsocket.ErrNotConnected while conn is reconnecting, as no response would
+// come before the reconnect.
+func (bws *BinanceWebsocket) request(ctx context.Context, conn *hwebsocket.WebsocketConnection, method string, params []interface{}, result interface{}) error {
+	if !conn.IsConnected() {
+		return fmt.Errorf("%s request: %w", method, hwebsocket.ErrNotConnected)
+	}
+	id := atomic.AddInt64(&bws.lastRequestID, 1)
+	responseChannel := make(chan []byte, 1)
+
+	bws.pendingLock.Lock()
+	bws.pending[id] = responseChannel
+	bws.pendingLock.Unlock()
+
+	defer func() {
+		bws.pendingLock.Lock()
+		delete(bws.pending, id)
+		bws.pendingLock.Unlock()
+	}()
+
+	err := conn.SendJSONMessage(LiveRequest{ID: id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	timeout := bws.RequestTimeout
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+
+	var msg []byte
+	select {
+	case msg = <-responseChannel:
+	case <-conn.Done():
+		return hwebsocket.ErrClosed
+	case <-ctx.Done():
+		return fmt.Errorf("%s request %d: %w", method, id, ctx.Err())
+	case <-time.After(timeout):
+		return fmt.Errorf("%s request %d: %w", method, id, ErrRequestTimeout)
+	}
+
+	var response struct {
+		LiveResponse
+		RawResult jsoniter.RawMessage `json:"result"`
+	}
+	err = json.Unmarshal(msg, &response)
+	if err != nil {
+		return err
+	}
+	// Binance answers an unknown property with code 0, so msg tells errors apart
+	if response.ErrorCode != 0 || response.ErrorMessage != "" {
+		return &LiveError{ID: id, Method: method, Code: response.ErrorCode, Message: response.ErrorMessage}
+	}
+	if result != nil {
+		return json.Unmarshal(response.RawResult, result)
+	}
+	return nil
+}
+
+// handleResponse hands a response over to the live request waiting for it, if
+// any, and reports whether it did
+func (bws *BinanceWebsocket) handleResponse(msg []byte) bool {
+	// Cheap enough to ask of every message: only responses carry an id
+	if !bytes.Contains(msg, []byte(`"id"`)) {
+		return false
+	}
+
+	var response struct {
+		CombinedStreamMessage
+		ID int64 `json:"id"`
+	}
+	err := json.Unmarshal(msg, &response)
+	if err != nil || response.Stream != "" || response.ID == 0 {
+		return false
+	}
+
+	// Taken out of pending so that a repeated id cannot block the receive loop
+	// on the full channel: the channel only ever gets the one response
+	bws.pendingLock.Lock()
+	responseChannel, ok := bws.pending[response.ID]
+	delete(bws.pending, response.ID)
+	bws.pendingLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	responseChannel <- msg
+	return true
+}
+
+// liveRequest is the connection's SubscriptionMessageFunc, used when it
+// resubscribes on its own, without waiting for the response
+func (bws *BinanceWebsocket) liveRequest(subscribe bool, streams []string) interface{} {
+	method := MethodUnsubscribe
+	if subscribe {
+		method = MethodSubscribe
+	}
+	return LiveRequest{
+		Method: method,
+		Params: toParams(streams),
+		ID:     atomic.AddInt64(&bws.lastRequestID, 1),
+	}
+}
+
+func toParams(streams []string) []interface{} {
+	params := make([]interface{}, len(streams))
+	for i, stream := range streams {
+		params[i] = stream
+	}
+	return params
+}
@@ -0,0 +1,24 @@
+package binancewebsocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinanceWebsocket_HandleResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	bws := NewBinanceWebsocket()
+	responseChannel := make(chan []byte, 1)
+	bws.pending[7] = responseChannel
+
+	response := []byte(`{"result":null,"id":7}`)
+	assert.True(bws.handleResponse(response))
+	// A repeated id is no longer pending, rather than blocking on the full channel
+	assert.False(bws.handleResponse(response))
+	assert.False(bws.handleResponse([]byte(`{"result":null,"id":8}`)))
+
+	assert.Equal(response, <-responseChannel)
+	assert.Empty(bws.pending)
+}
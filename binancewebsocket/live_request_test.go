@@ -0,0 +1,223 @@
+package binancewebsocket_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancesimulator"
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/hwebsocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// openSimulated opens a connection to a simulator, configured by options
+// before it is opened, collecting the messages that are not responses to live
+// requests
+func openSimulated(t *testing.T, options ...func(*binancewebsocket.BinanceWebsocket)) (*binancesimulator.Simulator, *binancewebsocket.BinanceWebsocket, chan []byte) {
+	sim := binancesimulator.New(binancewebsocket.MarketUSDMFutures, 42)
+	sim.AddSymbol("BTCUSDT")
+	t.Cleanup(sim.Close)
+
+	messages := make(chan []byte, 100)
+	binanceWebsocket := binancewebsocket.NewBinanceWebsocket()
+	binanceWebsocket.RequestTimeout = 200 * time.Millisecond
+	binanceWebsocket.MessageRateLimit = 0
+	for _, option := range options {
+		option(binanceWebsocket)
+	}
+	err := binanceWebsocket.Open(context.Background(), sim.WebsocketURL(), func(msg []byte) error {
+		messages <- msg
+		return nil
+	}, func(err error) {})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		binanceWebsocket.Close()
+		binanceWebsocket.Wait()
+	})
+
+	return sim, binanceWebsocket, messages
+}
+
+func TestBinanceWebsocket_LiveRequests(t *testing.T) {
+	assert := assert.New(t)
+	sim, binanceWebsocket, messages := openSimulated(t)
+
+	assert.NoError(binanceWebsocket.Subscribe([]string{"btcusdt@depth", "ethusdt@depth"}))
+	assert.Equal([]string{"btcusdt@depth", "ethusdt@depth"}, sim.Subscriptions())
+	assert.Equal([]string{"btcusdt@depth", "ethusdt@depth"}, binanceWebsocket.Subscriptions())
+
+	streams, err := binanceWebsocket.ListSubscriptions()
+	assert.NoError(err)
+	assert.Equal([]string{"btcusdt@depth", "ethusdt@depth"}, streams)
+
+	assert.NoError(binanceWebsocket.Unsubscribe([]string{"ethusdt@depth", "bnbusdt@depth"}))
+	assert.Equal([]string{"btcusdt@depth"}, sim.Subscriptions())
+	assert.Equal([]string{"btcusdt@depth"}, binanceWebsocket.Subscriptions())
+
+	var combined bool
+	assert.NoError(binanceWebsocket.GetProperty(binancewebsocket.PropertyCombined, &combined))
+	assert.False(combined)
+	assert.NoError(binanceWebsocket.SetProperty(binancewebsocket.PropertyCombined, true))
+	assert.NoError(binanceWebsocket.GetProperty(binancewebsocket.PropertyCombined, &combined))
+	assert.True(combined)
+
+	// Responses are returned to their request, only the events are forwarded
+	sim.Publish("BTCUSDT", 1)
+	select {
+	case msg := <-messages:
+		assert.Contains(string(msg), `"stream":"btcusdt@depth"`)
+	case <-time.After(time.Second):
+		assert.Fail("The depth update was not forwarded")
+	}
+	assert.Len(messages, 0)
+}
+
+func TestBinanceWebsocket_LiveRequestErrors(t *testing.T) {
+	assert := assert.New(t)
+	sim, binanceWebsocket, _ := openSimulated(t)
+
+	// Rejected: neither tracked nor resubscribed
+	err := binanceWebsocket.Subscribe([]string{"BTCUSDT@depth"})
+	var liveError *binancewebsocket.LiveError
+	if assert.True(errors.As(err, &liveError), "%v", err) {
+		assert.Equal(binancewebsocket.MethodSubscribe, liveError.Method)
+		assert.Equal(2, liveError.Code)
+	}
+	assert.Empty(binanceWebsocket.Subscriptions())
+
+	err = binanceWebsocket.SetProperty("unknown", true)
+	assert.True(errors.As(err, &liveError), "%v", err)
+
+	// Unanswered: still tracked, as Binance may have applied it
+	sim.SetUnresponsive(true)
+	err = binanceWebsocket.Subscribe([]string{"btcusdt@depth"})
+	assert.True(errors.Is(err, binancewebsocket.ErrRequestTimeout), "%v", err)
+	assert.Equal([]string{"btcusdt@depth"}, binanceWebsocket.Subscriptions())
+	assert.Equal([]string{"btcusdt@depth"}, sim.Subscriptions())
+
+	sim.SetUnresponsive(false)
+	streams, err := binanceWebsocket.ListSubscriptions()
+	assert.NoError(err)
+	assert.Equal([]string{"btcusdt@depth"}, streams)
+}
+
+func TestBinanceWebsocket_UnsubscribeContext(t *testing.T) {
+	assert := assert.New(t)
+	sim, binanceWebsocket, _ := openSimulated(t, func(binanceWebsocket *binancewebsocket.BinanceWebsocket) {
+		binanceWebsocket.RequestTimeout = time.Minute
+	})
+	assert.NoError(binanceWebsocket.Subscribe([]string{"btcusdt@depth", "ethusdt@depth"}))
+
+	// Unanswered: the wait ends with ctx, and the stream is forgotten
+	sim.SetUnresponsive(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := binanceWebsocket.UnsubscribeContext(ctx, []string{"ethusdt@depth"})
+	assert.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Equal([]string{"btcusdt@depth"}, binanceWebsocket.Subscriptions())
+
+	// Down: no wait at all
+	sim.Close()
+	assert.Eventually(func() bool { return !binanceWebsocket.Conn.IsConnected() }, time.Second, time.Millisecond)
+	start := time.Now()
+	err = binanceWebsocket.UnsubscribeContext(context.Background(), []string{"btcusdt@depth"})
+	assert.True(errors.Is(err, hwebsocket.ErrNotConnected), "%v", err)
+	assert.Less(int64(time.Since(start)), int64(100*time.Millisecond))
+	assert.Empty(binanceWebsocket.Subscriptions())
+}
+
+func TestBinanceWebsocket_ReadDeadline(t *testing.T) {
+	assert := assert.New(t)
+	disconnects := make(chan error, 10)
+	sim, binanceWebsocket, messages := openSimulated(t, func(binanceWebsocket *binancewebsocket.BinanceWebsocket) {
+		binanceWebsocket.ReadDeadline = time.Second
+		binanceWebsocket.OnDisconnect = func(streams []string, err error) { disconnects <- err }
+	})
+	assert.NoError(binanceWebsocket.Subscribe([]string{"btcusdt@depth"}))
+
+	// The pings keep a connection without events alive
+	time.Sleep(1500 * time.Millisecond)
+	assert.Len(disconnects, 0)
+
+	// A half-open connection is dropped once the deadline passes, and replaced
+	sim.Silence()
+	select {
+	case err := <-disconnects:
+		assert.Contains(err.Error(), "timeout")
+	case <-time.After(2 * time.Second):
+		assert.Fail("The silent connection was not dropped within the deadline")
+	}
+	assert.Eventually(func() bool {
+		return sim.Connections() == 1 && len(sim.Subscriptions()) == 1
+	}, time.Second, time.Millisecond)
+	// The response to the resubscription is not awaited, so it is forwarded
+	<-messages
+
+	sim.Publish("BTCUSDT", 1)
+	select {
+	case msg := <-messages:
+		assert.Contains(string(msg), `"s":"BTCUSDT"`)
+	case <-time.After(time.Second):
+		assert.Fail("The depth update was not forwarded on the new connection")
+	}
+}
+
+func TestBinanceWebsocket_Sharding(t *testing.T) {
+	assert := assert.New(t)
+	sim, binanceWebsocket, messages := openSimulated(t, func(binanceWebsocket *binancewebsocket.BinanceWebsocket) {
+		binanceWebsocket.MaxStreams = 2
+	})
+
+	assert.NoError(binanceWebsocket.Subscribe([]string{"btcusdt@depth", "ethusdt@depth", "bnbusdt@depth"}))
+	assert.Len(binanceWebsocket.Connections(), 2)
+	assert.Equal(2, sim.Connections())
+	assert.Equal([]string{"btcusdt@depth", "ethusdt@depth"}, binanceWebsocket.Connections()[0].Subscriptions())
+	assert.Equal([]string{"bnbusdt@depth"}, binanceWebsocket.Connections()[1].Subscriptions())
+
+	// Room freed on the first connection is used before opening another
+	assert.NoError(binanceWebsocket.Unsubscribe([]string{"ethusdt@depth"}))
+	assert.NoError(binanceWebsocket.Subscribe([]string{"btcusdt@depth", "adausdt@depth", "xrpusdt@depth"}))
+	assert.Len(binanceWebsocket.Connections(), 2)
+	assert.Equal([]string{"adausdt@depth", "btcusdt@depth"}, binanceWebsocket.Connections()[0].Subscriptions())
+	assert.Equal([]string{"bnbusdt@depth", "xrpusdt@depth"}, binanceWebsocket.Connections()[1].Subscriptions())
+
+	streams, err := binanceWebsocket.ListSubscriptions()
+	assert.NoError(err)
+	assert.Equal([]string{"adausdt@depth", "bnbusdt@depth", "btcusdt@depth", "xrpusdt@depth"}, streams)
+	assert.Equal(streams, binanceWebsocket.Subscriptions())
+	assert.True(binanceWebsocket.IsRunning())
+
+	sim.Publish("BTCUSDT", 1)
+	select {
+	case msg := <-messages:
+		assert.Contains(string(msg), `"s":"BTCUSDT"`)
+	case <-time.After(time.Second):
+		assert.Fail("The depth update was not forwarded")
+	}
+
+	// One connection giving up stops the feed as a whole
+	binanceWebsocket.Connections()[1].Close()
+	select {
+	case <-binanceWebsocket.Done():
+	case <-time.After(time.Second):
+		assert.Fail("The feed did not stop")
+	}
+	assert.False(binanceWebsocket.IsRunning())
+}
+
+func TestBinanceWebsocket_RateLimit(t *testing.T) {
+	assert := assert.New(t)
+	_, binanceWebsocket, _ := openSimulated(t, func(binanceWebsocket *binancewebsocket.BinanceWebsocket) {
+		binanceWebsocket.MessageRateLimit = 20
+		binanceWebsocket.MessageBurst = 1
+	})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := binanceWebsocket.ListSubscriptions()
+		assert.NoError(err)
+	}
+	assert.GreaterOrEqual(int64(time.Since(start)), int64(200*time.Millisecond), "5 requests at 20 per second take at least 4 intervals")
+}
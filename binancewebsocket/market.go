@@ -0,0 +1,90 @@
+package binancewebsocket
+
+// MarketType selects which Binance market a stream or book belongs to. The
+// markets differ in hosts, REST endpoints and depth update sequencing rules.
+type MarketType string
+
+const (
+	// MarketSpot ...
+	MarketSpot MarketType = "spot"
+	// MarketUSDMFutures USDⓈ-M futures, the default
+	MarketUSDMFutures MarketType = "usdm"
+	// MarketCOINMFutures ...
+	MarketCOINMFutures MarketType = "coinm"
+)
+
+// IsFutures reports whether the market sequences depth updates with pu. An
+// empty MarketType is treated as USD-M futures.
+func (m MarketType) IsFutures() bool {
+	return m != MarketSpot
+}
+
+// DepthSnapshotEndpoint returns the path of the REST order book snapshot
+func (m MarketType) DepthSnapshotEndpoint() string {
+	switch m {
+	case MarketSpot:
+		return "/api/v3/depth"
+	case MarketCOINMFutures:
+		return "/dapi/v1/depth"
+	}
+	return "/fapi/v1/depth"
+}
+
+// RESTBaseURL ...
+func (m MarketType) RESTBaseURL(isTestnet bool) string {
+	switch m {
+	case MarketSpot:
+		if isTestnet {
+			return "https://testnet.binance.vision"
+		}
+		return "https://api.binance.com"
+	case MarketCOINMFutures:
+		if isTestnet {
+			return "https://testnet.binancefuture.com"
+		}
+		return "https://dapi.binance.com"
+	}
+	if isTestnet {
+		return "https://testnet.binancefuture.com"
+	}
+	return "https://fapi.binance.com"
+}
+
+// WebsocketHost ...
+func (m MarketType) WebsocketHost(isTestnet bool) string {
+	switch m {
+	case MarketSpot:
+		if isTestnet {
+			return "testnet.binance.vision"
+		}
+		return "stream.binance.com:9443"
+	case MarketCOINMFutures:
+		if isTestnet {
+			return "dstream.binancefuture.com"
+		}
+		return "dstream.binance.com"
+	}
+	if isTestnet {
+		return "stream.binancefuture.com"
+	}
+	return "fstream.binance.com"
+}
+
+// MessageRateLimit returns a rate, per second, safely under the market's cap
+// on the messages a connection may send, pings and pongs included. Binance
+// drops the connections that exceed it.
+func (m MarketType) MessageRateLimit() float64 {
+	if m == MarketSpot {
+		return 4 // Of 5
+	}
+	return 8 // Of 10
+}
+
+// MaxStreamsPerConnection returns the market's cap on the streams a single
+// connection may subscribe to
+func (m MarketType) MaxStreamsPerConnection() int {
+	if m == MarketSpot {
+		return 1024
+	}
+	return 200
+}
@@ -2,9 +2,9 @@ package binancewebsocket
 
 // LiveRequest ...
 type LiveRequest struct {
-	ID     int64    `json:"id"`
-	Method string   `json:"method"`
-	Params []string `json:"params"`
+	ID     int64         `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params,omitempty"` // Stream names, or a property name and value
 }
 
 // LiveResponse ...
@@ -23,7 +23,153 @@ type DepthUpdate struct {
 	Symbol               string      `json:"s"`
 	FirstUpdateID        int64       `json:"U"`
 	LastUpdateID         int64       `json:"u"`
-	PreviousLastUpdateID int64       `json:"pu"`
+	PreviousLastUpdateID int64       `json:"pu"` // Futures only
+	Pair                 string      `json:"ps"` // COIN-M futures only
 	BidDepthDelta        [][2]string `json:"b"`
 	AskDepthDelta        [][2]string `json:"a"`
+
+	// Market is not part of the payload. It selects the sequencing rules below
+	// and is set by whoever knows which market the stream belongs to.
+	Market MarketType `json:"-"`
+}
+
+// IsStale reports whether a book at lastUpdateID already contains every change in the event
+func (du DepthUpdate) IsStale(lastUpdateID int64) bool {
+	if du.Market.IsFutures() {
+		return du.LastUpdateID < lastUpdateID
+	}
+	return du.LastUpdateID <= lastUpdateID
+}
+
+// Straddles reports whether the event can be the first one applied on top of a
+// snapshot at lastUpdateID. Stale events must be dropped before asking.
+func (du DepthUpdate) Straddles(lastUpdateID int64) bool {
+	if du.Market.IsFutures() {
+		// U <= lastUpdateId AND u >= lastUpdateId
+		return du.FirstUpdateID <= lastUpdateID && du.LastUpdateID >= lastUpdateID
+	}
+	// U <= lastUpdateId+1 AND u >= lastUpdateId+1
+	return du.FirstUpdateID <= lastUpdateID+1 && du.LastUpdateID >= lastUpdateID+1
+}
+
+// Continues reports whether the event directly follows the previously applied
+// event, whose u was lastUpdateID
+func (du DepthUpdate) Continues(lastUpdateID int64) bool {
+	if du.Market.IsFutures() {
+		// Each new event's pu should be equal to the previous event's u
+		return du.PreviousLastUpdateID == lastUpdateID
+	}
+	// Each new event's U should be equal to the previous event's u+1
+	return du.FirstUpdateID == lastUpdateID+1
+}
+
+// The payloads below declare every key Binance sends that differs from
+// another only in case, e.g. both "t" and "T", so that neither is decoded into
+// the field of the other
+
+// Trade ...
+type Trade struct {
+	EventType     string `json:"e"`
+	EventTime     int64  `json:"E"`
+	Symbol        string `json:"s"`
+	TradeID       int64  `json:"t"`
+	Price         string `json:"p"`
+	Quantity      string `json:"q"`
+	BuyerOrderID  int64  `json:"b"` // Spot only
+	SellerOrderID int64  `json:"a"` // Spot only
+	TradeTime     int64  `json:"T"`
+	IsBuyerMaker  bool   `json:"m"`
+	Ignore        bool   `json:"M"`
+}
+
+// AggTrade ...
+type AggTrade struct {
+	EventType    string `json:"e"`
+	EventTime    int64  `json:"E"`
+	Symbol       string `json:"s"`
+	AggTradeID   int64  `json:"a"`
+	Price        string `json:"p"`
+	Quantity     string `json:"q"`
+	FirstTradeID int64  `json:"f"`
+	LastTradeID  int64  `json:"l"`
+	TradeTime    int64  `json:"T"`
+	IsBuyerMaker bool   `json:"m"`
+	Ignore       bool   `json:"M"` // Spot only
+}
+
+// BookTicker is the best bid and ask. On spot it carries no event type or
+// times, and is only recognised on the combined stream endpoint.
+type BookTicker struct {
+	EventType       string `json:"e"` // Futures only
+	EventTime       int64  `json:"E"` // Futures only
+	TransactionTime int64  `json:"T"` // Futures only
+	UpdateID        int64  `json:"u"`
+	Symbol          string `json:"s"`
+	BestBidPrice    string `json:"b"`
+	BestBidQuantity string `json:"B"`
+	BestAskPrice    string `json:"a"`
+	BestAskQuantity string `json:"A"`
+}
+
+// MarkPriceUpdate ...
+type MarkPriceUpdate struct {
+	EventType            string `json:"e"`
+	EventTime            int64  `json:"E"`
+	Symbol               string `json:"s"`
+	MarkPrice            string `json:"p"`
+	IndexPrice           string `json:"i"`
+	EstimatedSettlePrice string `json:"P"`
+	FundingRate          string `json:"r"`
+	NextFundingTime      int64  `json:"T"`
+}
+
+// ForceOrder is a liquidation order
+type ForceOrder struct {
+	EventType string           `json:"e"`
+	EventTime int64            `json:"E"`
+	Order     ForceOrderDetail `json:"o"`
+}
+
+// ForceOrderDetail ...
+type ForceOrderDetail struct {
+	Symbol                    string `json:"s"`
+	Side                      string `json:"S"`
+	OrderType                 string `json:"o"`
+	TimeInForce               string `json:"f"`
+	Quantity                  string `json:"q"`
+	Price                     string `json:"p"`
+	AveragePrice              string `json:"ap"`
+	OrderStatus               string `json:"X"`
+	LastFilledQuantity        string `json:"l"`
+	AccumulatedFilledQuantity string `json:"z"`
+	TradeTime                 int64  `json:"T"`
+}
+
+// KlineEvent ...
+type KlineEvent struct {
+	EventType string `json:"e"`
+	EventTime int64  `json:"E"`
+	Symbol    string `json:"s"`
+	Kline     Kline  `json:"k"`
+}
+
+// Kline is a candlestick, open until IsClosed
+type Kline struct {
+	StartTime           int64  `json:"t"`
+	CloseTime           int64  `json:"T"`
+	Symbol              string `json:"s"`
+	Interval            string `json:"i"`
+	FirstTradeID        int64  `json:"f"`
+	LastTradeID         int64  `json:"L"`
+	Open                string `json:"o"`
+	Close               string `json:"c"`
+	High                string `json:"h"`
+	Low                 string `json:"l"`
+	Volume              string `json:"v"`
+	NumberOfTrades      int64  `json:"n"`
+	IsClosed            bool   `json:"x"`
+	QuoteVolume         string `json:"q"`
+	TakerBuyVolume      string `json:"V"`
+	TakerBuyQuoteVolume string `json:"Q"`
+	Ignore              string `json:"B"`
 }
@@ -0,0 +1,267 @@
+package binancewebsocket
+
+import (
+	"fmt"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Event types, the e field of each payload
+const (
+	EventTypeDepthUpdate     = "depthUpdate"
+	EventTypeTrade           = "trade"
+	EventTypeAggTrade        = "aggTrade"
+	EventTypeBookTicker      = "bookTicker"
+	EventTypeMarkPriceUpdate = "markPriceUpdate"
+	EventTypeForceOrder      = "forceOrder"
+	EventTypeKline           = "kline"
+)
+
+// streamEventTypes is the event type of each stream type, for the payloads
+// that do not carry one, e.g. the spot bookTicker
+var streamEventTypes = map[string]string{
+	"depth":      EventTypeDepthUpdate,
+	"trade":      EventTypeTrade,
+	"aggTrade":   EventTypeAggTrade,
+	"bookTicker": EventTypeBookTicker,
+	"markPrice":  EventTypeMarkPriceUpdate,
+	"forceOrder": EventTypeForceOrder,
+	"kline":      EventTypeKline,
+}
+
+// CombinedStreamMessage wraps every payload on the combined stream endpoint
+type CombinedStreamMessage struct {
+	Stream string              `json:"stream"`
+	Data   jsoniter.RawMessage `json:"data"`
+}
+
+// CombinedStreamURL returns the combined stream endpoint of the raw endpoint
+// rawURL, e.g. wss://fstream.binance.com/stream?streams=btcusdt@depth/ethusdt@depth
+// for wss://fstream.binance.com/ws/. The streams in the URL are subscribed
+// again on every reconnect, even once unsubscribed, so streams that come and
+// go are better subscribed with live requests.
+func CombinedStreamURL(rawURL string, streams []string) string {
+	combinedURL := strings.TrimSuffix(strings.TrimSuffix(rawURL, "/"), "/ws") + "/stream"
+	if len(streams) == 0 {
+		return combinedURL
+	}
+	return combinedURL + "?streams=" + strings.Join(streams, "/")
+}
+
+// StreamType returns the type of a stream name, e.g. "depth" for
+// btcusdt@depth@100ms, "kline" for btcusdt@kline_1m or "forceOrder" for the
+// all market !forceOrder@arr
+func StreamType(stream string) string {
+	parts := strings.Split(stream, "@")
+	streamType := parts[0]
+	if strings.HasPrefix(streamType, "!") {
+		streamType = strings.TrimPrefix(streamType, "!")
+	} else if len(parts) > 1 {
+		streamType = parts[1]
+	}
+
+	if i := strings.Index(streamType, "_"); i >= 0 {
+		streamType = streamType[:i]
+	}
+	return streamType
+}
+
+// ParseError is returned by Router for a message that could not be decoded
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return "parsing the message: " + e.Err.Error()
+}
+
+// Unwrap ...
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// EventHandleFunc handles the payload of an event. stream is empty on the raw
+// stream endpoint, where payloads do not name their stream.
+type EventHandleFunc func(stream string, data []byte) error
+
+// Router dispatches the messages of a connection to the handler registered for
+// their event type, decoded into its typed payload. Every message is peeked at
+// once: responses to live requests are told apart by their id, events by their
+// e field. Messages from the combined stream endpoint are unwrapped first, and
+// their stream type stands in for a missing e field. The array payloads of the
+// all market streams, e.g. !markPrice@arr, are dispatched element by element.
+type Router struct {
+	handlers map[string]EventHandleFunc
+
+	LiveResponseHandleFunc func(LiveResponse) error
+	// UnknownEventHandleFunc is given the events without a handler. eventType
+	// is empty when it could not be told. Without it they are an error.
+	UnknownEventHandleFunc func(eventType, stream string, data []byte) error
+}
+
+// NewRouter ...
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[string]EventHandleFunc),
+	}
+}
+
+// Handle registers the handler of an event type, e.g. EventTypeTrade
+func (r *Router) Handle(eventType string, f EventHandleFunc) *Router {
+	r.handlers[eventType] = f
+	return r
+}
+
+// HandleDepthUpdate ...
+func (r *Router) HandleDepthUpdate(f func(stream string, depthUpdate DepthUpdate) error) *Router {
+	return r.Handle(EventTypeDepthUpdate, func(stream string, data []byte) error {
+		var depthUpdate DepthUpdate
+		if err := decode(data, &depthUpdate); err != nil {
+			return err
+		}
+		return f(stream, depthUpdate)
+	})
+}
+
+// HandleTrade ...
+func (r *Router) HandleTrade(f func(stream string, trade Trade) error) *Router {
+	return r.Handle(EventTypeTrade, func(stream string, data []byte) error {
+		var trade Trade
+		if err := decode(data, &trade); err != nil {
+			return err
+		}
+		return f(stream, trade)
+	})
+}
+
+// HandleAggTrade ...
+func (r *Router) HandleAggTrade(f func(stream string, aggTrade AggTrade) error) *Router {
+	return r.Handle(EventTypeAggTrade, func(stream string, data []byte) error {
+		var aggTrade AggTrade
+		if err := decode(data, &aggTrade); err != nil {
+			return err
+		}
+		return f(stream, aggTrade)
+	})
+}
+
+// HandleBookTicker ...
+func (r *Router) HandleBookTicker(f func(stream string, bookTicker BookTicker) error) *Router {
+	return r.Handle(EventTypeBookTicker, func(stream string, data []byte) error {
+		var bookTicker BookTicker
+		if err := decode(data, &bookTicker); err != nil {
+			return err
+		}
+		return f(stream, bookTicker)
+	})
+}
+
+// HandleMarkPriceUpdate ...
+func (r *Router) HandleMarkPriceUpdate(f func(stream string, markPriceUpdate MarkPriceUpdate) error) *Router {
+	return r.Handle(EventTypeMarkPriceUpdate, func(stream string, data []byte) error {
+		var markPriceUpdate MarkPriceUpdate
+		if err := decode(data, &markPriceUpdate); err != nil {
+			return err
+		}
+		return f(stream, markPriceUpdate)
+	})
+}
+
+// HandleForceOrder ...
+func (r *Router) HandleForceOrder(f func(stream string, forceOrder ForceOrder) error) *Router {
+	return r.Handle(EventTypeForceOrder, func(stream string, data []byte) error {
+		var forceOrder ForceOrder
+		if err := decode(data, &forceOrder); err != nil {
+			return err
+		}
+		return f(stream, forceOrder)
+	})
+}
+
+// HandleKline ...
+func (r *Router) HandleKline(f func(stream string, klineEvent KlineEvent) error) *Router {
+	return r.Handle(EventTypeKline, func(stream string, data []byte) error {
+		var klineEvent KlineEvent
+		if err := decode(data, &klineEvent); err != nil {
+			return err
+		}
+		return f(stream, klineEvent)
+	})
+}
+
+// HandleMessage is the connection's message handler. Messages that cannot be
+// decoded return a *ParseError.
+func (r *Router) HandleMessage(msg []byte) error {
+	var envelope struct {
+		CombinedStreamMessage
+		LiveResponse
+		EventType string `json:"e"`
+		EventTime int64  `json:"E"` // Declared so it is not decoded into EventType
+	}
+	if err := decode(msg, &envelope); err != nil {
+		return err
+	}
+
+	switch {
+	case envelope.Stream != "":
+		return r.dispatchData(envelope.Stream, envelope.Data)
+	case envelope.ID > 0 || envelope.ErrorCode != 0:
+		if r.LiveResponseHandleFunc == nil {
+			return nil
+		}
+		return r.LiveResponseHandleFunc(envelope.LiveResponse)
+	}
+	return r.dispatch(envelope.EventType, "", msg)
+}
+
+// dispatchData dispatches the data of a combined stream message
+func (r *Router) dispatchData(stream string, data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		var elements []jsoniter.RawMessage
+		if err := decode(data, &elements); err != nil {
+			return err
+		}
+		for _, element := range elements {
+			if err := r.dispatchData(stream, element); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var event struct {
+		EventType string `json:"e"`
+		EventTime int64  `json:"E"`
+	}
+	if err := decode(data, &event); err != nil {
+		return err
+	}
+	eventType := event.EventType
+	if eventType == "" {
+		eventType = streamEventTypes[StreamType(stream)]
+	}
+	return r.dispatch(eventType, stream, data)
+}
+
+func (r *Router) dispatch(eventType, stream string, data []byte) error {
+	if f, ok := r.handlers[eventType]; ok {
+		return f(stream, data)
+	}
+	if r.UnknownEventHandleFunc != nil {
+		return r.UnknownEventHandleFunc(eventType, stream, data)
+	}
+	if eventType == "" {
+		return fmt.Errorf("no event type in message %s", data)
+	}
+	return fmt.Errorf("no handler for %s events", eventType)
+}
+
+// decode returns a *ParseError when data cannot be decoded into v
+func decode(data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return &ParseError{err}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package binancewebsocket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamType(t *testing.T) {
+	testCases := []struct {
+		stream             string
+		expectedStreamType string
+	}{
+		{"btcusdt@depth", "depth"},
+		{"btcusdt@depth@100ms", "depth"},
+		{"btcusdt@depth20@100ms", "depth20"},
+		{"btcusdt@kline_1m", "kline"},
+		{"btcusdt@markPrice@1s", "markPrice"},
+		{"!forceOrder@arr", "forceOrder"},
+		{"!bookTicker", "bookTicker"},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expectedStreamType, StreamType(testCase.stream), testCase.stream)
+	}
+}
+
+func TestCombinedStreamURL(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("wss://fstream.binance.com/stream", CombinedStreamURL("wss://fstream.binance.com/ws/", nil))
+	assert.Equal("wss://fstream.binance.com/stream?streams=btcusdt@depth/ethusdt@depth@100ms",
+		CombinedStreamURL("wss://fstream.binance.com/ws", []string{"btcusdt@depth", "ethusdt@depth@100ms"}))
+}
+
+func TestRouter(t *testing.T) {
+	assert := assert.New(t)
+
+	var routed []string
+	router := NewRouter().
+		HandleDepthUpdate(func(stream string, depthUpdate DepthUpdate) error {
+			routed = append(routed, fmt.Sprint(stream, " depthUpdate ", depthUpdate.Symbol, " ", depthUpdate.LastUpdateID))
+			return nil
+		}).
+		HandleTrade(func(stream string, trade Trade) error {
+			routed = append(routed, fmt.Sprint(stream, " trade ", trade.TradeID, " ", trade.TradeTime, " ", trade.IsBuyerMaker))
+			return nil
+		}).
+		HandleAggTrade(func(stream string, aggTrade AggTrade) error {
+			routed = append(routed, fmt.Sprint(stream, " aggTrade ", aggTrade.AggTradeID, " ", aggTrade.Price))
+			return nil
+		}).
+		HandleBookTicker(func(stream string, bookTicker BookTicker) error {
+			routed = append(routed, fmt.Sprint(stream, " bookTicker ", bookTicker.BestBidPrice, " ", bookTicker.BestBidQuantity))
+			return nil
+		}).
+		HandleMarkPriceUpdate(func(stream string, markPriceUpdate MarkPriceUpdate) error {
+			routed = append(routed, fmt.Sprint(stream, " markPriceUpdate ", markPriceUpdate.Symbol, " ", markPriceUpdate.MarkPrice, " ", markPriceUpdate.EstimatedSettlePrice))
+			return nil
+		}).
+		HandleForceOrder(func(stream string, forceOrder ForceOrder) error {
+			routed = append(routed, fmt.Sprint(stream, " forceOrder ", forceOrder.Order.Symbol, " ", forceOrder.Order.Side))
+			return nil
+		}).
+		HandleKline(func(stream string, klineEvent KlineEvent) error {
+			routed = append(routed, fmt.Sprint(stream, " kline ", klineEvent.Kline.Interval, " ", klineEvent.Kline.Low, " ", klineEvent.Kline.LastTradeID))
+			return nil
+		})
+	router.LiveResponseHandleFunc = func(liveResponse LiveResponse) error {
+		routed = append(routed, fmt.Sprint("live response ", liveResponse.ID))
+		if liveResponse.ErrorCode != 0 {
+			return errors.New(liveResponse.ErrorMessage)
+		}
+		return nil
+	}
+
+	messages := []string{
+		`{"e":"depthUpdate","E":1,"T":1,"s":"BTCUSDT","U":1,"u":2,"pu":0,"b":[],"a":[]}`,
+		`{"stream":"btcusdt@depth@100ms","data":{"e":"depthUpdate","E":2,"s":"BTCUSDT","U":3,"u":4,"b":[],"a":[]}}`,
+		`{"e":"trade","E":1,"s":"BNBBTC","t":12345,"p":"0.001","q":"100","b":88,"a":50,"T":123456785,"m":true,"M":true}`,
+		`{"e":"aggTrade","E":1,"s":"BTCUSDT","a":5933014,"p":"0.001","q":"100","f":100,"l":105,"T":123456785,"m":true}`,
+		`{"stream":"bnbusdt@bookTicker","data":{"u":400900217,"s":"BNBUSDT","b":"25.35","B":"31.21","a":"25.36","A":"40.66"}}`,
+		`{"stream":"!markPrice@arr","data":[{"e":"markPriceUpdate","E":1,"s":"BTCUSDT","p":"11794.15","i":"11784.62","P":"11784.25","r":"0.00038","T":1},{"e":"markPriceUpdate","E":1,"s":"ETHUSDT","p":"400.1","i":"400","P":"400.2","r":"0.0001","T":1}]}`,
+		`{"e":"forceOrder","E":1,"o":{"s":"BTCUSDT","S":"SELL","o":"LIMIT","f":"IOC","q":"0.014","p":"9910","ap":"9910","X":"FILLED","l":"0.014","z":"0.014","T":1}}`,
+		`{"e":"kline","E":1,"s":"BNBBTC","k":{"t":1,"T":2,"s":"BNBBTC","i":"1m","f":100,"L":200,"o":"0.0010","c":"0.0020","h":"0.0025","l":"0.0015","v":"1000","n":100,"x":false,"q":"1.0","V":"500","Q":"0.5","B":"0"}}`,
+		`{"result":null,"id":1}`,
+	}
+	for _, msg := range messages {
+		assert.NoError(router.HandleMessage([]byte(msg)), msg)
+	}
+	assert.EqualError(router.HandleMessage([]byte(`{"code":2,"msg":"Invalid request","id":2}`)), "Invalid request")
+	assert.Equal([]string{
+		" depthUpdate BTCUSDT 2",
+		"btcusdt@depth@100ms depthUpdate BTCUSDT 4",
+		" trade 12345 123456785 true",
+		" aggTrade 5933014 0.001",
+		"bnbusdt@bookTicker bookTicker 25.35 31.21",
+		"!markPrice@arr markPriceUpdate BTCUSDT 11794.15 11784.25",
+		"!markPrice@arr markPriceUpdate ETHUSDT 400.1 400.2",
+		" forceOrder BTCUSDT SELL",
+		" kline 1m 0.0015 200",
+		"live response 1",
+		"live response 2",
+	}, routed)
+
+	assert.EqualError(router.HandleMessage([]byte(`{"e":"24hrTicker","E":1}`)), "no handler for 24hrTicker events")
+	assert.EqualError(router.HandleMessage([]byte(`{"u":1,"s":"BNBUSDT","b":"1","B":"1","a":"1","A":"1"}`)), `no event type in message {"u":1,"s":"BNBUSDT","b":"1","B":"1","a":"1","A":"1"}`)
+
+	var parseError *ParseError
+	assert.True(errors.As(router.HandleMessage([]byte(`{"stream":`)), &parseError))
+	assert.True(errors.As(router.HandleMessage([]byte(`{"stream":"btcusdt@depth","data":{"e":"depthUpdate","u":"x"}}`)), &parseError))
+
+	var unknown []string
+	router.UnknownEventHandleFunc = func(eventType, stream string, data []byte) error {
+		unknown = append(unknown, eventType+" "+stream)
+		return nil
+	}
+	assert.NoError(router.HandleMessage([]byte(`{"stream":"!ticker@arr","data":[{"e":"24hrTicker","E":1}]}`)))
+	assert.NoError(router.HandleMessage([]byte(`{"lastUpdateId":1,"bids":[],"asks":[]}`)))
+	assert.Equal([]string{"24hrTicker !ticker@arr", " "}, unknown)
+}
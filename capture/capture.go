@@ -0,0 +1,162 @@
+/*
+  Package capture records raw exchange traffic so that order book problems can
+  be reproduced later. A capture file is a gzip stream of length-delimited
+  records:
+
+    uvarint(len(record)) | record
+
+  where a record is
+
+    kind (1 byte) | receivedAt (8 bytes, big-endian unix nanoseconds) | uvarint(len(source)) | source | payload
+*/
+
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Kind of a record
+type Kind byte
+
+const (
+	// KindFrame is an inbound websocket frame. Source is the websocket URL.
+	KindFrame Kind = 1
+	// KindSnapshot is a REST depth snapshot response body. Source is the symbol.
+	KindSnapshot Kind = 2
+)
+
+// maxRecordSize guards against reading garbage as a huge length prefix
+const maxRecordSize = 64 << 20
+
+// ErrCorruptRecord is returned by Reader.Next for records it cannot decode
+var ErrCorruptRecord = errors.New("capture: corrupt record")
+
+func (k Kind) String() string {
+	switch k {
+	case KindFrame:
+		return "frame"
+	case KindSnapshot:
+		return "snapshot"
+	}
+	return fmt.Sprintf("kind(%d)", byte(k))
+}
+
+// Record ...
+type Record struct {
+	Kind       Kind
+	ReceivedAt time.Time
+	Source     string
+	Payload    []byte
+}
+
+// Writer writes records to a single capture stream
+type Writer struct {
+	gzipWriter *gzip.Writer
+	header     []byte
+}
+
+// NewWriter ...
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		gzipWriter: gzip.NewWriter(w),
+		header:     make([]byte, 0, 2*binary.MaxVarintLen64+9),
+	}
+}
+
+// Write appends a record to the stream
+func (cw *Writer) Write(record Record) error {
+	recordLength := 1 + 8 + uvarintLength(uint64(len(record.Source))) + len(record.Source) + len(record.Payload)
+
+	header := cw.header[:0]
+	header = appendUvarint(header, uint64(recordLength))
+	header = append(header, byte(record.Kind))
+	var receivedAt [8]byte
+	binary.BigEndian.PutUint64(receivedAt[:], uint64(record.ReceivedAt.UnixNano()))
+	header = append(header, receivedAt[:]...)
+	header = appendUvarint(header, uint64(len(record.Source)))
+
+	for _, part := range [][]byte{header, []byte(record.Source), record.Payload} {
+		_, err := cw.gzipWriter.Write(part)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush pushes buffered records to the underlying writer
+func (cw *Writer) Flush() error {
+	return cw.gzipWriter.Flush()
+}
+
+// Close flushes and terminates the gzip stream. It does not close the underlying writer.
+func (cw *Writer) Close() error {
+	return cw.gzipWriter.Close()
+}
+
+// Reader reads records from a capture stream
+type Reader struct {
+	reader *bufio.Reader
+}
+
+// NewReader ...
+func NewReader(r io.Reader) (*Reader, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{reader: bufio.NewReader(gzipReader)}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the stream
+func (cr *Reader) Next() (Record, error) {
+	recordLength, err := binary.ReadUvarint(cr.reader)
+	if err != nil {
+		return Record{}, err
+	}
+	if recordLength < 9 || recordLength > maxRecordSize {
+		return Record{}, ErrCorruptRecord
+	}
+
+	data := make([]byte, recordLength)
+	_, err = io.ReadFull(cr.reader, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+
+	record := Record{
+		Kind:       Kind(data[0]),
+		ReceivedAt: time.Unix(0, int64(binary.BigEndian.Uint64(data[1:9]))),
+	}
+
+	sourceLength, n := binary.Uvarint(data[9:])
+	if n <= 0 || uint64(len(data)-9-n) < sourceLength {
+		return Record{}, ErrCorruptRecord
+	}
+	sourceStart := 9 + n
+	record.Source = string(data[sourceStart : sourceStart+int(sourceLength)])
+	record.Payload = data[sourceStart+int(sourceLength):]
+
+	return record, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], v)
+	return append(buf, varint[:n]...)
+}
+
+func uvarintLength(v uint64) int {
+	var varint [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(varint[:], v)
+}
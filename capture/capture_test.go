@@ -0,0 +1,79 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture_RoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	records := []Record{
+		{KindFrame, time.Unix(0, 1600000000123456789), "wss://stream.binancefuture.com/ws/", []byte(`{"e":"depthUpdate"}`)},
+		{KindSnapshot, time.Unix(0, 1600000000223456789), "BTCUSDT", []byte(`{"lastUpdateId":1}`)},
+		{KindFrame, time.Unix(0, 1600000000323456789), "", []byte{}},
+	}
+
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+	for _, record := range records {
+		assert.NoError(writer.Write(record))
+	}
+	assert.NoError(writer.Close())
+
+	reader, err := NewReader(&buffer)
+	assert.NoError(err)
+	for _, expected := range records {
+		record, err := reader.Next()
+		assert.NoError(err)
+		assert.Equal(expected.Kind, record.Kind)
+		assert.True(expected.ReceivedAt.Equal(record.ReceivedAt))
+		assert.Equal(expected.Source, record.Source)
+		assert.Equal(expected.Payload, record.Payload)
+	}
+	_, err = reader.Next()
+	assert.Equal(io.EOF, err)
+}
+
+func TestCapture_RecorderRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "capture")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	recorder, err := NewRecorder(dir, "test", 1, 0)
+	assert.NoError(err)
+
+	// Snapshots are flushed straight away, so every record overflows the 1 byte limit
+	for i := 0; i < 3; i++ {
+		assert.NoError(recorder.RecordSnapshot("BTCUSDT", time.Now(), []byte(`{"lastUpdateId":1}`)))
+	}
+	assert.NoError(recorder.Close())
+
+	files, err := Files(dir, "test")
+	assert.NoError(err)
+	assert.Len(files, 3)
+
+	for _, name := range files {
+		file, err := os.Open(name)
+		assert.NoError(err)
+
+		reader, err := NewReader(file)
+		assert.NoError(err)
+		record, err := reader.Next()
+		assert.NoError(err)
+		assert.Equal(KindSnapshot, record.Kind)
+		assert.Equal("BTCUSDT", record.Source)
+
+		_, err = reader.Next()
+		assert.Equal(io.EOF, err)
+		file.Close()
+	}
+}
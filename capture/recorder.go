@@ -0,0 +1,165 @@
+package capture
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// flushInterval bounds how much traffic is lost if the process dies
+const flushInterval = time.Second
+
+// Recorder writes records to capture files in a directory, starting a new file
+// whenever the current one reaches MaxBytes (compressed) or MaxAge
+type Recorder struct {
+	Dir      string
+	Prefix   string
+	MaxBytes int64         // 0 disables size-based rotation
+	MaxAge   time.Duration // 0 disables time-based rotation
+
+	file      *os.File
+	counter   *countingWriter
+	writer    *Writer
+	openedAt  time.Time
+	flushedAt time.Time
+	sequence  int
+	sync.Mutex
+}
+
+// NewRecorder creates dir if needed. The first file is opened on the first record.
+func NewRecorder(dir, prefix string, maxBytes int64, maxAge time.Duration) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		Dir:      dir,
+		Prefix:   prefix,
+		MaxBytes: maxBytes,
+		MaxAge:   maxAge,
+	}, nil
+}
+
+// RecordFrame records an inbound websocket frame
+func (r *Recorder) RecordFrame(websocketURL string, receivedAt time.Time, msg []byte) error {
+	return r.Record(Record{Kind: KindFrame, ReceivedAt: receivedAt, Source: websocketURL, Payload: msg})
+}
+
+// RecordSnapshot records a REST depth snapshot response body
+func (r *Recorder) RecordSnapshot(symbol string, receivedAt time.Time, body []byte) error {
+	return r.Record(Record{Kind: KindSnapshot, ReceivedAt: receivedAt, Source: symbol, Payload: body})
+}
+
+// Record ...
+func (r *Recorder) Record(record Record) error {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+
+	if r.writer != nil && r.shouldRotate(now) {
+		err := r.closeFile()
+		if err != nil {
+			log.Printf("[capture][%s] Error closing capture file: %s", r.Dir, err.Error())
+		}
+	}
+
+	if r.writer == nil {
+		err := r.openFile(now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := r.writer.Write(record)
+	if err != nil {
+		return err
+	}
+
+	// Snapshots are rare and precious, everything else is flushed periodically
+	if record.Kind == KindSnapshot || now.Sub(r.flushedAt) >= flushInterval {
+		r.flushedAt = now
+		return r.writer.Flush()
+	}
+	return nil
+}
+
+// Close flushes and closes the current file
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.writer == nil {
+		return nil
+	}
+	return r.closeFile()
+}
+
+// shouldRotate expects the caller to hold the lock
+func (r *Recorder) shouldRotate(now time.Time) bool {
+	if r.MaxBytes > 0 && r.counter.n >= r.MaxBytes {
+		return true
+	}
+	if r.MaxAge > 0 && now.Sub(r.openedAt) >= r.MaxAge {
+		return true
+	}
+	return false
+}
+
+// openFile expects the caller to hold the lock
+func (r *Recorder) openFile(now time.Time) error {
+	r.sequence++
+	name := fmt.Sprintf("%s-%s-%06d.cap.gz", r.Prefix, now.UTC().Format("20060102T150405Z"), r.sequence)
+
+	file, err := os.OpenFile(filepath.Join(r.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	r.file = file
+	r.counter = &countingWriter{file: file}
+	r.writer = NewWriter(r.counter)
+	r.openedAt = now
+	r.flushedAt = now
+
+	return nil
+}
+
+// closeFile expects the caller to hold the lock
+func (r *Recorder) closeFile() error {
+	err := r.writer.Close()
+	closeErr := r.file.Close()
+	r.writer, r.counter, r.file = nil, nil, nil
+
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Files returns the capture files in dir with the given prefix, oldest first
+func Files(dir, prefix string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"-*.cap.gz"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// countingWriter counts the compressed bytes written to the file
+type countingWriter struct {
+	file *os.File
+	n    int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.file.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,415 @@
+/*
+  Package config loads the service configuration. Settings are layered, each
+  overriding the one before:
+
+    1. Default()
+    2. the YAML file passed to Load, see config.example.yaml
+    3. HLOB_* environment variables, see ApplyEnv
+    4. command line flags, see Overrides
+
+  Validate must pass before the configuration is used.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/hwebsocket"
+	"gopkg.in/yaml.v3"
+)
+
+// ExchangeTypeBinance is the only exchange supported so far
+const ExchangeTypeBinance = "binance"
+
+// Config ...
+type Config struct {
+	Exchanges []Exchange `yaml:"exchanges"`
+	Servers   Servers    `yaml:"servers"`
+	Capture   Capture    `yaml:"capture"`
+	Health    Health     `yaml:"health"`
+	Shutdown  Shutdown   `yaml:"shutdown"`
+}
+
+// Exchange is one websocket feed and the books fed from it
+type Exchange struct {
+	// Name identifies the exchange in the APIs, e.g. "binance" or "binance-spot"
+	Name   string                      `yaml:"name"`
+	Type   string                      `yaml:"type"`
+	Market binancewebsocket.MarketType `yaml:"market"`
+	// Testnet selects the default endpoints when WebsocketURL or RESTBaseURL are empty
+	Testnet      bool     `yaml:"testnet"`
+	WebsocketURL string   `yaml:"websocketURL"`
+	RESTBaseURL  string   `yaml:"restBaseURL"`
+	Symbols      []string `yaml:"symbols"`
+	// CombinedStreams connects to the combined stream endpoint, where every
+	// message names its stream, rather than the raw one
+	CombinedStreams bool `yaml:"combinedStreams"`
+	// StreamSpeed is the depth stream update speed, e.g. "100ms". Empty for the
+	// market's default.
+	StreamSpeed     string        `yaml:"streamSpeed"`
+	SnapshotLimit   int           `yaml:"snapshotLimit"`
+	SnapshotTimeout time.Duration `yaml:"snapshotTimeout"`
+	// RotationInterval is how often the connection is replaced, without losing
+	// an event, ahead of Binance dropping it after 24 hours. 0 to never.
+	RotationInterval time.Duration `yaml:"rotationInterval"`
+	// Connections is the number of redundant connections to the same streams.
+	// Above 1, each depth update is taken from whichever delivers it first.
+	Connections int `yaml:"connections"`
+	// MessageRateLimit bounds the messages each connection sends per second,
+	// up to MessageBurst at once. 0 for a rate safely under the market's cap,
+	// beyond which Binance drops the connection.
+	MessageRateLimit float64 `yaml:"messageRateLimit"`
+	MessageBurst     int     `yaml:"messageBurst"`
+	// MaxStreamsPerConnection is the number of streams subscribed on a
+	// connection before another is opened. 0 for the market's cap.
+	MaxStreamsPerConnection int   `yaml:"maxStreamsPerConnection"`
+	Retry                   Retry `yaml:"retry"`
+}
+
+// Retry ...
+type Retry struct {
+	// ConnectionRetryLimit is the number of reconnect attempts before giving
+	// up, -1 to retry forever
+	ConnectionRetryLimit int `yaml:"connectionRetryLimit"`
+	// The wait before a reconnect attempt starts at ReconnectInitialDelay and
+	// doubles after every failed attempt up to ReconnectMaxDelay, spread by up
+	// to ±ReconnectJitter of itself
+	ReconnectInitialDelay time.Duration `yaml:"reconnectInitialDelay"`
+	ReconnectMaxDelay     time.Duration `yaml:"reconnectMaxDelay"`
+	ReconnectJitter       float64       `yaml:"reconnectJitter"`
+	// After CircuitBreakerThreshold failed attempts in a row, attempts are made
+	// every CircuitBreakerCooldown instead. 0 disables the circuit breaker.
+	CircuitBreakerThreshold int           `yaml:"circuitBreakerThreshold"`
+	CircuitBreakerCooldown  time.Duration `yaml:"circuitBreakerCooldown"`
+	// SnapshotRetryDelay is the wait before refetching a snapshot that failed
+	SnapshotRetryDelay time.Duration `yaml:"snapshotRetryDelay"`
+}
+
+// Servers lists the address of each server, empty to disable it
+type Servers struct {
+	HTTPAddr   string `yaml:"httpAddr"`
+	GRPCAddr   string `yaml:"grpcAddr"`
+	StreamAddr string `yaml:"streamAddr"`
+}
+
+// Capture records raw frames and snapshots when Dir is set
+type Capture struct {
+	Dir      string        `yaml:"dir"`
+	MaxBytes int64         `yaml:"maxBytes"`
+	MaxAge   time.Duration `yaml:"maxAge"`
+}
+
+// Health ...
+type Health struct {
+	StalenessWindow time.Duration `yaml:"stalenessWindow"`
+}
+
+// Shutdown ...
+type Shutdown struct {
+	// GracePeriod bounds how long unsubscribing and draining may take
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+	// RequestTimeout bounds the wait for Binance to confirm the
+	// unsubscriptions, within GracePeriod
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+}
+
+// Default is the configuration used without a file: BTCUSDT on the USDⓈ-M
+// futures testnet
+func Default() *Config {
+	return &Config{
+		Exchanges: []Exchange{DefaultExchange()},
+		Servers: Servers{
+			HTTPAddr:   "localhost:8080",
+			GRPCAddr:   "localhost:9090",
+			StreamAddr: "localhost:8081",
+		},
+		Capture: Capture{
+			MaxBytes: 256 << 20,
+			MaxAge:   time.Hour,
+		},
+		Health: Health{
+			StalenessWindow: 30 * time.Second,
+		},
+		Shutdown: Shutdown{
+			GracePeriod:    7 * time.Second,
+			RequestTimeout: 2 * time.Second,
+		},
+	}
+}
+
+// DefaultExchange ...
+func DefaultExchange() Exchange {
+	return Exchange{
+		Name:             ExchangeTypeBinance,
+		Type:             ExchangeTypeBinance,
+		Market:           binancewebsocket.MarketUSDMFutures,
+		Testnet:          true,
+		Symbols:          []string{"BTCUSDT"},
+		SnapshotLimit:    1000,
+		SnapshotTimeout:  10 * time.Second,
+		RotationInterval: binancewebsocket.DefaultRotationInterval,
+		Connections:      1,
+		MessageBurst:     1,
+		Retry: Retry{
+			ConnectionRetryLimit:   10,
+			ReconnectInitialDelay:  hwebsocket.DefaultReconnectInitialDelay,
+			ReconnectMaxDelay:      hwebsocket.DefaultReconnectMaxDelay,
+			ReconnectJitter:        hwebsocket.DefaultReconnectJitter,
+			CircuitBreakerCooldown: time.Minute,
+			SnapshotRetryDelay:     time.Second,
+		},
+	}
+}
+
+// Load reads the YAML file at path over the defaults. Exchanges in the file
+// start from DefaultExchange, so only what differs needs to be set.
+func Load(path string) (*Config, error) {
+	config := Default()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	// Decode the exchanges again, this time over their defaults
+	var file struct {
+		Exchanges []yaml.Node `yaml:"exchanges"`
+	}
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, node := range file.Exchanges {
+		exchange := DefaultExchange()
+		err = node.Decode(&exchange)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		config.Exchanges[i] = exchange
+	}
+
+	return config, nil
+}
+
+// StreamSuffix is appended to each lower-cased symbol to name its depth stream
+func (e Exchange) StreamSuffix() string {
+	if e.StreamSpeed == "" {
+		return "@depth"
+	}
+	return "@depth@" + e.StreamSpeed
+}
+
+// WebsocketEndpoint returns WebsocketURL or the market's default raw, or
+// combined, stream URL
+func (e Exchange) WebsocketEndpoint() string {
+	if e.WebsocketURL != "" {
+		return e.WebsocketURL
+	}
+	rawURL := "wss://" + e.Market.WebsocketHost(e.Testnet) + "/ws/"
+	if e.CombinedStreams {
+		return binancewebsocket.CombinedStreamURL(rawURL, nil)
+	}
+	return rawURL
+}
+
+// RateLimit returns MessageRateLimit or the market's default
+func (e Exchange) RateLimit() float64 {
+	if e.MessageRateLimit > 0 {
+		return e.MessageRateLimit
+	}
+	return e.Market.MessageRateLimit()
+}
+
+// StreamsPerConnection returns MaxStreamsPerConnection or the market's cap
+func (e Exchange) StreamsPerConnection() int {
+	if e.MaxStreamsPerConnection > 0 {
+		return e.MaxStreamsPerConnection
+	}
+	return e.Market.MaxStreamsPerConnection()
+}
+
+// RESTEndpoint returns RESTBaseURL or the market's default
+func (e Exchange) RESTEndpoint() string {
+	if e.RESTBaseURL != "" {
+		return e.RESTBaseURL
+	}
+	return e.Market.RESTBaseURL(e.Testnet)
+}
+
+// ReconnectPolicy builds the websocket's reconnect policy
+func (r Retry) ReconnectPolicy() *hwebsocket.ExponentialBackoff {
+	policy := hwebsocket.NewExponentialBackoff(r.ConnectionRetryLimit)
+	policy.InitialDelay = r.ReconnectInitialDelay
+	policy.MaxDelay = r.ReconnectMaxDelay
+	policy.Jitter = r.ReconnectJitter
+	policy.BreakerThreshold = r.CircuitBreakerThreshold
+	policy.BreakerCooldown = r.CircuitBreakerCooldown
+	return policy
+}
+
+// Validate reports every problem with the configuration at once
+func (c *Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(c.Exchanges) == 0 {
+		addProblem("at least one exchange is required")
+	}
+
+	names := make(map[string]bool)
+	for i, exchange := range c.Exchanges {
+		prefix := fmt.Sprintf("exchanges[%d]", i)
+
+		if exchange.Name == "" {
+			addProblem("%s: name is required", prefix)
+		} else if names[strings.ToLower(exchange.Name)] {
+			addProblem("%s: name %q is used more than once", prefix, exchange.Name)
+		}
+		names[strings.ToLower(exchange.Name)] = true
+
+		if exchange.Type != ExchangeTypeBinance {
+			addProblem("%s: unsupported type %q", prefix, exchange.Type)
+		}
+
+		switch exchange.Market {
+		case binancewebsocket.MarketSpot, binancewebsocket.MarketUSDMFutures, binancewebsocket.MarketCOINMFutures:
+		default:
+			addProblem("%s: unknown market %q", prefix, exchange.Market)
+		}
+
+		if len(exchange.Symbols) == 0 {
+			addProblem("%s: at least one symbol is required", prefix)
+		}
+		symbols := make(map[string]bool)
+		for _, symbol := range exchange.Symbols {
+			if symbol == "" || strings.ContainsAny(symbol, "@/ ") {
+				addProblem("%s: invalid symbol %q", prefix, symbol)
+			} else if symbols[strings.ToUpper(symbol)] {
+				addProblem("%s: symbol %s is listed more than once", prefix, symbol)
+			}
+			symbols[strings.ToUpper(symbol)] = true
+		}
+
+		if !isValidStreamSpeed(exchange.Market, exchange.StreamSpeed) {
+			addProblem("%s: stream speed %q is not offered on the %s market", prefix, exchange.StreamSpeed, exchange.Market)
+		}
+		if !isValidSnapshotLimit(exchange.Market, exchange.SnapshotLimit) {
+			addProblem("%s: snapshot limit %d is not offered on the %s market", prefix, exchange.SnapshotLimit, exchange.Market)
+		}
+		if exchange.SnapshotTimeout <= 0 {
+			addProblem("%s: snapshotTimeout must be positive", prefix)
+		}
+		if exchange.RotationInterval < 0 {
+			addProblem("%s: rotationInterval must not be negative", prefix)
+		}
+		if exchange.Connections < 1 {
+			addProblem("%s: connections must be at least 1", prefix)
+		}
+		if exchange.MessageRateLimit < 0 {
+			addProblem("%s: messageRateLimit must not be negative", prefix)
+		}
+		if exchange.MessageBurst < 1 {
+			addProblem("%s: messageBurst must be at least 1", prefix)
+		}
+		if maxStreams := exchange.Market.MaxStreamsPerConnection(); exchange.MaxStreamsPerConnection < 0 || exchange.MaxStreamsPerConnection > maxStreams {
+			addProblem("%s: maxStreamsPerConnection must be between 0 and the %s market's cap of %d", prefix, exchange.Market, maxStreams)
+		}
+		if exchange.Retry.ConnectionRetryLimit < hwebsocket.UnlimitedRetries {
+			addProblem("%s: retry.connectionRetryLimit must be -1 or more", prefix)
+		}
+		if exchange.Retry.ReconnectInitialDelay < 0 || exchange.Retry.ReconnectMaxDelay < 0 {
+			addProblem("%s: retry.reconnectInitialDelay and retry.reconnectMaxDelay must not be negative", prefix)
+		}
+		if exchange.Retry.ReconnectJitter < 0 || exchange.Retry.ReconnectJitter > 1 {
+			addProblem("%s: retry.reconnectJitter must be between 0 and 1", prefix)
+		}
+		if exchange.Retry.CircuitBreakerThreshold < 0 {
+			addProblem("%s: retry.circuitBreakerThreshold must not be negative", prefix)
+		}
+		if exchange.Retry.CircuitBreakerThreshold > 0 && exchange.Retry.CircuitBreakerCooldown <= 0 {
+			addProblem("%s: retry.circuitBreakerCooldown must be positive", prefix)
+		}
+		if exchange.Retry.SnapshotRetryDelay < 0 {
+			addProblem("%s: retry.snapshotRetryDelay must not be negative", prefix)
+		}
+	}
+
+	addrs := make(map[string]string)
+	for _, server := range []struct{ name, addr string }{
+		{"servers.httpAddr", c.Servers.HTTPAddr},
+		{"servers.grpcAddr", c.Servers.GRPCAddr},
+		{"servers.streamAddr", c.Servers.StreamAddr},
+	} {
+		if server.addr == "" {
+			continue
+		}
+		if other, ok := addrs[server.addr]; ok {
+			addProblem("%s: %s is already used by %s", server.name, server.addr, other)
+		}
+		addrs[server.addr] = server.name
+	}
+
+	if c.Capture.Dir != "" {
+		if c.Capture.MaxBytes <= 0 {
+			addProblem("capture.maxBytes must be positive")
+		}
+		if c.Capture.MaxAge <= 0 {
+			addProblem("capture.maxAge must be positive")
+		}
+	}
+	if c.Health.StalenessWindow < 0 {
+		addProblem("health.stalenessWindow must not be negative")
+	}
+	if c.Shutdown.RequestTimeout <= 0 {
+		addProblem("shutdown.requestTimeout must be positive")
+	}
+	if c.Shutdown.GracePeriod < c.Shutdown.RequestTimeout {
+		addProblem(fmt.Sprintf("shutdown.gracePeriod must not be shorter than shutdown.requestTimeout (%s)", c.Shutdown.RequestTimeout))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isValidStreamSpeed checks against the update speeds Binance offers per market
+func isValidStreamSpeed(market binancewebsocket.MarketType, streamSpeed string) bool {
+	switch streamSpeed {
+	case "":
+		return true
+	case "100ms":
+		return true
+	case "250ms", "500ms":
+		return market.IsFutures()
+	}
+	return false
+}
+
+// isValidSnapshotLimit checks against the depth limits Binance accepts per market
+func isValidSnapshotLimit(market binancewebsocket.MarketType, limit int) bool {
+	if !market.IsFutures() {
+		return limit > 0 && limit <= 5000
+	}
+	switch limit {
+	case 5, 10, 20, 50, 100, 500, 1000:
+		return true
+	}
+	return false
+}
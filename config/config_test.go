@@ -0,0 +1,169 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := Load("../config.example.yaml")
+	assert.NoError(err)
+	assert.NoError(config.Validate())
+
+	assert.Len(config.Exchanges, 2)
+	assert.Equal([]string{"BTCUSDT", "ETHUSDT"}, config.Exchanges[0].Symbols)
+	assert.Equal("@depth@100ms", config.Exchanges[0].StreamSuffix())
+	assert.Equal("wss://stream.binancefuture.com/ws/", config.Exchanges[0].WebsocketEndpoint())
+
+	// Left out of the file, so taken from DefaultExchange
+	spot := config.Exchanges[1]
+	assert.Equal(binancewebsocket.MarketSpot, spot.Market)
+	assert.Equal(ExchangeTypeBinance, spot.Type)
+	assert.Equal(1000, spot.SnapshotLimit)
+	assert.Equal(10*time.Second, spot.SnapshotTimeout)
+	assert.Equal("@depth", spot.StreamSuffix())
+	assert.Equal("https://testnet.binance.vision", spot.RESTEndpoint())
+
+	spot.CombinedStreams = true
+	assert.Equal("wss://testnet.binance.vision/stream", spot.WebsocketEndpoint())
+
+	policy := config.Exchanges[0].Retry.ReconnectPolicy()
+	assert.Equal(10, policy.MaxRetries)
+	assert.Equal(250*time.Millisecond, policy.InitialDelay)
+	assert.Equal(time.Minute, policy.BreakerCooldown)
+
+	_, err = Load("does-not-exist.yaml")
+	assert.Error(err)
+}
+
+func TestOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(ioutil.WriteFile(path, []byte("servers:\n  httpAddr: localhost:1000\n  grpcAddr: localhost:2000\n"), 0644))
+
+	config, err := Load(path)
+	assert.NoError(err)
+
+	env := map[string]string{
+		"HLOB_HTTP_ADDR": "localhost:3000",
+		"HLOB_GRPC_ADDR": "localhost:4000",
+		"HLOB_SYMBOLS":   "ethusdt, bnbusdt",
+	}
+	assert.NoError(config.ApplyEnv(func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}))
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := RegisterFlags(flagSet)
+	assert.NoError(flagSet.Parse([]string{"-grpc-addr", "", "-staleness-window", "1m"}))
+	assert.NoError(overrides.Apply(config))
+
+	assert.Equal("localhost:3000", config.Servers.HTTPAddr, "The environment overrides the file")
+	assert.Equal("", config.Servers.GRPCAddr, "Flags override the environment")
+	assert.Equal("localhost:8081", config.Servers.StreamAddr, "Defaults are kept")
+	assert.Equal(time.Minute, config.Health.StalenessWindow)
+	assert.Equal([]string{"ethusdt", "bnbusdt"}, config.Exchanges[0].Symbols)
+
+	assert.Error(config.ApplyEnv(func(key string) (string, bool) {
+		return "soon", key == "HLOB_CAPTURE_MAX_AGE"
+	}))
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		modify        func(config *Config)
+		expectedError string
+	}{
+		{"default", func(config *Config) {}, ""},
+		{
+			"no exchanges",
+			func(config *Config) { config.Exchanges = nil },
+			"invalid configuration: at least one exchange is required",
+		},
+		{
+			"bad exchange",
+			func(config *Config) {
+				config.Exchanges[0].Type = "kraken"
+				config.Exchanges[0].Market = "margin"
+				config.Exchanges[0].Symbols = []string{"BTCUSDT", "btcusdt", "btc@depth"}
+				config.Exchanges[0].Connections = 0
+				config.Exchanges[0].MessageRateLimit = -1
+				config.Exchanges[0].MessageBurst = 0
+			},
+			`invalid configuration: exchanges[0]: unsupported type "kraken"; exchanges[0]: unknown market "margin"; exchanges[0]: symbol btcusdt is listed more than once; exchanges[0]: invalid symbol "btc@depth"; exchanges[0]: connections must be at least 1; exchanges[0]: messageRateLimit must not be negative; exchanges[0]: messageBurst must be at least 1`,
+		},
+		{
+			"market limits",
+			func(config *Config) {
+				spot := DefaultExchange()
+				spot.Name = "binance-spot"
+				spot.Market = binancewebsocket.MarketSpot
+				spot.StreamSpeed = "250ms"
+				spot.SnapshotLimit = 5000
+				config.Exchanges = append(config.Exchanges, spot)
+				config.Exchanges[0].SnapshotLimit = 5000
+				config.Exchanges[0].MaxStreamsPerConnection = 300
+				config.Exchanges[1].MaxStreamsPerConnection = 300
+			},
+			`invalid configuration: exchanges[0]: snapshot limit 5000 is not offered on the usdm market; exchanges[0]: maxStreamsPerConnection must be between 0 and the usdm market's cap of 200; exchanges[1]: stream speed "250ms" is not offered on the spot market`,
+		},
+		{
+			"duplicate names and addresses",
+			func(config *Config) {
+				config.Exchanges = append(config.Exchanges, DefaultExchange())
+				config.Servers.StreamAddr = config.Servers.HTTPAddr
+			},
+			`invalid configuration: exchanges[1]: name "binance" is used more than once; servers.streamAddr: localhost:8080 is already used by servers.httpAddr`,
+		},
+		{
+			"retry",
+			func(config *Config) {
+				config.Exchanges[0].Retry.ConnectionRetryLimit = -2
+				config.Exchanges[0].Retry.ReconnectJitter = 2
+				config.Exchanges[0].Retry.CircuitBreakerThreshold = 3
+				config.Exchanges[0].Retry.CircuitBreakerCooldown = 0
+			},
+			"invalid configuration: exchanges[0]: retry.connectionRetryLimit must be -1 or more; exchanges[0]: retry.reconnectJitter must be between 0 and 1; exchanges[0]: retry.circuitBreakerCooldown must be positive",
+		},
+		{
+			"capture",
+			func(config *Config) {
+				config.Capture.Dir = "/tmp"
+				config.Capture.MaxBytes = 0
+			},
+			"invalid configuration: capture.maxBytes must be positive",
+		},
+		{
+			"shutdown",
+			func(config *Config) {
+				config.Shutdown.GracePeriod = time.Second
+			},
+			"invalid configuration: shutdown.gracePeriod must not be shorter than shutdown.requestTimeout (2s)",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := Default()
+			testCase.modify(config)
+
+			err := config.Validate()
+			if testCase.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.expectedError)
+			}
+		})
+	}
+}
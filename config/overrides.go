@@ -0,0 +1,163 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+)
+
+// EnvPrefix is prepended to the upper-cased override name, with dashes turned
+// into underscores, e.g. HLOB_HTTP_ADDR
+const EnvPrefix = "HLOB_"
+
+// override is a setting that can be changed from the environment or the
+// command line. Exchange settings apply to the first exchange.
+type override struct {
+	name  string
+	usage string
+	set   func(config *Config, value string) error
+}
+
+var overrides = []override{
+	{"http-addr", "Serve the books over HTTP on this address, empty to disable", func(c *Config, v string) error {
+		c.Servers.HTTPAddr = v
+		return nil
+	}},
+	{"grpc-addr", "Serve the books over gRPC on this address, empty to disable", func(c *Config, v string) error {
+		c.Servers.GRPCAddr = v
+		return nil
+	}},
+	{"stream-addr", "Stream book updates to websocket clients on this address, empty to disable", func(c *Config, v string) error {
+		c.Servers.StreamAddr = v
+		return nil
+	}},
+	{"capture-dir", "Record raw websocket frames and depth snapshots to this directory", func(c *Config, v string) error {
+		c.Capture.Dir = v
+		return nil
+	}},
+	{"capture-max-bytes", "Start a new capture file after this many compressed bytes", func(c *Config, v string) error {
+		return parseInt64(v, &c.Capture.MaxBytes)
+	}},
+	{"capture-max-age", "Start a new capture file after this long", func(c *Config, v string) error {
+		return parseDuration(v, &c.Capture.MaxAge)
+	}},
+	{"staleness-window", "Books that applied no update for this long are not ready", func(c *Config, v string) error {
+		return parseDuration(v, &c.Health.StalenessWindow)
+	}},
+	{"shutdown-grace-period", "How long unsubscribing and draining may take on shutdown", func(c *Config, v string) error {
+		return parseDuration(v, &c.Shutdown.GracePeriod)
+	}},
+	{"shutdown-request-timeout", "How long to wait for Binance to confirm the unsubscriptions on shutdown", func(c *Config, v string) error {
+		return parseDuration(v, &c.Shutdown.RequestTimeout)
+	}},
+	{"market", "Market of the first exchange: spot, usdm or coinm", func(c *Config, v string) error {
+		return setExchange(c, func(e *Exchange) error {
+			e.Market = binancewebsocket.MarketType(v)
+			return nil
+		})
+	}},
+	{"testnet", "Connect the first exchange to the testnet", func(c *Config, v string) error {
+		return setExchange(c, func(e *Exchange) error {
+			testnet, err := strconv.ParseBool(v)
+			e.Testnet = testnet
+			return err
+		})
+	}},
+	{"symbols", "Comma separated symbols of the first exchange, e.g. BTCUSDT,ETHUSDT", func(c *Config, v string) error {
+		return setExchange(c, func(e *Exchange) error {
+			e.Symbols = nil
+			for _, symbol := range strings.Split(v, ",") {
+				e.Symbols = append(e.Symbols, strings.TrimSpace(symbol))
+			}
+			return nil
+		})
+	}},
+	{"stream-speed", "Depth stream update speed of the first exchange, e.g. 100ms", func(c *Config, v string) error {
+		return setExchange(c, func(e *Exchange) error {
+			e.StreamSpeed = v
+			return nil
+		})
+	}},
+}
+
+// ApplyEnv applies every HLOB_* variable that lookupEnv finds, usually os.LookupEnv
+func (c *Config) ApplyEnv(lookupEnv func(key string) (string, bool)) error {
+	for _, o := range overrides {
+		key := EnvPrefix + strings.ToUpper(strings.Replace(o.name, "-", "_", -1))
+		value, ok := lookupEnv(key)
+		if !ok {
+			continue
+		}
+		err := o.set(c, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Overrides holds the command line flags registered by RegisterFlags
+type Overrides struct {
+	flagSet *flag.FlagSet
+	values  map[string]*string
+}
+
+// RegisterFlags defines a flag per override on flagSet. Only the flags actually
+// given on the command line are applied by Apply.
+func RegisterFlags(flagSet *flag.FlagSet) *Overrides {
+	overrideFlags := &Overrides{flagSet: flagSet, values: make(map[string]*string)}
+	for _, o := range overrides {
+		overrideFlags.values[o.name] = flagSet.String(o.name, "", o.usage)
+	}
+	return overrideFlags
+}
+
+// Apply sets the flags given on the command line. Call after parsing.
+func (o *Overrides) Apply(config *Config) error {
+	var err error
+	o.flagSet.Visit(func(f *flag.Flag) {
+		value, ok := o.values[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		for _, override := range overrides {
+			if override.name == f.Name {
+				err = override.set(config, *value)
+				if err != nil {
+					err = fmt.Errorf("-%s: %w", f.Name, err)
+				}
+				return
+			}
+		}
+	})
+	return err
+}
+
+func setExchange(config *Config, set func(exchange *Exchange) error) error {
+	if len(config.Exchanges) == 0 {
+		config.Exchanges = []Exchange{DefaultExchange()}
+	}
+	return set(&config.Exchanges[0])
+}
+
+func parseInt64(value string, target *int64) error {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	*target = parsed
+	return nil
+}
+
+func parseDuration(value string, target *time.Duration) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*target = parsed
+	return nil
+}
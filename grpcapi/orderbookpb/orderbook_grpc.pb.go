@@ -0,0 +1,209 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package orderbookpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// OrderBookServiceClient is the client API for OrderBookService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OrderBookServiceClient interface {
+	// GetBook returns up to depth levels per side of a book
+	GetBook(ctx context.Context, in *GetBookRequest, opts ...grpc.CallOption) (*Book, error)
+	// GetTopOfBook returns the best bid and ask, the spread and the mid price
+	GetTopOfBook(ctx context.Context, in *GetTopOfBookRequest, opts ...grpc.CallOption) (*TopOfBook, error)
+	// SubscribeBook streams a snapshot once the book is live, then deltas holding
+	// only the levels that changed
+	SubscribeBook(ctx context.Context, in *SubscribeBookRequest, opts ...grpc.CallOption) (OrderBookService_SubscribeBookClient, error)
+}
+
+type orderBookServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOrderBookServiceClient(cc grpc.ClientConnInterface) OrderBookServiceClient {
+	return &orderBookServiceClient{cc}
+}
+
+func (c *orderBookServiceClient) GetBook(ctx context.Context, in *GetBookRequest, opts ...grpc.CallOption) (*Book, error) {
+	out := new(Book)
+	err := c.cc.Invoke(ctx, "/hlob.orderbook.v1.OrderBookService/GetBook", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderBookServiceClient) GetTopOfBook(ctx context.Context, in *GetTopOfBookRequest, opts ...grpc.CallOption) (*TopOfBook, error) {
+	out := new(TopOfBook)
+	err := c.cc.Invoke(ctx, "/hlob.orderbook.v1.OrderBookService/GetTopOfBook", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderBookServiceClient) SubscribeBook(ctx context.Context, in *SubscribeBookRequest, opts ...grpc.CallOption) (OrderBookService_SubscribeBookClient, error) {
+	stream, err := c.cc.NewStream(ctx, &OrderBookService_ServiceDesc.Streams[0], "/hlob.orderbook.v1.OrderBookService/SubscribeBook", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &orderBookServiceSubscribeBookClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type OrderBookService_SubscribeBookClient interface {
+	Recv() (*BookUpdate, error)
+	grpc.ClientStream
+}
+
+type orderBookServiceSubscribeBookClient struct {
+	grpc.ClientStream
+}
+
+func (x *orderBookServiceSubscribeBookClient) Recv() (*BookUpdate, error) {
+	m := new(BookUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OrderBookServiceServer is the server API for OrderBookService service.
+// All implementations must embed UnimplementedOrderBookServiceServer
+// for forward compatibility
+type OrderBookServiceServer interface {
+	// GetBook returns up to depth levels per side of a book
+	GetBook(context.Context, *GetBookRequest) (*Book, error)
+	// GetTopOfBook returns the best bid and ask, the spread and the mid price
+	GetTopOfBook(context.Context, *GetTopOfBookRequest) (*TopOfBook, error)
+	// SubscribeBook streams a snapshot once the book is live, then deltas holding
+	// only the levels that changed
+	SubscribeBook(*SubscribeBookRequest, OrderBookService_SubscribeBookServer) error
+	mustEmbedUnimplementedOrderBookServiceServer()
+}
+
+// UnimplementedOrderBookServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedOrderBookServiceServer struct {
+}
+
+func (UnimplementedOrderBookServiceServer) GetBook(context.Context, *GetBookRequest) (*Book, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBook not implemented")
+}
+func (UnimplementedOrderBookServiceServer) GetTopOfBook(context.Context, *GetTopOfBookRequest) (*TopOfBook, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTopOfBook not implemented")
+}
+func (UnimplementedOrderBookServiceServer) SubscribeBook(*SubscribeBookRequest, OrderBookService_SubscribeBookServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeBook not implemented")
+}
+func (UnimplementedOrderBookServiceServer) mustEmbedUnimplementedOrderBookServiceServer() {}
+
+// UnsafeOrderBookServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OrderBookServiceServer will
+// result in compilation errors.
+type UnsafeOrderBookServiceServer interface {
+	mustEmbedUnimplementedOrderBookServiceServer()
+}
+
+func RegisterOrderBookServiceServer(s grpc.ServiceRegistrar, srv OrderBookServiceServer) {
+	s.RegisterService(&OrderBookService_ServiceDesc, srv)
+}
+
+func _OrderBookService_GetBook_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderBookServiceServer).GetBook(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hlob.orderbook.v1.OrderBookService/GetBook",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderBookServiceServer).GetBook(ctx, req.(*GetBookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderBookService_GetTopOfBook_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTopOfBookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderBookServiceServer).GetTopOfBook(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hlob.orderbook.v1.OrderBookService/GetTopOfBook",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderBookServiceServer).GetTopOfBook(ctx, req.(*GetTopOfBookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderBookService_SubscribeBook_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeBookRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OrderBookServiceServer).SubscribeBook(m, &orderBookServiceSubscribeBookServer{stream})
+}
+
+type OrderBookService_SubscribeBookServer interface {
+	Send(*BookUpdate) error
+	grpc.ServerStream
+}
+
+type orderBookServiceSubscribeBookServer struct {
+	grpc.ServerStream
+}
+
+func (x *orderBookServiceSubscribeBookServer) Send(m *BookUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// OrderBookService_ServiceDesc is the grpc.ServiceDesc for OrderBookService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OrderBookService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hlob.orderbook.v1.OrderBookService",
+	HandlerType: (*OrderBookServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetBook",
+			Handler:    _OrderBookService_GetBook_Handler,
+		},
+		{
+			MethodName: "GetTopOfBook",
+			Handler:    _OrderBookService_GetTopOfBook_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribeBook",
+			Handler:       _OrderBookService_SubscribeBook_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "orderbook.proto",
+}
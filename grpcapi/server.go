@@ -0,0 +1,279 @@
+/*
+  Package grpcapi serves the live order books over gRPC, see
+  orderbookpb/orderbook.proto. Prices and quantities travel as decimal strings
+  produced by robaho/fixed, so no precision is lost on the way.
+*/
+
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative orderbookpb/orderbook.proto
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/grpcapi/orderbookpb"
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultPollInterval is how often books that can't notify of changes are checked
+const DefaultPollInterval = 100 * time.Millisecond
+
+// Server implements orderbookpb.OrderBookServiceServer
+type Server struct {
+	orderbookpb.UnimplementedOrderBookServiceServer
+
+	PollInterval time.Duration
+
+	sources         map[string]limitorderbook.OrderBookSource
+	grpcServer      *grpc.Server  // Set by Serve
+	shutdownChannel chan struct{} // Closed by Shutdown, ends the subscriptions
+	isShutdown      bool
+	sync.RWMutex
+}
+
+// New ...
+func New(sources ...limitorderbook.OrderBookSource) *Server {
+	s := &Server{
+		PollInterval:    DefaultPollInterval,
+		sources:         make(map[string]limitorderbook.OrderBookSource),
+		shutdownChannel: make(chan struct{}),
+	}
+	for _, source := range sources {
+		s.AddSource(source)
+	}
+	return s
+}
+
+// AddSource serves the books of another exchange
+func (s *Server) AddSource(source limitorderbook.OrderBookSource) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sources[strings.ToLower(source.Exchange())] = source
+}
+
+// ListenAndServe serves the service on addr until it fails or Shutdown is called
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[grpcapi] Listening on %s\n", addr)
+	return s.Serve(listener)
+}
+
+// Serve serves the service on listener until it fails or Shutdown is called,
+// when it returns nil
+func (s *Server) Serve(listener net.Listener) error {
+	grpcServer := grpc.NewServer()
+	orderbookpb.RegisterOrderBookServiceServer(grpcServer, s)
+
+	s.Lock()
+	if s.isShutdown {
+		s.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.grpcServer = grpcServer
+	s.Unlock()
+
+	return grpcServer.Serve(listener)
+}
+
+// Shutdown ends the subscriptions and waits for the other calls in flight. The
+// calls still running once ctx is done are cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	if !s.isShutdown {
+		s.isShutdown = true
+		close(s.shutdownChannel)
+	}
+	grpcServer := s.grpcServer
+	s.Unlock()
+
+	if grpcServer == nil {
+		return nil
+	}
+
+	stoppedChannel := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stoppedChannel)
+	}()
+	select {
+	case <-stoppedChannel:
+		return nil
+	case <-ctx.Done():
+		grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+// GetBook ...
+func (s *Server) GetBook(ctx context.Context, request *orderbookpb.GetBookRequest) (*orderbookpb.Book, error) {
+	orderBook, err := s.orderBook(request.Exchange, request.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := orderBook.Snapshot()
+	return &orderbookpb.Book{
+		Exchange:     strings.ToLower(request.Exchange),
+		Symbol:       snapshot.Symbol,
+		LastUpdateId: snapshot.LastUpdateID,
+		EventTime:    snapshot.EventTime,
+		SyncState:    toSyncState(orderBook.SyncState()),
+		Bids:         toPriceLevels(snapshot.TopN("b", int(request.Depth))),
+		Asks:         toPriceLevels(snapshot.TopN("a", int(request.Depth))),
+	}, nil
+}
+
+// GetTopOfBook ...
+func (s *Server) GetTopOfBook(ctx context.Context, request *orderbookpb.GetTopOfBookRequest) (*orderbookpb.TopOfBook, error) {
+	orderBook, err := s.orderBook(request.Exchange, request.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := orderBook.Snapshot()
+	topOfBook := &orderbookpb.TopOfBook{
+		Exchange:     strings.ToLower(request.Exchange),
+		Symbol:       snapshot.Symbol,
+		LastUpdateId: snapshot.LastUpdateID,
+		EventTime:    snapshot.EventTime,
+		SyncState:    toSyncState(orderBook.SyncState()),
+	}
+	if bestBid, ok := snapshot.BestBid(); ok {
+		topOfBook.BestBid = toPriceLevel(bestBid)
+	}
+	if bestAsk, ok := snapshot.BestAsk(); ok {
+		topOfBook.BestAsk = toPriceLevel(bestAsk)
+	}
+	if spread, ok := snapshot.Spread(); ok {
+		topOfBook.Spread = spread.String()
+	}
+	if midPrice, ok := snapshot.MidPrice(); ok {
+		topOfBook.MidPrice = midPrice.String()
+	}
+	return topOfBook, nil
+}
+
+// SubscribeBook sends a snapshot once the book is live, then a delta whenever
+// levels within depth change, until the client goes away or Shutdown is called
+func (s *Server) SubscribeBook(request *orderbookpb.SubscribeBookRequest, stream orderbookpb.OrderBookService_SubscribeBookServer) error {
+	orderBook, err := s.orderBook(request.Exchange, request.Symbol)
+	if err != nil {
+		return err
+	}
+
+	exchange := strings.ToLower(request.Exchange)
+	depthTracker := limitorderbook.NewDepthTracker(int(request.Depth))
+	var lastSequence int64
+	isSnapshotSent := false
+
+	doneChannel := make(chan struct{})
+	go func() {
+		select {
+		case <-stream.Context().Done():
+		case <-s.shutdownChannel:
+		}
+		close(doneChannel)
+	}()
+
+	limitorderbook.Follow(orderBook, s.PollInterval, doneChannel, func(snapshot *limitorderbook.BookSnapshot) bool {
+		update := &orderbookpb.BookUpdate{
+			Exchange:         exchange,
+			Symbol:           snapshot.Symbol,
+			Sequence:         snapshot.LastUpdateID,
+			PreviousSequence: lastSequence,
+			EventTime:        snapshot.EventTime,
+		}
+
+		var bids, asks []limitorderbook.PriceLevel
+		if !isSnapshotSent {
+			update.Type = orderbookpb.BookUpdate_TYPE_SNAPSHOT
+			bids, asks = depthTracker.Levels(snapshot)
+			isSnapshotSent = true
+		} else {
+			if snapshot.LastUpdateID == lastSequence {
+				return true
+			}
+			update.Type = orderbookpb.BookUpdate_TYPE_DELTA
+			bids, asks = depthTracker.Changes(snapshot)
+			if len(bids) == 0 && len(asks) == 0 {
+				// Nothing changed within depth
+				return true
+			}
+		}
+		update.Bids = toPriceLevels(bids)
+		update.Asks = toPriceLevels(asks)
+		lastSequence = snapshot.LastUpdateID
+
+		err = stream.Send(update)
+		return err == nil
+	})
+
+	if err != nil {
+		return err
+	}
+	select {
+	case <-s.shutdownChannel:
+		return status.Error(codes.Unavailable, "server shutting down")
+	default:
+	}
+	return stream.Context().Err()
+}
+
+func (s *Server) orderBook(exchange, symbol string) (limitorderbook.OrderBook, error) {
+	s.RLock()
+	source, ok := s.sources[strings.ToLower(exchange)]
+	s.RUnlock()
+
+	if ok {
+		var orderBook limitorderbook.OrderBook
+		orderBook, ok = source.OrderBook(symbol)
+		if ok {
+			return orderBook, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no book for %s %s", exchange, symbol)
+}
+
+func toPriceLevels(priceLevels []limitorderbook.PriceLevel) []*orderbookpb.PriceLevel {
+	levels := make([]*orderbookpb.PriceLevel, 0, len(priceLevels))
+	for _, priceLevel := range priceLevels {
+		levels = append(levels, toPriceLevel(priceLevel))
+	}
+	return levels
+}
+
+func toPriceLevel(priceLevel limitorderbook.PriceLevel) *orderbookpb.PriceLevel {
+	pair := priceLevel.Strings()
+	return &orderbookpb.PriceLevel{Price: pair[0], Quantity: pair[1]}
+}
+
+func toSyncState(syncState limitorderbook.SyncState) orderbookpb.SyncState {
+	switch syncState {
+	case limitorderbook.SyncStateUnsynced:
+		return orderbookpb.SyncState_SYNC_STATE_UNSYNCED
+	case limitorderbook.SyncStateBuffering:
+		return orderbookpb.SyncState_SYNC_STATE_BUFFERING
+	case limitorderbook.SyncStateSnapshotting:
+		return orderbookpb.SyncState_SYNC_STATE_SNAPSHOTTING
+	case limitorderbook.SyncStateReplaying:
+		return orderbookpb.SyncState_SYNC_STATE_REPLAYING
+	case limitorderbook.SyncStateLive:
+		return orderbookpb.SyncState_SYNC_STATE_LIVE
+	default:
+		return orderbookpb.SyncState_SYNC_STATE_UNSPECIFIED
+	}
+}
@@ -0,0 +1,151 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/grpcapi/orderbookpb"
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func level(price, quantity string) *orderbookpb.PriceLevel {
+	return &orderbookpb.PriceLevel{Price: price, Quantity: quantity}
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.SnapshotFetcher = limitorderbook.NewMemorySnapshotFetcher().AddSnapshot("BTCUSDT", &limitorderbook.DepthSnapshot{
+		LastUpdateID: 100,
+		Bids:         [][2]string{{"100.10", "1.5"}, {"100.00", "2"}},
+		Asks:         [][2]string{{"100.25", "3"}, {"100.50", "1"}},
+	})
+	bookManager.Subscribe("BTCUSDT")
+	defer bookManager.Close()
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	orderbookpb.RegisterOrderBookServiceServer(grpcServer, New(bookManager))
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := orderbookpb.NewOrderBookServiceClient(conn)
+
+	stream, err := client.SubscribeBook(ctx, &orderbookpb.SubscribeBookRequest{Exchange: "binance", Symbol: "BTCUSDT", Depth: 1})
+	assert.NoError(err)
+
+	assert.NoError(bookManager.HandleMessage([]byte(`{"e":"depthUpdate","E":1,"s":"BTCUSDT","U":95,"u":105,"pu":94,"b":[["100.10","1"]],"a":[]}`)))
+
+	update, err := stream.Recv()
+	assert.NoError(err)
+	assert.True(proto.Equal(&orderbookpb.BookUpdate{
+		Type:      orderbookpb.BookUpdate_TYPE_SNAPSHOT,
+		Exchange:  "binance",
+		Symbol:    "BTCUSDT",
+		Sequence:  105,
+		EventTime: 1,
+		Bids:      []*orderbookpb.PriceLevel{level("100.1", "1")},
+		Asks:      []*orderbookpb.PriceLevel{level("100.25", "3")},
+	}, update), update)
+
+	assert.NoError(bookManager.HandleMessage([]byte(`{"e":"depthUpdate","E":2,"s":"BTCUSDT","U":106,"u":108,"pu":105,"b":[["100.20","4"]],"a":[["100.25","0"]]}`)))
+
+	update, err = stream.Recv()
+	assert.NoError(err)
+	assert.True(proto.Equal(&orderbookpb.BookUpdate{
+		Type:             orderbookpb.BookUpdate_TYPE_DELTA,
+		Exchange:         "binance",
+		Symbol:           "BTCUSDT",
+		Sequence:         108,
+		PreviousSequence: 105,
+		EventTime:        2,
+		Bids:             []*orderbookpb.PriceLevel{level("100.2", "4"), level("100.1", "0")},
+		Asks:             []*orderbookpb.PriceLevel{level("100.5", "1"), level("100.25", "0")},
+	}, update), update)
+
+	book, err := client.GetBook(ctx, &orderbookpb.GetBookRequest{Exchange: "BINANCE", Symbol: "BTCUSDT"})
+	assert.NoError(err)
+	assert.True(proto.Equal(&orderbookpb.Book{
+		Exchange:     "binance",
+		Symbol:       "BTCUSDT",
+		LastUpdateId: 108,
+		EventTime:    2,
+		SyncState:    orderbookpb.SyncState_SYNC_STATE_LIVE,
+		Bids:         []*orderbookpb.PriceLevel{level("100.2", "4"), level("100.1", "1"), level("100", "2")},
+		Asks:         []*orderbookpb.PriceLevel{level("100.5", "1")},
+	}, book), book)
+
+	topOfBook, err := client.GetTopOfBook(ctx, &orderbookpb.GetTopOfBookRequest{Exchange: "binance", Symbol: "BTCUSDT"})
+	assert.NoError(err)
+	assert.True(proto.Equal(&orderbookpb.TopOfBook{
+		Exchange:     "binance",
+		Symbol:       "BTCUSDT",
+		LastUpdateId: 108,
+		EventTime:    2,
+		SyncState:    orderbookpb.SyncState_SYNC_STATE_LIVE,
+		BestBid:      level("100.2", "4"),
+		BestAsk:      level("100.5", "1"),
+		Spread:       "0.3",
+		MidPrice:     "100.35",
+	}, topOfBook), topOfBook)
+
+	_, err = client.GetTopOfBook(ctx, &orderbookpb.GetTopOfBookRequest{Exchange: "kraken", Symbol: "BTCUSDT"})
+	assert.Equal(codes.NotFound, status.Code(err))
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.SnapshotFetcher = limitorderbook.NewMemorySnapshotFetcher().AddSnapshot("BTCUSDT", &limitorderbook.DepthSnapshot{LastUpdateID: 100})
+	bookManager.Subscribe("BTCUSDT")
+	defer bookManager.Close()
+	assert.NoError(bookManager.HandleMessage([]byte(`{"e":"depthUpdate","E":1,"s":"BTCUSDT","U":95,"u":105,"pu":94,"b":[["100.10","1"]],"a":[]}`)))
+
+	server := New(bookManager)
+	listener := bufconn.Listen(1 << 20)
+	servedChannel := make(chan error, 1)
+	go func() { servedChannel <- server.Serve(listener) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := orderbookpb.NewOrderBookServiceClient(conn)
+
+	stream, err := client.SubscribeBook(ctx, &orderbookpb.SubscribeBookRequest{Exchange: "binance", Symbol: "BTCUSDT"})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.NoError(err)
+
+	// The subscription would otherwise keep GracefulStop waiting
+	assert.NoError(server.Shutdown(ctx))
+	assert.NoError(<-servedChannel)
+	_, err = stream.Recv()
+	assert.Equal(codes.Unavailable, status.Code(err), err)
+}
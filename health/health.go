@@ -0,0 +1,227 @@
+/*
+  Package health answers the orchestrator's probes:
+
+    GET /healthz  200 while every liveness check passes, e.g. the websocket and
+                  book update goroutines are running
+    GET /readyz   200 while every source has a book for each configured
+                  symbol, each live and having applied an update within the
+                  staleness window
+
+  Both return 503 with the failing checks otherwise.
+*/
+
+package health
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+const (
+	// StatusOK ...
+	StatusOK = "ok"
+	// StatusFailing ...
+	StatusFailing = "failing"
+)
+
+// DefaultStalenessWindow is how long a live book may go without applying an
+// update before it stops being ready
+const DefaultStalenessWindow = 30 * time.Second
+
+// LivenessChecker is implemented by anything that runs goroutines worth watching,
+// e.g. BinanceL2LimitOrderBookManager
+type LivenessChecker interface {
+	CheckLiveness() error
+}
+
+// Check is the outcome of a single check
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the body of both endpoints
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// IsOK ...
+func (r Report) IsOK() bool {
+	return r.Status == StatusOK
+}
+
+type readinessSource struct {
+	source  limitorderbook.OrderBookSource
+	symbols []string
+}
+
+type livenessCheck struct {
+	name    string
+	checker LivenessChecker
+}
+
+// Checker ...
+type Checker struct {
+	StalenessWindow time.Duration
+
+	sources        []readinessSource
+	livenessChecks []livenessCheck
+	now            func() time.Time
+	sync.RWMutex
+}
+
+// New ...
+func New(stalenessWindow time.Duration) *Checker {
+	return &Checker{
+		StalenessWindow: stalenessWindow,
+		now:             time.Now,
+	}
+}
+
+// AddSource requires a book of the source for each of the symbols, in-sync, for
+// readiness. Without symbols, whichever books the source has are checked.
+func (c *Checker) AddSource(source limitorderbook.OrderBookSource, symbols ...string) *Checker {
+	c.Lock()
+	defer c.Unlock()
+
+	expected := make([]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		expected = append(expected, strings.ToUpper(symbol))
+	}
+	c.sources = append(c.sources, readinessSource{source: source, symbols: expected})
+	return c
+}
+
+// AddLivenessCheck ...
+func (c *Checker) AddLivenessCheck(name string, checker LivenessChecker) *Checker {
+	c.Lock()
+	defer c.Unlock()
+
+	c.livenessChecks = append(c.livenessChecks, livenessCheck{name: name, checker: checker})
+	return c
+}
+
+// Liveness runs every liveness check
+func (c *Checker) Liveness() Report {
+	c.RLock()
+	livenessChecks := c.livenessChecks
+	c.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: []Check{}}
+	for _, livenessCheck := range livenessChecks {
+		report.add(livenessCheck.name, livenessCheck.checker.CheckLiveness())
+	}
+	return report
+}
+
+// Readiness checks that every book is live and fresh. A configured symbol
+// without a book is not ready, e.g. once it is dropped after a LiveError, and
+// neither is a source without a book, e.g. before its symbols are subscribed.
+func (c *Checker) Readiness() Report {
+	c.RLock()
+	sources := c.sources
+	c.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: []Check{}}
+	for _, readinessSource := range sources {
+		source := readinessSource.source
+		exchange := strings.ToLower(source.Exchange())
+
+		symbols := readinessSource.symbols
+		if len(symbols) == 0 {
+			symbols = source.Symbols()
+		}
+
+		books := 0
+		for _, symbol := range symbols {
+			orderBook, ok := source.OrderBook(symbol)
+			if !ok {
+				if len(readinessSource.symbols) > 0 {
+					report.add(exchange+"/"+symbol, errors.New("no book"))
+				}
+				continue
+			}
+			books++
+			report.add(exchange+"/"+symbol, c.checkBook(orderBook))
+		}
+		if books == 0 && len(readinessSource.symbols) == 0 {
+			report.add(exchange, errors.New("no books"))
+		}
+	}
+	return report
+}
+
+func (c *Checker) checkBook(orderBook limitorderbook.OrderBook) error {
+	syncState := orderBook.SyncState()
+	if syncState != limitorderbook.SyncStateLive {
+		return fmt.Errorf("book is %s", syncState)
+	}
+
+	freshness, ok := orderBook.(limitorderbook.Freshness)
+	if !ok || c.StalenessWindow <= 0 {
+		return nil
+	}
+
+	lastAppliedAt := freshness.LastAppliedAt()
+	if lastAppliedAt.IsZero() {
+		return fmt.Errorf("no update applied yet")
+	}
+	if age := c.now().Sub(lastAppliedAt); age > c.StalenessWindow {
+		return fmt.Errorf("no update applied for %s", age.Truncate(time.Millisecond))
+	}
+	return nil
+}
+
+func (r *Report) add(name string, err error) {
+	if err == nil {
+		r.Checks = append(r.Checks, Check{Name: name, Status: StatusOK})
+		return
+	}
+
+	r.Status = StatusFailing
+	r.Checks = append(r.Checks, Check{Name: name, Status: StatusFailing, Error: err.Error()})
+}
+
+// LivenessHandler serves /healthz
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Liveness())
+	})
+}
+
+// ReadinessHandler serves /readyz
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Readiness())
+	})
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if !report.IsOK() {
+		status = http.StatusServiceUnavailable
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[health] Error marshalling the report: %s\n", err.Error())
+		status = http.StatusInternalServerError
+		data = []byte(`{"status":"failing"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
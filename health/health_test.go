@@ -0,0 +1,135 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+type testOrderBook struct {
+	syncState     limitorderbook.SyncState
+	lastAppliedAt time.Time
+}
+
+func (tob testOrderBook) Snapshot() *limitorderbook.BookSnapshot { return nil }
+func (tob testOrderBook) SyncState() limitorderbook.SyncState    { return tob.syncState }
+func (tob testOrderBook) LastAppliedAt() time.Time               { return tob.lastAppliedAt }
+
+type testSource map[string]testOrderBook
+
+func (ts testSource) Exchange() string { return "Binance" }
+func (ts testSource) Symbols() []string {
+	symbols := make([]string, 0, len(ts))
+	for symbol := range ts {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+func (ts testSource) OrderBook(symbol string) (limitorderbook.OrderBook, bool) {
+	orderBook, ok := ts[symbol]
+	return orderBook, ok
+}
+
+type testLivenessChecker struct{ err error }
+
+func (tlc testLivenessChecker) CheckLiveness() error { return tlc.err }
+
+func TestChecker_Readiness(t *testing.T) {
+	testCases := []struct {
+		name           string
+		source         testSource
+		symbols        []string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			"live and fresh",
+			testSource{
+				"BTCUSDT": {limitorderbook.SyncStateLive, now.Add(-time.Second)},
+				"ETHUSDT": {limitorderbook.SyncStateLive, now.Add(-10 * time.Second)},
+			},
+			nil,
+			http.StatusOK,
+			`{"status":"ok","checks":[{"name":"binance/BTCUSDT","status":"ok"},{"name":"binance/ETHUSDT","status":"ok"}]}`,
+		},
+		{
+			"resyncing",
+			testSource{
+				"BTCUSDT": {limitorderbook.SyncStateLive, now.Add(-time.Second)},
+				"ETHUSDT": {limitorderbook.SyncStateSnapshotting, now.Add(-time.Second)},
+			},
+			nil,
+			http.StatusServiceUnavailable,
+			`{"status":"failing","checks":[{"name":"binance/BTCUSDT","status":"ok"},{"name":"binance/ETHUSDT","status":"failing","error":"book is snapshotting"}]}`,
+		},
+		{
+			"stale",
+			testSource{
+				"BTCUSDT": {limitorderbook.SyncStateLive, now.Add(-time.Minute)},
+				"ETHUSDT": {limitorderbook.SyncStateLive, time.Time{}},
+			},
+			nil,
+			http.StatusServiceUnavailable,
+			`{"status":"failing","checks":[{"name":"binance/BTCUSDT","status":"failing","error":"no update applied for 1m0s"},{"name":"binance/ETHUSDT","status":"failing","error":"no update applied yet"}]}`,
+		},
+		{
+			"no books",
+			testSource{},
+			nil,
+			http.StatusServiceUnavailable,
+			`{"status":"failing","checks":[{"name":"binance","status":"failing","error":"no books"}]}`,
+		},
+		{
+			"configured symbol without a book",
+			testSource{
+				"BTCUSDT": {limitorderbook.SyncStateLive, now.Add(-time.Second)},
+			},
+			[]string{"btcusdt", "ETHUSDT"},
+			http.StatusServiceUnavailable,
+			`{"status":"failing","checks":[{"name":"binance/BTCUSDT","status":"ok"},{"name":"binance/ETHUSDT","status":"failing","error":"no book"}]}`,
+		},
+		{
+			"configured symbols without any book",
+			testSource{},
+			[]string{"BTCUSDT"},
+			http.StatusServiceUnavailable,
+			`{"status":"failing","checks":[{"name":"binance/BTCUSDT","status":"failing","error":"no book"}]}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			checker := New(30*time.Second).AddSource(testCase.source, testCase.symbols...)
+			checker.now = func() time.Time { return now }
+
+			recorder := httptest.NewRecorder()
+			checker.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(testCase.expectedStatus, recorder.Code)
+			assert.JSONEq(testCase.expectedBody, recorder.Body.String())
+		})
+	}
+}
+
+func TestChecker_Liveness(t *testing.T) {
+	assert := assert.New(t)
+
+	checker := New(DefaultStalenessWindow).
+		AddLivenessCheck("binance", testLivenessChecker{}).
+		AddLivenessCheck("kraken", testLivenessChecker{errors.New("the websocket connection is not running")})
+
+	recorder := httptest.NewRecorder()
+	checker.LivenessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(http.StatusServiceUnavailable, recorder.Code)
+	assert.JSONEq(`{"status":"failing","checks":[{"name":"binance","status":"ok"},{"name":"kraken","status":"failing","error":"the websocket connection is not running"}]}`, recorder.Body.String())
+}
@@ -7,30 +7,77 @@
 package hwebsocket
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bensooraj/h-lob-service/metrics"
 	"github.com/gorilla/websocket"
 	jsoniter "github.com/json-iterator/go"
 )
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+// DefaultReadDeadlineTime is the ReadDeadlineTime used when none is set
+const DefaultReadDeadlineTime = time.Minute
+
 // WebsocketConfiguration ...
 type WebsocketConfiguration struct {
+	Name                 string // Labels the metrics, e.g. the exchange's name. Never the URL, which varies.
 	WebsocketURL         string
 	RequestHeader        map[string][]string
 	MessageHandleFunc    func([]byte) error
 	ErrorHandleFunc      func(error)
 	IsAutoReconnect      bool
 	IsDump               bool
-	ReadDeadlineTime     time.Duration
-	ConnectionRetryLimit int
+	ReadDeadlineTime     time.Duration   // Silence, not even a pong, after which the connection counts as dropped. DefaultReadDeadlineTime when 0
+	ConnectionRetryLimit int             // Used by the default ReconnectPolicy
+	ReconnectPolicy      ReconnectPolicy // NewExponentialBackoff(ConnectionRetryLimit) when nil
+	Recorder             FrameRecorder
+
+	SubscriptionMessageFunc SubscriptionMessageFunc
+	RateLimit               RateLimit // Servers such as Binance drop connections that write too fast
+
+	// RotationInterval is how often the connection is replaced, make-before-break,
+	// 0 to never. SequenceFunc lets the overlapping connections be de-duplicated
+	// without a gap, see rotate.
+	RotationInterval time.Duration
+	RotationOverlap  time.Duration // DefaultRotationOverlap when 0
+	SequenceFunc     SequenceFunc
+
+	// The hooks are called from the goroutine that reconnects, so they must not block
+	OnDisconnect   func(err error)                        // The connection dropped, before reconnecting
+	OnReconnecting func(attempt int, delay time.Duration) // Before waiting delay and making the attempt, counted from 1
+	OnReconnected  func()                                 // Reconnected and the subscriptions replayed
+}
+
+// SubscriptionMessageFunc builds the message that subscribes to the streams, or
+// unsubscribes from them when subscribe is false
+type SubscriptionMessageFunc func(subscribe bool, streams []string) interface{}
+
+// FrameRecorder is handed every inbound text/binary frame before the message handler
+type FrameRecorder interface {
+	RecordFrame(websocketURL string, receivedAt time.Time, msg []byte) error
 }
 
+// ErrClosed is returned when sending on a closed connection
+var ErrClosed = errors.New("websocket connection closed")
+
+// ErrNotConnected reports a connection that is down, reconnecting after a
+// drop, and so cannot answer a request
+var ErrNotConnected = errors.New("websocket connection not connected")
+
+// ErrNoSubscriptionMessageFunc is returned by Subscribe and Unsubscribe when no
+// SubscriptionMessageFunc was set
+var ErrNoSubscriptionMessageFunc = errors.New("no subscription message func set")
+
 type bufferChannel chan []byte
 
 // WebsocketConnection ...
@@ -39,8 +86,24 @@ type WebsocketConnection struct {
 	WriteBufferChannel        bufferChannel
 	PingMessageBufferChannel  bufferChannel
 	CloseMessageBufferChannel bufferChannel // For sending close signal to the ws server
-	Subscriptions             []interface{}
-	CloseChannel              chan struct{} // For closing the connection locally
+
+	connLock          sync.RWMutex // Guards Conn, which Reconnect and rotate replace, and standby
+	receiveLock       sync.Mutex   // Serialises the message handler, guards the fields below
+	standby           *websocket.Conn
+	standbyStreams    []string      // Subscribed on the standby when it was opened
+	standbyDone       chan struct{} // Closed once the standby is promoted or dropped
+	sequencer         *sequencer
+	subscriptionsLock sync.Mutex
+	subscriptions     map[string]struct{} // Active streams, replayed after a reconnect
+
+	ctx               context.Context // Cancelled by Close, stops every goroutine
+	cancel            context.CancelFunc
+	closeOnce         sync.Once
+	waitGroup         sync.WaitGroup
+	doneChannel       chan struct{} // Closed once every goroutine has exited
+	runningGoroutines int32         // WriteRequest and ReceiveMessage, accessed atomically
+	disconnected      int32         // 1 from a drop until the reconnect, accessed atomically
+	rateLimiter       *tokenBucket  // nil without a RateLimit
 
 	WebsocketConfiguration
 }
@@ -60,12 +123,23 @@ func New() *WebsocketBuilder {
 	}
 }
 
-// Build ...
-func (wsb *WebsocketBuilder) Build() *WebsocketConnection {
+// Build connects and starts the connection's goroutines, which run until ctx
+// is cancelled or Close is called
+func (wsb *WebsocketBuilder) Build(ctx context.Context) (*WebsocketConnection, error) {
 	wsc := &WebsocketConnection{
 		WebsocketConfiguration: *wsb.wsConfig,
 	}
-	return wsc.InitialiseConnection()
+	err := wsc.InitialiseConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return wsc, nil
+}
+
+// SetName ...
+func (wsb *WebsocketBuilder) SetName(name string) *WebsocketBuilder {
+	wsb.wsConfig.Name = name
+	return wsb
 }
 
 // SetWebsocketURL ...
@@ -116,31 +190,127 @@ func (wsb *WebsocketBuilder) SetConnectionRetryLimit(crl int) *WebsocketBuilder
 	return wsb
 }
 
+// SetRecorder ...
+func (wsb *WebsocketBuilder) SetRecorder(recorder FrameRecorder) *WebsocketBuilder {
+	wsb.wsConfig.Recorder = recorder
+	return wsb
+}
+
+// SetSubscriptionMessageFunc ...
+func (wsb *WebsocketBuilder) SetSubscriptionMessageFunc(f SubscriptionMessageFunc) *WebsocketBuilder {
+	wsb.wsConfig.SubscriptionMessageFunc = f
+	return wsb
+}
+
+// SetReconnectPolicy ...
+func (wsb *WebsocketBuilder) SetReconnectPolicy(policy ReconnectPolicy) *WebsocketBuilder {
+	wsb.wsConfig.ReconnectPolicy = policy
+	return wsb
+}
+
+// SetRotationInterval ...
+func (wsb *WebsocketBuilder) SetRotationInterval(d time.Duration) *WebsocketBuilder {
+	wsb.wsConfig.RotationInterval = d
+	return wsb
+}
+
+// SetRotationOverlap ...
+func (wsb *WebsocketBuilder) SetRotationOverlap(d time.Duration) *WebsocketBuilder {
+	wsb.wsConfig.RotationOverlap = d
+	return wsb
+}
+
+// SetSequenceFunc ...
+func (wsb *WebsocketBuilder) SetSequenceFunc(f SequenceFunc) *WebsocketBuilder {
+	wsb.wsConfig.SequenceFunc = f
+	return wsb
+}
+
+// SetRateLimit ...
+func (wsb *WebsocketBuilder) SetRateLimit(perSecond float64, burst int) *WebsocketBuilder {
+	wsb.wsConfig.RateLimit = RateLimit{PerSecond: perSecond, Burst: burst}
+	return wsb
+}
+
+// SetOnDisconnect ...
+func (wsb *WebsocketBuilder) SetOnDisconnect(f func(err error)) *WebsocketBuilder {
+	wsb.wsConfig.OnDisconnect = f
+	return wsb
+}
+
+// SetOnReconnecting ...
+func (wsb *WebsocketBuilder) SetOnReconnecting(f func(attempt int, delay time.Duration)) *WebsocketBuilder {
+	wsb.wsConfig.OnReconnecting = f
+	return wsb
+}
+
+// SetOnReconnected ...
+func (wsb *WebsocketBuilder) SetOnReconnected(f func()) *WebsocketBuilder {
+	wsb.wsConfig.OnReconnected = f
+	return wsb
+}
+
 // InitialiseConnection ...
-func (wsc *WebsocketConnection) InitialiseConnection() *WebsocketConnection {
-	wsc.ReadDeadlineTime = time.Minute
+func (wsc *WebsocketConnection) InitialiseConnection(ctx context.Context) error {
+	if wsc.ReadDeadlineTime <= 0 {
+		wsc.ReadDeadlineTime = DefaultReadDeadlineTime
+	}
+	wsc.subscriptions = make(map[string]struct{})
+	wsc.sequencer = newSequencer()
+	wsc.rateLimiter = newTokenBucket(wsc.RateLimit, time.Now())
 
 	err := wsc.Connect()
 	if err != nil {
-		log.Panic("Error establishing websocket connection", err)
+		return fmt.Errorf("establishing websocket connection: %w", err)
 	}
 
-	// This is like the done channel to exit all active go routines
-	wsc.CloseChannel = make(chan struct{}, 2)
+	// Cancelling the context exits all active go routines
+	wsc.ctx, wsc.cancel = context.WithCancel(ctx)
+	wsc.doneChannel = make(chan struct{})
 
 	// For sending messages to the remote websocket server
 	wsc.CloseMessageBufferChannel = make(bufferChannel, 1)
 	wsc.PingMessageBufferChannel = make(bufferChannel, 10)
 	wsc.WriteBufferChannel = make(bufferChannel, 10)
 
+	wsc.waitGroup.Add(2)
 	go wsc.WriteRequest()
 	go wsc.ReceiveMessage()
 
-	return wsc
+	if wsc.RotationInterval > 0 {
+		wsc.waitGroup.Add(1)
+		go wsc.rotateConnection()
+	}
+
+	go func() {
+		// Unblocks ReceiveMessage when the parent context is cancelled
+		<-wsc.ctx.Done()
+		wsc.Close()
+	}()
+	go func() {
+		wsc.waitGroup.Wait()
+		close(wsc.doneChannel)
+	}()
+
+	return nil
 }
 
 // Connect ...
 func (wsc *WebsocketConnection) Connect() error {
+	c, err := wsc.dial()
+	if err != nil {
+		return err
+	}
+
+	wsc.connLock.Lock()
+	wsc.Conn = c
+	wsc.connLock.Unlock()
+
+	return nil
+}
+
+// dial opens a new connection without making it the current one
+func (wsc *WebsocketConnection) dial() (*websocket.Conn, error) {
 	c, resp, err := websocket.DefaultDialer.Dial(wsc.WebsocketURL, http.Header(wsc.RequestHeader))
 	if err != nil {
 		log.Printf("[ws][%s] %s", wsc.WebsocketURL, err.Error())
@@ -148,125 +318,253 @@ func (wsc *WebsocketConnection) Connect() error {
 			dumpData, _ := httputil.DumpResponse(resp, true)
 			log.Printf("[ws][dump][%s] %s", wsc.WebsocketURL, string(dumpData))
 		}
-		return err
+		return nil, err
 	}
 
-	wsc.Conn = c
+	wsc.setHandlers(c)
 
 	if wsc.IsDump && resp != nil {
 		dumpData, _ := httputil.DumpResponse(resp, true)
 		log.Printf("[ws][dump][%s] %s", wsc.WebsocketURL, string(dumpData))
 	}
 
-	return nil
+	return c, nil
 }
 
-// Close ...
+// conn returns the current connection, which changes on every reconnect and rotation
+func (wsc *WebsocketConnection) conn() *websocket.Conn {
+	wsc.connLock.RLock()
+	defer wsc.connLock.RUnlock()
+
+	return wsc.Conn
+}
+
+// setStandby expects the caller to hold receiveLock
+func (wsc *WebsocketConnection) setStandby(conn *websocket.Conn) {
+	wsc.connLock.Lock()
+	wsc.standby = conn
+	wsc.connLock.Unlock()
+}
+
+// setHandlers sets the control frame handlers and the first read deadline, on
+// every new connection
+func (wsc *WebsocketConnection) setHandlers(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(wsc.ReadDeadlineTime))
+
+	// CLOSE
+	// The read then fails, and ReceiveMessage reconnects or stops
+	conn.SetCloseHandler(func(code int, text string) error {
+		log.Printf("[ws][%s] websocket exiting [code=%d, text=%s]", wsc.WebsocketURL, code, text)
+		closeMessage := websocket.FormatCloseMessage(code, "")
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		return nil
+	})
+
+	// PONG
+	conn.SetPongHandler(func(appData string) error {
+		log.Printf("[ws][%s] PONG RECEIVE %s", wsc.WebsocketURL, appData)
+		conn.SetReadDeadline(time.Now().Add(wsc.ReadDeadlineTime))
+		return nil
+	})
+
+	// PING
+	conn.SetPingHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(wsc.ReadDeadlineTime))
+		err := conn.WriteMessage(websocket.PongMessage, nil)
+		if err != nil {
+			log.Printf("[ws][%s] PING RECEIVE ERROR %s", wsc.WebsocketURL, err.Error())
+			return err
+		}
+		log.Printf("[ws][%s] PING RECEIVED %s", wsc.WebsocketURL, appData)
+		return nil
+	})
+}
+
+// Close stops the goroutines and closes the connection. Safe to call more than once.
+// Use Done or Wait to know when the goroutines have exited.
 func (wsc *WebsocketConnection) Close() error {
-	close(wsc.CloseChannel)
+	var err error
+	wsc.closeOnce.Do(func() {
+		wsc.cancel()
 
-	err := wsc.Conn.Close()
-	if err != nil {
-		log.Printf("[ws][%s] Error closing the websocket connection: %s", wsc.WebsocketURL, err.Error())
-		return err
-	}
+		wsc.connLock.RLock()
+		conn, standby := wsc.Conn, wsc.standby
+		wsc.connLock.RUnlock()
 
-	if wsc.IsDump {
-		log.Printf("[ws][%s] connection closed", wsc.WebsocketURL)
-	}
-	return nil
+		if standby != nil {
+			standby.Close()
+		}
+
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+
+		err = conn.Close()
+		if err != nil {
+			log.Printf("[ws][%s] Error closing the websocket connection: %s", wsc.WebsocketURL, err.Error())
+			return
+		}
+
+		if wsc.IsDump {
+			log.Printf("[ws][%s] connection closed", wsc.WebsocketURL)
+		}
+	})
+	return err
+}
+
+// Done is closed once every goroutine of the connection has exited
+func (wsc *WebsocketConnection) Done() <-chan struct{} {
+	return wsc.doneChannel
+}
+
+// Wait blocks until every goroutine of the connection has exited
+func (wsc *WebsocketConnection) Wait() {
+	<-wsc.doneChannel
+}
+
+// IsRunning reports whether both the WriteRequest and ReceiveMessage goroutines
+// are running. Safe to call from any goroutine.
+func (wsc *WebsocketConnection) IsRunning() bool {
+	// A rotation runs a second ReceiveMessage goroutine for a while
+	return atomic.LoadInt32(&wsc.runningGoroutines) >= 2
+}
+
+// IsConnected reports whether the connection is open, neither closed nor
+// reconnecting after a drop. Safe to call from any goroutine.
+func (wsc *WebsocketConnection) IsConnected() bool {
+	return wsc.ctx.Err() == nil && atomic.LoadInt32(&wsc.disconnected) == 0
 }
 
-// WriteRequest ...
+// WriteRequest writes the queued messages, no faster than RateLimit allows
 func (wsc *WebsocketConnection) WriteRequest() {
+	atomic.AddInt32(&wsc.runningGoroutines, 1)
+	defer atomic.AddInt32(&wsc.runningGoroutines, -1)
+	defer wsc.waitGroup.Done()
+
 	var err error
 	for {
+		var messageType int
+		var msg []byte
 		select {
-		case <-wsc.CloseChannel:
+		case <-wsc.ctx.Done():
 			log.Printf("[ws][%s] Exiting the WriteRequest go routine", wsc.WebsocketURL)
 			return
 
-		case msg := <-wsc.WriteBufferChannel:
-			err = wsc.Conn.WriteMessage(websocket.TextMessage, msg)
+		case msg = <-wsc.WriteBufferChannel:
+			messageType = websocket.TextMessage
+
+		case msg = <-wsc.PingMessageBufferChannel:
+			messageType = websocket.PingMessage
 
-		case msg := <-wsc.PingMessageBufferChannel:
-			err = wsc.Conn.WriteMessage(websocket.PingMessage, msg)
+		case msg = <-wsc.CloseMessageBufferChannel:
+			messageType = websocket.CloseMessage
+		}
 
-		case msg := <-wsc.CloseMessageBufferChannel:
-			err = wsc.Conn.WriteMessage(websocket.CloseMessage, msg)
+		if !wsc.waitForRateLimit() {
+			log.Printf("[ws][%s] Exiting the WriteRequest go routine", wsc.WebsocketURL)
+			return
 		}
+		err = wsc.conn().WriteMessage(messageType, msg)
 
 		if err != nil {
 			log.Printf("[ws][%s] Error writing message: %s", wsc.WebsocketURL, err.Error())
-			time.Sleep(1 * time.Second)
+			select {
+			case <-wsc.ctx.Done():
+			case <-time.After(1 * time.Second):
+			}
 		}
 	}
 }
 
-// ReceiveMessage ...
-func (wsc *WebsocketConnection) ReceiveMessage() {
-	// CLOSE
-	wsc.Conn.SetCloseHandler(func(code int, text string) error {
-		log.Printf("[ws][%s] websocket exiting [code=%d, text=%s]", wsc.WebsocketURL, code, text)
-		err := wsc.Close()
-		return err
-	})
+// waitForRateLimit waits until the next message is due. It returns false if
+// the connection is closed meanwhile.
+func (wsc *WebsocketConnection) waitForRateLimit() bool {
+	if wsc.rateLimiter == nil {
+		return true
+	}
+	delay := wsc.rateLimiter.take(time.Now())
+	if delay <= 0 {
+		return true
+	}
 
-	// PONG
-	wsc.Conn.SetPongHandler(func(appData string) error {
-		log.Printf("[ws][%s] PONG RECEIVE %s", wsc.WebsocketURL, appData)
-		wsc.Conn.SetReadDeadline(time.Now().Add(wsc.ReadDeadlineTime))
-		return nil
-	})
+	metrics.RateLimitedMessages.WithLabelValues(wsc.Name).Inc()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
-	// PING
-	wsc.Conn.SetPingHandler(func(appData string) error {
-		wsc.Conn.SetReadDeadline(time.Now().Add(wsc.ReadDeadlineTime))
-		err := wsc.Conn.WriteMessage(websocket.PongMessage, nil)
-		if err != nil {
-			log.Printf("[ws][%s] PING RECEIVE ERROR %s", wsc.WebsocketURL, err.Error())
-			return err
-		}
-		log.Printf("[ws][%s] PING RECEIVED %s", wsc.WebsocketURL, appData)
-		return nil
-	})
+	select {
+	case <-wsc.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// ReceiveMessage reads the connection until it is closed
+func (wsc *WebsocketConnection) ReceiveMessage() {
+	wsc.receive(wsc.conn())
+}
+
+// receive reads conn for as long as it is the current connection, or the
+// standby of a rotation. A current connection that fails is replaced by the
+// standby if there is one, or reconnected.
+func (wsc *WebsocketConnection) receive(conn *websocket.Conn) {
+	atomic.AddInt32(&wsc.runningGoroutines, 1)
+	defer atomic.AddInt32(&wsc.runningGoroutines, -1)
+	defer wsc.waitGroup.Done()
 
 	for {
 		select {
-		case <-wsc.CloseChannel:
+		case <-wsc.ctx.Done():
 			log.Printf("[ws][%s] Exiting the ReceiveMessage goroutine", wsc.WebsocketURL)
 			return
 		default:
-			msgType, msg, err := wsc.Conn.ReadMessage()
+			msgType, msg, err := conn.ReadMessage()
+			receivedAt := time.Now()
+			if err != nil && wsc.ctx.Err() != nil {
+				// Closed locally
+				log.Printf("[ws][%s] Exiting the ReceiveMessage goroutine", wsc.WebsocketURL)
+				return
+			}
 			if err != nil {
+				if wsc.replaced(conn) {
+					return
+				}
 				log.Printf("[ws][%s] Error receiving message from the websocket: %s", wsc.WebsocketURL, err.Error())
 
+				if wsc.failOver() {
+					// The standby's goroutine reads on
+					return
+				}
+
+				atomic.StoreInt32(&wsc.disconnected, 1)
+				if wsc.OnDisconnect != nil {
+					wsc.OnDisconnect(err)
+				}
+
 				if wsc.IsAutoReconnect {
 					log.Printf("[ws][%s] Attempting reconnect", wsc.WebsocketURL)
 					wsc.Reconnect()
+					conn = wsc.conn()
 					continue
 				}
 				// Should this come before the reconnect attempt
 				if wsc.ErrorHandleFunc != nil {
 					wsc.ErrorHandleFunc(err)
 				}
+				wsc.Close()
 
 				return
 			}
 
-			wsc.Conn.SetReadDeadline(time.Now().Add(wsc.ReadDeadlineTime * time.Second))
+			conn.SetReadDeadline(time.Now().Add(wsc.ReadDeadlineTime))
 
 			switch msgType {
 			case websocket.BinaryMessage:
+				wsc.handleMessage(conn, receivedAt, msg, nil)
 			case websocket.TextMessage:
 				if wsc.MessageHandleFunc == nil {
 					log.Printf("[ws][%s] No message handler defined: %s", wsc.WebsocketURL, msg)
-					break
-				}
-				err = wsc.MessageHandleFunc(msg)
-				if err != nil {
-					log.Printf("[ws][%s] Error processing the message: %s", wsc.WebsocketURL, err.Error())
 				}
+				wsc.handleMessage(conn, receivedAt, msg, wsc.MessageHandleFunc)
 			case websocket.CloseMessage:
 				wsc.Close()
 			default:
@@ -277,72 +575,298 @@ func (wsc *WebsocketConnection) ReceiveMessage() {
 	}
 }
 
-// Subscribe ...
-func (wsc *WebsocketConnection) Subscribe(subscription interface{}) error {
-	jsonData, err := json.Marshal(subscription)
+// replaced reports whether conn failed because it is no longer needed: it was
+// rotated out, or it was the standby of a rotation, which is then abandoned
+func (wsc *WebsocketConnection) replaced(conn *websocket.Conn) bool {
+	wsc.receiveLock.Lock()
+	defer wsc.receiveLock.Unlock()
+
+	if conn == wsc.conn() {
+		return false
+	}
+	wsc.dropStandby(conn)
+	return true
+}
+
+// failOver makes the standby of a rotation the current connection, if there is one
+func (wsc *WebsocketConnection) failOver() bool {
+	wsc.receiveLock.Lock()
+	defer wsc.receiveLock.Unlock()
+
+	if wsc.standby == nil {
+		return false
+	}
+	wsc.promoteStandby("failover")
+	return true
+}
+
+// handleMessage records and hands over msg, unless it duplicates a message
+// already handed over from the other connection of a rotation
+func (wsc *WebsocketConnection) handleMessage(conn *websocket.Conn, receivedAt time.Time, msg []byte, handleFunc func([]byte) error) {
+	wsc.receiveLock.Lock()
+	defer wsc.receiveLock.Unlock()
+
+	fromPrimary := conn == wsc.conn()
+	forward := fromPrimary
+	// Sequencing costs a decode of every message, so it is only done while needed
+	if wsc.SequenceFunc != nil && wsc.sequencer.active() {
+		if stream, sequence, ok := wsc.SequenceFunc(msg); ok {
+			forward = wsc.sequencer.forward(fromPrimary, stream, sequence)
+		}
+	}
+	if !forward {
+		return
+	}
+
+	if wsc.Recorder != nil {
+		err := wsc.Recorder.RecordFrame(wsc.WebsocketURL, receivedAt, msg)
+		if err != nil {
+			log.Printf("[ws][%s] Error recording the message: %s", wsc.WebsocketURL, err.Error())
+		}
+	}
+
+	if handleFunc != nil {
+		err := handleFunc(msg)
+		if err != nil {
+			log.Printf("[ws][%s] Error processing the message: %s", wsc.WebsocketURL, err.Error())
+		}
+	}
+
+	if wsc.standby != nil && wsc.sequencer.caughtUp() {
+		wsc.promoteStandby("switched")
+	}
+}
+
+// Subscribe subscribes to the streams not already subscribed and adds them to
+// the subscriptions replayed after a reconnect
+func (wsc *WebsocketConnection) Subscribe(streams ...string) error {
+	newStreams := wsc.AddSubscriptions(streams...)
+	if len(newStreams) == 0 {
+		return nil
+	}
+
+	err := wsc.sendSubscription(true, newStreams)
 	if err != nil {
-		log.Printf("[ws][%s] error marshalling subscription info: %s", wsc.WebsocketURL, err.Error())
+		wsc.RemoveSubscriptions(newStreams...)
 		return err
 	}
 
-	wsc.WriteBufferChannel <- jsonData
-	wsc.Subscriptions = append(wsc.Subscriptions, subscription)
+	return nil
+}
+
+// Unsubscribe unsubscribes from the streams and removes them from the
+// subscriptions. Streams not subscribed are ignored.
+func (wsc *WebsocketConnection) Unsubscribe(streams ...string) error {
+	activeStreams := wsc.RemoveSubscriptions(streams...)
+	if len(activeStreams) == 0 {
+		return nil
+	}
+
+	err := wsc.sendSubscription(false, activeStreams)
+	if err != nil {
+		wsc.AddSubscriptions(activeStreams...)
+		return err
+	}
+
+	return nil
+}
+
+// AddSubscriptions adds the streams not already subscribed to the
+// subscriptions replayed after a reconnect, without subscribing to them, and
+// returns them. For callers that send their own subscription requests.
+func (wsc *WebsocketConnection) AddSubscriptions(streams ...string) []string {
+	wsc.subscriptionsLock.Lock()
+	defer wsc.subscriptionsLock.Unlock()
+
+	var newStreams []string
+	for _, stream := range streams {
+		if _, ok := wsc.subscriptions[stream]; !ok {
+			wsc.subscriptions[stream] = struct{}{}
+			newStreams = append(newStreams, stream)
+		}
+	}
+	return newStreams
+}
+
+// RemoveSubscriptions removes the streams from the subscriptions, without
+// unsubscribing from them, and returns those that were subscribed
+func (wsc *WebsocketConnection) RemoveSubscriptions(streams ...string) []string {
+	wsc.subscriptionsLock.Lock()
+	defer wsc.subscriptionsLock.Unlock()
+
+	var activeStreams []string
+	for _, stream := range streams {
+		if _, ok := wsc.subscriptions[stream]; ok {
+			delete(wsc.subscriptions, stream)
+			activeStreams = append(activeStreams, stream)
+		}
+	}
+	return activeStreams
+}
+
+// Subscriptions returns the active streams, sorted
+func (wsc *WebsocketConnection) Subscriptions() []string {
+	wsc.subscriptionsLock.Lock()
+	defer wsc.subscriptionsLock.Unlock()
+
+	return wsc.sortedSubscriptions()
+}
+
+// resubscribe replays the active subscriptions on a new connection
+func (wsc *WebsocketConnection) resubscribe() error {
+	wsc.subscriptionsLock.Lock()
+	defer wsc.subscriptionsLock.Unlock()
+
+	streams := wsc.sortedSubscriptions()
+	if len(streams) == 0 {
+		return nil
+	}
+
+	err := wsc.sendSubscription(true, streams)
+	if err != nil {
+		return err
+	}
+	log.Printf("[ws][%s] Resubscribed to %v", wsc.WebsocketURL, streams)
 
 	return nil
 }
 
-// Reconnect ...
+// syncSubscriptions subscribes to the streams added since previous was taken,
+// and unsubscribes from those removed
+func (wsc *WebsocketConnection) syncSubscriptions(previous []string) {
+	wsc.subscriptionsLock.Lock()
+	defer wsc.subscriptionsLock.Unlock()
+
+	wasSubscribed := make(map[string]bool, len(previous))
+	var removed []string
+	for _, stream := range previous {
+		wasSubscribed[stream] = true
+		if _, ok := wsc.subscriptions[stream]; !ok {
+			removed = append(removed, stream)
+		}
+	}
+	var added []string
+	for _, stream := range wsc.sortedSubscriptions() {
+		if !wasSubscribed[stream] {
+			added = append(added, stream)
+		}
+	}
+
+	if len(added) > 0 {
+		err := wsc.sendSubscription(true, added)
+		if err != nil {
+			log.Printf("[ws][%s] Failed to subscribe to %v: %s", wsc.WebsocketURL, added, err.Error())
+		}
+	}
+	if len(removed) > 0 {
+		err := wsc.sendSubscription(false, removed)
+		if err != nil {
+			log.Printf("[ws][%s] Failed to unsubscribe from %v: %s", wsc.WebsocketURL, removed, err.Error())
+		}
+	}
+}
+
+// sortedSubscriptions expects the caller to hold subscriptionsLock
+func (wsc *WebsocketConnection) sortedSubscriptions() []string {
+	streams := make([]string, 0, len(wsc.subscriptions))
+	for stream := range wsc.subscriptions {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	return streams
+}
+
+func (wsc *WebsocketConnection) sendSubscription(subscribe bool, streams []string) error {
+	if wsc.SubscriptionMessageFunc == nil {
+		return ErrNoSubscriptionMessageFunc
+	}
+	return wsc.SendJSONMessage(wsc.SubscriptionMessageFunc(subscribe, streams))
+}
+
+// Reconnect replaces the dropped connection, waiting between attempts as the
+// ReconnectPolicy says, then replays the subscriptions. The connection is
+// closed if the policy gives up.
 func (wsc *WebsocketConnection) Reconnect() {
-	wsc.Conn.Close()
+	wsc.conn().Close()
+
+	policy := wsc.ReconnectPolicy
+	if policy == nil {
+		policy = NewExponentialBackoff(wsc.ConnectionRetryLimit)
+	}
 
 	var err error
+	connected := false
+	for failedAttempts := 0; !connected; failedAttempts++ {
+		delay, ok := policy.NextDelay(failedAttempts)
+		if !ok {
+			break
+		}
+		if wsc.OnReconnecting != nil {
+			wsc.OnReconnecting(failedAttempts+1, delay)
+		}
 
-	sleep := 0
-	for i := 0; i < wsc.ConnectionRetryLimit; i++ {
-		time.Sleep(time.Duration(sleep) * time.Second)
+		select {
+		case <-wsc.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
 		err = wsc.Connect()
 		if err != nil {
 			log.Printf("[ws][%s] Failed to reconnect: %s", wsc.WebsocketURL, err.Error())
+			metrics.ReconnectAttempts.WithLabelValues(wsc.Name, "failure").Inc()
 		} else {
-			break
+			metrics.ReconnectAttempts.WithLabelValues(wsc.Name, "success").Inc()
+			atomic.StoreInt32(&wsc.disconnected, 0)
+			connected = true
 		}
-
-		sleep <<= 1
 	}
 
-	if err != nil {
-		log.Printf("[ws][%s] Failed to reconnect: %s", wsc.WebsocketURL, err.Error())
+	if !connected {
+		log.Printf("[ws][%s] Giving up reconnecting", wsc.WebsocketURL)
 		wsc.Close()
 		if wsc.ErrorHandleFunc != nil {
 			wsc.ErrorHandleFunc(errors.New("Failed To Reconnect"))
 		}
-	} else {
-		var subscriptions []interface{}
-
-		copy(subscriptions, wsc.Subscriptions)
-		wsc.Subscriptions = []interface{}{}
+		return
+	}
 
-		for _, subscription := range subscriptions {
-			_ = wsc.Subscribe(subscription)
-		}
+	err = wsc.resubscribe()
+	if err != nil {
+		log.Printf("[ws][%s] Failed to resubscribe: %s", wsc.WebsocketURL, err.Error())
 	}
 
+	if wsc.OnReconnected != nil {
+		wsc.OnReconnected()
+	}
 }
 
-// SendMessage ...
-func (wsc *WebsocketConnection) SendMessage(msg []byte) {
-	wsc.WriteBufferChannel <- msg
+// SendMessage queues a text message. It returns ErrClosed once the connection is closed.
+func (wsc *WebsocketConnection) SendMessage(msg []byte) error {
+	return wsc.send(wsc.WriteBufferChannel, msg)
 }
 
 // SendPingMessage ...
-func (wsc *WebsocketConnection) SendPingMessage(msg []byte) {
-	wsc.PingMessageBufferChannel <- msg
-	log.Printf("[ws][%s] PING SENT: %s", wsc.WebsocketURL, msg)
+func (wsc *WebsocketConnection) SendPingMessage(msg []byte) error {
+	err := wsc.send(wsc.PingMessageBufferChannel, msg)
+	if err == nil {
+		log.Printf("[ws][%s] PING SENT: %s", wsc.WebsocketURL, msg)
+	}
+	return err
 }
 
 // SendCloseMessage ...
-func (wsc *WebsocketConnection) SendCloseMessage(msg []byte) {
-	wsc.CloseMessageBufferChannel <- msg
+func (wsc *WebsocketConnection) SendCloseMessage(msg []byte) error {
+	return wsc.send(wsc.CloseMessageBufferChannel, msg)
+}
+
+func (wsc *WebsocketConnection) send(channel bufferChannel, msg []byte) error {
+	select {
+	case <-wsc.ctx.Done():
+		return ErrClosed
+	case channel <- msg:
+		return nil
+	}
 }
 
 // SendJSONMessage ...
@@ -352,6 +876,5 @@ func (wsc *WebsocketConnection) SendJSONMessage(msg interface{}) error {
 		log.Printf("[ws][%s] Failed to marshal the msg to JSON: %s", wsc.WebsocketURL, err.Error())
 		return err
 	}
-	wsc.WriteBufferChannel <- data
-	return nil
+	return wsc.SendMessage(data)
 }
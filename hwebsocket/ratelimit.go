@@ -0,0 +1,55 @@
+package hwebsocket
+
+import (
+	"time"
+)
+
+// RateLimit is a token bucket bounding the frames WriteRequest writes, pings
+// and close frames included: up to Burst at once, refilled at PerSecond. The
+// zero value does not limit. Pongs answering the server's pings are written
+// by the read loop and not counted.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int // 1 when less
+}
+
+// tokenBucket implements RateLimit. Only WriteRequest uses it, so it needs no lock.
+type tokenBucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+// newTokenBucket returns nil when limit does not limit
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.PerSecond <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		perSecond: limit.PerSecond,
+		burst:     burst,
+		tokens:    burst,
+		last:      now,
+	}
+}
+
+// take takes a token and returns how long to wait before it is due. A token
+// not due yet is taken ahead, so the next caller waits for the one after.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.perSecond
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.perSecond * float64(time.Second))
+}
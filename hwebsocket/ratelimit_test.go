@@ -0,0 +1,45 @@
+package hwebsocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket_Take(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newTokenBucket(RateLimit{}, time.Now()))
+
+	start := time.Now()
+	bucket := newTokenBucket(RateLimit{PerSecond: 10, Burst: 2}, start)
+
+	testCases := []struct {
+		after         time.Duration
+		expectedDelay time.Duration
+	}{
+		{0, 0},
+		{0, 0}, // The burst is spent
+		{0, 100 * time.Millisecond},
+		{0, 200 * time.Millisecond}, // Behind the token taken ahead
+		{300 * time.Millisecond, 0},
+		{time.Second, 0}, // Refilled up to the burst only
+		{time.Second, 0},
+		{time.Second, 100 * time.Millisecond},
+	}
+
+	for i, testCase := range testCases {
+		delay := bucket.take(start.Add(testCase.after))
+		assert.InDelta(float64(testCase.expectedDelay), float64(delay), float64(time.Microsecond), "take %d", i)
+	}
+}
+
+func TestTokenBucket_DefaultBurst(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Now()
+	bucket := newTokenBucket(RateLimit{PerSecond: 4}, start)
+	assert.Equal(time.Duration(0), bucket.take(start))
+	assert.Equal(250*time.Millisecond, bucket.take(start))
+}
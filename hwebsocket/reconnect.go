@@ -0,0 +1,81 @@
+package hwebsocket
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// UnlimitedRetries makes ExponentialBackoff retry until the connection is closed
+const UnlimitedRetries = -1
+
+// Defaults of the policy used when no ReconnectPolicy is set
+const (
+	DefaultReconnectInitialDelay = 250 * time.Millisecond
+	DefaultReconnectMaxDelay     = 30 * time.Second
+	DefaultReconnectMultiplier   = 2
+	DefaultReconnectJitter       = 0.2
+)
+
+// ReconnectPolicy decides how long Reconnect waits before each attempt
+type ReconnectPolicy interface {
+	// NextDelay is given the number of attempts that failed so far, 0 before
+	// the first one. It returns false to give up.
+	NextDelay(failedAttempts int) (time.Duration, bool)
+}
+
+// ExponentialBackoff waits InitialDelay before the first attempt and
+// Multiplier times longer before each next one, up to MaxDelay. Each delay is
+// spread by up to ±Jitter of itself so that clients dropped together do not
+// reconnect together.
+//
+// After BreakerThreshold failed attempts in a row the circuit breaker opens:
+// the exchange is probed every BreakerCooldown rather than hammered. A zero
+// BreakerThreshold disables the breaker.
+type ExponentialBackoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64 // Between 0 and 1
+	MaxRetries   int     // Attempts before giving up, or UnlimitedRetries
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// NewExponentialBackoff returns the default policy, giving up after maxRetries attempts
+func NewExponentialBackoff(maxRetries int) *ExponentialBackoff {
+	return &ExponentialBackoff{
+		InitialDelay: DefaultReconnectInitialDelay,
+		MaxDelay:     DefaultReconnectMaxDelay,
+		Multiplier:   DefaultReconnectMultiplier,
+		Jitter:       DefaultReconnectJitter,
+		MaxRetries:   maxRetries,
+	}
+}
+
+// NextDelay ...
+func (eb *ExponentialBackoff) NextDelay(failedAttempts int) (time.Duration, bool) {
+	if eb.MaxRetries != UnlimitedRetries && failedAttempts >= eb.MaxRetries {
+		return 0, false
+	}
+
+	if eb.BreakerThreshold > 0 && failedAttempts >= eb.BreakerThreshold {
+		return eb.jitter(eb.BreakerCooldown), true
+	}
+
+	delay := float64(eb.InitialDelay) * math.Pow(eb.Multiplier, float64(failedAttempts))
+	if eb.MaxDelay > 0 && delay > float64(eb.MaxDelay) {
+		delay = float64(eb.MaxDelay)
+	} else if delay > math.MaxInt64 {
+		delay = math.MaxInt64
+	}
+	return eb.jitter(time.Duration(delay)), true
+}
+
+func (eb *ExponentialBackoff) jitter(delay time.Duration) time.Duration {
+	if eb.Jitter <= 0 {
+		return delay
+	}
+	return time.Duration(float64(delay) * (1 - eb.Jitter + 2*eb.Jitter*rand.Float64()))
+}
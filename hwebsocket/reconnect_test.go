@@ -0,0 +1,57 @@
+package hwebsocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff_NextDelay(t *testing.T) {
+	policy := &ExponentialBackoff{
+		InitialDelay:     100 * time.Millisecond,
+		MaxDelay:         time.Second,
+		Multiplier:       2,
+		MaxRetries:       8,
+		BreakerThreshold: 6,
+		BreakerCooldown:  time.Minute,
+	}
+
+	testCases := []struct {
+		failedAttempts int
+		expectedDelay  time.Duration
+		expectedOK     bool
+	}{
+		{0, 100 * time.Millisecond, true},
+		{1, 200 * time.Millisecond, true},
+		{3, 800 * time.Millisecond, true},
+		{4, time.Second, true}, // Capped at MaxDelay
+		{5, time.Second, true},
+		{6, time.Minute, true}, // The breaker is open
+		{7, time.Minute, true},
+		{8, 0, false},
+	}
+
+	for _, testCase := range testCases {
+		delay, ok := policy.NextDelay(testCase.failedAttempts)
+		assert.Equal(t, testCase.expectedOK, ok, "failed attempts %d", testCase.failedAttempts)
+		assert.Equal(t, testCase.expectedDelay, delay, "failed attempts %d", testCase.failedAttempts)
+	}
+}
+
+func TestExponentialBackoff_Jitter(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := NewExponentialBackoff(UnlimitedRetries)
+	policy.Jitter = 0.5
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		delay, ok := policy.NextDelay(1000)
+		assert.True(ok, "UnlimitedRetries never gives up")
+		assert.GreaterOrEqual(int64(delay), int64(DefaultReconnectMaxDelay/2))
+		assert.LessOrEqual(int64(delay), int64(DefaultReconnectMaxDelay*3/2))
+		distinct[delay] = true
+	}
+	assert.Greater(len(distinct), 1, "The delays must be spread")
+}
@@ -0,0 +1,257 @@
+package hwebsocket
+
+import (
+	"log"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/metrics"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultRotationOverlap bounds how long the old connection is kept once its
+// replacement is open
+const DefaultRotationOverlap = 10 * time.Second
+
+// SequenceFunc extracts the stream and the sequence number of a message, e.g.
+// the symbol and the update ID u of a depth update. ok is false for messages
+// that are not sequenced.
+type SequenceFunc func(msg []byte) (stream string, sequence int64, ok bool)
+
+// streamSequence is the state of one stream in the sequencer
+type streamSequence struct {
+	last        int64 // Last sequence forwarded
+	standbyLast int64 // Last sequence seen on the standby connection
+	switched    bool  // The stream is forwarded from the standby connection
+	catchingUp  bool  // Drop what was already forwarded, until the stream moves past last
+}
+
+// sequencer decides which messages to forward while a rotation overlaps two
+// connections, so every stream is forwarded in order, without duplicates and
+// without gaps.
+//
+// Each stream is forwarded from the primary until the standby has caught up
+// with it, i.e. the standby delivered a sequence the primary already
+// forwarded. From then on the stream is forwarded from the standby only,
+// starting right after the last sequence forwarded from the primary.
+//
+// Only the streams seen since the rotation started are tracked, and messages
+// need not be sequenced at all outside of a rotation, see active.
+type sequencer struct {
+	streams    map[string]*streamSequence
+	rotating   bool
+	catchingUp int // Streams still catching up after the last rotation
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{streams: make(map[string]*streamSequence)}
+}
+
+// active reports whether messages must be sequenced: during a rotation, and
+// after it until every stream has caught up
+func (s *sequencer) active() bool {
+	return s.rotating || s.catchingUp > 0
+}
+
+// startRotation forgets every stream, so the ones no longer subscribed do not
+// hold up the rotation or linger in the map
+func (s *sequencer) startRotation() {
+	s.rotating = true
+	s.streams = make(map[string]*streamSequence)
+	s.catchingUp = 0
+}
+
+// endRotation makes the standby the primary. Streams it had not caught up on
+// drop what was already forwarded, the rest follows on.
+func (s *sequencer) endRotation() {
+	s.rotating = false
+	for _, stream := range s.streams {
+		if !stream.switched {
+			stream.catchingUp = true
+			s.catchingUp++
+		}
+	}
+}
+
+// caughtUp reports whether the standby has caught up on every stream
+func (s *sequencer) caughtUp() bool {
+	if len(s.streams) == 0 {
+		return false
+	}
+	for _, stream := range s.streams {
+		if !stream.switched {
+			return false
+		}
+	}
+	return true
+}
+
+// forward reports whether a message with the given sequence, received on the
+// primary or on the standby connection, must be forwarded
+func (s *sequencer) forward(fromPrimary bool, name string, sequence int64) bool {
+	stream, ok := s.streams[name]
+	if !ok {
+		stream = &streamSequence{}
+		s.streams[name] = stream
+	}
+
+	if !s.rotating {
+		if stream.catchingUp {
+			if sequence <= stream.last {
+				return false
+			}
+			stream.catchingUp = false
+			s.catchingUp--
+		}
+		stream.last = sequence
+		return true
+	}
+
+	if fromPrimary {
+		if stream.switched {
+			return false
+		}
+		if sequence > stream.last {
+			stream.last = sequence
+		}
+		if stream.standbyLast != 0 && stream.standbyLast <= stream.last {
+			stream.switched = true
+		}
+		return true
+	}
+
+	stream.standbyLast = sequence
+	if !stream.switched {
+		// Forwarding the standby while it is ahead of the primary would leave a gap
+		if sequence <= stream.last {
+			stream.switched = true
+		}
+		return false
+	}
+	if sequence <= stream.last {
+		return false
+	}
+	stream.last = sequence
+	return true
+}
+
+// rotateConnection opens a replacement connection every RotationInterval, see rotate
+func (wsc *WebsocketConnection) rotateConnection() {
+	defer wsc.waitGroup.Done()
+
+	ticker := time.NewTicker(wsc.RotationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wsc.ctx.Done():
+			return
+		case <-ticker.C:
+			wsc.rotate()
+		}
+	}
+}
+
+// rotate replaces the connection make-before-break: the replacement is opened
+// and subscribed to every stream, and only once it has caught up on every
+// stream, or after RotationOverlap, is the old connection closed
+func (wsc *WebsocketConnection) rotate() {
+	log.Printf("[ws][%s] Rotating the connection", wsc.WebsocketURL)
+
+	conn, err := wsc.dial()
+	if err != nil {
+		log.Printf("[ws][%s] Failed to open the replacement connection: %s", wsc.WebsocketURL, err.Error())
+		metrics.ConnectionRotations.WithLabelValues(wsc.Name, "failure").Inc()
+		return
+	}
+
+	streams := wsc.Subscriptions()
+	if len(streams) > 0 && wsc.SubscriptionMessageFunc != nil {
+		var data []byte
+		data, err = json.Marshal(wsc.SubscriptionMessageFunc(true, streams))
+		if err == nil {
+			err = conn.WriteMessage(websocket.TextMessage, data)
+		}
+		if err != nil {
+			log.Printf("[ws][%s] Failed to subscribe the replacement connection: %s", wsc.WebsocketURL, err.Error())
+			metrics.ConnectionRotations.WithLabelValues(wsc.Name, "failure").Inc()
+			conn.Close()
+			return
+		}
+	}
+
+	wsc.receiveLock.Lock()
+	if wsc.ctx.Err() != nil {
+		wsc.receiveLock.Unlock()
+		conn.Close()
+		return
+	}
+	wsc.setStandby(conn)
+	wsc.standbyStreams = streams
+	wsc.standbyDone = make(chan struct{})
+	standbyDone := wsc.standbyDone
+	wsc.sequencer.startRotation()
+	wsc.receiveLock.Unlock()
+
+	wsc.waitGroup.Add(1)
+	go wsc.receive(conn)
+
+	overlap := wsc.RotationOverlap
+	if overlap <= 0 {
+		overlap = DefaultRotationOverlap
+	}
+	select {
+	case <-wsc.ctx.Done():
+		return
+	case <-standbyDone:
+		return
+	case <-time.After(overlap):
+	}
+
+	wsc.receiveLock.Lock()
+	defer wsc.receiveLock.Unlock()
+
+	if wsc.standby == conn {
+		log.Printf("[ws][%s] The replacement connection did not catch up on every stream within %s", wsc.WebsocketURL, overlap)
+		wsc.promoteStandby("forced")
+	}
+}
+
+// promoteStandby makes the standby connection the primary and closes the old
+// one. Expects the caller to hold receiveLock.
+func (wsc *WebsocketConnection) promoteStandby(result string) {
+	old := wsc.conn()
+
+	wsc.connLock.Lock()
+	wsc.Conn = wsc.standby
+	wsc.standby = nil
+	wsc.connLock.Unlock()
+
+	wsc.sequencer.endRotation()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	old.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	old.Close()
+
+	metrics.ConnectionRotations.WithLabelValues(wsc.Name, result).Inc()
+	log.Printf("[ws][%s] Rotated the connection (%s)", wsc.WebsocketURL, result)
+
+	// Streams (un)subscribed during the overlap only reached the old connection
+	wsc.syncSubscriptions(wsc.standbyStreams)
+	wsc.standbyStreams = nil
+	close(wsc.standbyDone)
+}
+
+// dropStandby abandons the rotation if conn is the standby. Expects the caller
+// to hold receiveLock.
+func (wsc *WebsocketConnection) dropStandby(conn *websocket.Conn) {
+	if wsc.standby != conn {
+		return
+	}
+	log.Printf("[ws][%s] The replacement connection failed, keeping the current one", wsc.WebsocketURL)
+	metrics.ConnectionRotations.WithLabelValues(wsc.Name, "failure").Inc()
+
+	wsc.setStandby(nil)
+	wsc.standbyStreams = nil
+	close(wsc.standbyDone)
+	wsc.sequencer.endRotation()
+}
@@ -0,0 +1,99 @@
+package hwebsocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sequencedMessage struct {
+	fromPrimary bool
+	sequence    int64
+}
+
+func TestSequencer(t *testing.T) {
+	testCases := []struct {
+		name              string
+		messages          []sequencedMessage
+		expectedForwarded []int64
+		expectedCaughtUp  bool
+	}{
+		{
+			"standby behind the primary",
+			[]sequencedMessage{{true, 3}, {true, 4}, {false, 3}, {true, 5}, {false, 4}, {false, 5}, {true, 6}, {false, 6}, {false, 7}},
+			[]int64{3, 4, 5, 6, 7},
+			true,
+		},
+		{
+			"standby ahead of the primary",
+			[]sequencedMessage{{true, 3}, {false, 5}, {true, 4}, {false, 6}, {true, 5}, {true, 6}, {false, 7}, {true, 7}},
+			[]int64{3, 4, 5, 6, 7},
+			true,
+		},
+		{
+			"standby not caught up yet",
+			[]sequencedMessage{{true, 3}, {false, 5}, {true, 4}},
+			[]int64{3, 4},
+			false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			s := newSequencer()
+			assert.True(s.forward(true, "BTCUSDT", 2))
+			s.startRotation()
+
+			var forwarded []int64
+			for _, message := range testCase.messages {
+				if s.forward(message.fromPrimary, "BTCUSDT", message.sequence) {
+					forwarded = append(forwarded, message.sequence)
+				}
+			}
+			assert.Equal(testCase.expectedForwarded, forwarded)
+			assert.Equal(testCase.expectedCaughtUp, s.caughtUp())
+		})
+	}
+}
+
+func TestSequencer_EndRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSequencer()
+	s.startRotation()
+	s.forward(true, "BTCUSDT", 10)
+	s.forward(false, "BTCUSDT", 11) // Ahead, the primary has not caught up
+	s.endRotation()
+	assert.True(s.active(), "Sequenced until caught up")
+
+	// The new primary was not caught up, so what it has in common with the old one is dropped
+	assert.False(s.forward(true, "BTCUSDT", 9))
+	assert.False(s.forward(true, "BTCUSDT", 10))
+	assert.True(s.forward(true, "BTCUSDT", 12))
+	assert.False(s.active())
+	assert.True(s.forward(true, "BTCUSDT", 12), "Duplicates are left to the message handler once caught up")
+}
+
+func TestSequencer_StartRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSequencer()
+	assert.False(s.active())
+
+	s.startRotation()
+	s.forward(true, "BTCUSDT", 10)
+	s.forward(true, "ETHUSDT", 20) // Unsubscribed before the next rotation
+	s.forward(false, "BTCUSDT", 10)
+	s.endRotation()
+	assert.True(s.active(), "ETHUSDT never caught up")
+
+	s.startRotation()
+	assert.Empty(s.streams)
+	s.forward(true, "BTCUSDT", 11)
+	s.forward(false, "BTCUSDT", 11)
+	assert.True(s.caughtUp(), "The stream gone since must not hold up the rotation")
+	s.endRotation()
+	assert.False(s.active())
+}
@@ -0,0 +1,293 @@
+package limitorderbook_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancesimulator"
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/bensooraj/h-lob-service/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/robaho/fixed"
+	"github.com/stretchr/testify/assert"
+)
+
+const eventually = 5 * time.Second
+
+// newSimulator returns a simulator of BTCUSDT. It is closed after the feeds
+// opened later in the test, so their books unsubscribe from a live connection.
+func newSimulator(t *testing.T, market binancewebsocket.MarketType) *binancesimulator.Simulator {
+	sim := binancesimulator.New(market, 42)
+	sim.AddSymbol("BTCUSDT")
+	t.Cleanup(sim.Close)
+	return sim
+}
+
+// simulatedBook runs a book manager against a simulator over a real websocket
+// connection, configured by options before it is opened
+func simulatedBook(t *testing.T, market binancewebsocket.MarketType, options ...func(*binancewebsocket.BinanceWebsocket)) (*binancesimulator.Simulator, *limitorderbook.BinanceL2LimitOrderBook) {
+	sim := newSimulator(t, market)
+
+	binanceWebsocket := binancewebsocket.NewBinanceWebsocket()
+	bookManager := simulatedManager(sim, binanceWebsocket)
+	binanceWebsocket.OnDisconnect = bookManager.HandleDisconnect
+	binanceWebsocket.OnReconnected = bookManager.HandleReconnect
+	for _, option := range options {
+		option(binanceWebsocket)
+	}
+
+	return sim, openSimulatedBook(t, sim, sim.WebsocketURL(), bookManager)
+}
+
+// simulatedManager returns a book manager fed from feed, which fetches its snapshots from sim
+func simulatedManager(sim *binancesimulator.Simulator, feed binancewebsocket.Feed) *limitorderbook.BinanceL2LimitOrderBookManager {
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(feed)
+	bookManager.Market = sim.Market
+	bookManager.SnapshotFetcher = limitorderbook.NewHTTPSnapshotFetcher(sim.RESTBaseURL(), sim.Market.DepthSnapshotEndpoint(), 1000, time.Second)
+	return bookManager
+}
+
+// openSimulatedBook opens the manager's feed to url on sim and subscribes to BTCUSDT
+func openSimulatedBook(t *testing.T, sim *binancesimulator.Simulator, url string, bookManager *limitorderbook.BinanceL2LimitOrderBookManager) *limitorderbook.BinanceL2LimitOrderBook {
+	feed := bookManager.Websocket
+	err := feed.Open(context.Background(), url, bookManager.HandleMessage, func(err error) {})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		bookManager.Close()
+		feed.Close()
+		feed.Wait()
+	})
+
+	assert.NoError(t, bookManager.Subscribe("BTCUSDT"))
+	assert.Eventually(t, func() bool { return len(sim.Subscriptions()) == 1 }, eventually, time.Millisecond)
+
+	bL2LoB, _ := bookManager.Book("BTCUSDT")
+	return bL2LoB
+}
+
+// assertInSync waits for the book to catch up with the simulator and compares every level
+func assertInSync(t *testing.T, sim *binancesimulator.Simulator, bL2LoB *limitorderbook.BinanceL2LimitOrderBook) {
+	lastUpdateID, err := sim.LastUpdateID(bL2LoB.Symbol)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		snapshot := bL2LoB.Snapshot()
+		return bL2LoB.SyncState() == limitorderbook.SyncStateLive && snapshot.LastUpdateID == lastUpdateID
+	}, eventually, time.Millisecond, "The book must catch up with update %d", lastUpdateID)
+
+	bids, asks, err := sim.Book(bL2LoB.Symbol)
+	assert.NoError(t, err)
+	snapshot := bL2LoB.Snapshot()
+	assert.Equal(t, toPriceLevels(bids), snapshot.TopN("b", 0))
+	assert.Equal(t, toPriceLevels(asks), snapshot.TopN("a", 0))
+}
+
+func toPriceLevels(levels [][2]string) []limitorderbook.PriceLevel {
+	priceLevels := make([]limitorderbook.PriceLevel, 0, len(levels))
+	for _, level := range levels {
+		quantity, _ := strconv.ParseFloat(level[1], 64)
+		priceLevels = append(priceLevels, limitorderbook.PriceLevel{Price: fixed.MustParse(level[0]), Quantity: quantity})
+	}
+	return priceLevels
+}
+
+func TestBinanceLoB_Simulated(t *testing.T) {
+	for _, market := range []binancewebsocket.MarketType{binancewebsocket.MarketUSDMFutures, binancewebsocket.MarketSpot} {
+		t.Run(string(market), func(t *testing.T) {
+			assert := assert.New(t)
+
+			sim, bL2LoB := simulatedBook(t, market)
+
+			sim.Publish("BTCUSDT", 1)
+			assert.Eventually(func() bool { return sim.SnapshotRequests("BTCUSDT") == 1 }, eventually, time.Millisecond)
+			assert.ErrorIs(sim.Publish("ETHUSDT", 1), binancesimulator.ErrUnknownSymbol)
+			sim.Publish("BTCUSDT", 50)
+			assertInSync(t, sim, bL2LoB)
+
+			// Duplicates are ignored
+			sim.PublishDuplicate("BTCUSDT")
+			sim.Publish("BTCUSDT", 10)
+			assertInSync(t, sim, bL2LoB)
+			assert.Equal(1, sim.SnapshotRequests("BTCUSDT"), "A duplicate must not trigger a resync")
+
+			// A gap triggers a resync
+			sim.InjectGap("BTCUSDT")
+			sim.Publish("BTCUSDT", 1)
+			assert.Eventually(func() bool { return sim.SnapshotRequests("BTCUSDT") == 2 }, eventually, time.Millisecond)
+			sim.Publish("BTCUSDT", 10)
+			assertInSync(t, sim, bL2LoB)
+
+			// A stale snapshot is refetched
+			sim.InjectGap("BTCUSDT")
+			sim.ServeStaleSnapshots("BTCUSDT", 1, 20)
+			sim.Publish("BTCUSDT", 1)
+			assert.Eventually(func() bool { return sim.SnapshotRequests("BTCUSDT") == 4 }, eventually, time.Millisecond)
+			sim.Publish("BTCUSDT", 10)
+			assertInSync(t, sim, bL2LoB)
+		})
+	}
+}
+
+func TestBinanceLoB_SimulatedReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	sim, bL2LoB := simulatedBook(t, binancewebsocket.MarketUSDMFutures)
+
+	sim.Publish("BTCUSDT", 10)
+	assertInSync(t, sim, bL2LoB)
+	assert.Equal(1, sim.SnapshotRequests("BTCUSDT"))
+
+	// The subscription is replayed on the new connection and the book resyncs,
+	// even though no event was missed
+	sim.Disconnect()
+	assert.Eventually(func() bool {
+		return sim.Connections() == 1 && len(sim.Subscriptions()) == 1
+	}, eventually, time.Millisecond)
+	assert.Equal([]string{"btcusdt@depth"}, sim.Subscriptions())
+	assert.Eventually(func() bool { return bL2LoB.SyncState() == limitorderbook.SyncStateBuffering }, eventually, time.Millisecond)
+
+	sim.Publish("BTCUSDT", 1)
+	assert.Eventually(func() bool { return sim.SnapshotRequests("BTCUSDT") == 2 }, eventually, time.Millisecond)
+	sim.Publish("BTCUSDT", 10)
+	assertInSync(t, sim, bL2LoB)
+}
+
+func TestBinanceLoB_SimulatedRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	sim, bL2LoB := simulatedBook(t, binancewebsocket.MarketUSDMFutures, func(binanceWebsocket *binancewebsocket.BinanceWebsocket) {
+		binanceWebsocket.Name = "rotation"
+		binanceWebsocket.RotationInterval = 200 * time.Millisecond
+		binanceWebsocket.RotationOverlap = 5 * time.Second
+	})
+
+	switched := metrics.ConnectionRotations.WithLabelValues("rotation", "switched")
+	switchedBefore := testutil.ToFloat64(switched)
+
+	sim.Publish("BTCUSDT", 10)
+	assertInSync(t, sim, bL2LoB)
+
+	// Keep the stream busy while the connection is replaced underneath
+	stopChannel := make(chan struct{})
+	publishedChannel := make(chan struct{})
+	go func() {
+		defer close(publishedChannel)
+		for {
+			select {
+			case <-stopChannel:
+				return
+			case <-time.After(time.Millisecond):
+				sim.Publish("BTCUSDT", 1)
+			}
+		}
+	}()
+
+	assert.Eventually(func() bool { return testutil.ToFloat64(switched) >= switchedBefore+2 }, eventually, time.Millisecond)
+	close(stopChannel)
+	<-publishedChannel
+
+	assertInSync(t, sim, bL2LoB)
+	assert.Equal(1, sim.SnapshotRequests("BTCUSDT"), "Rotating must not cost a resync")
+	assert.Eventually(func() bool { return sim.Connections() == 1 }, eventually, time.Millisecond, "The old connections must be closed")
+}
+
+func TestBinanceLoB_SimulatedArbitration(t *testing.T) {
+	assert := assert.New(t)
+
+	sim := newSimulator(t, binancewebsocket.MarketUSDMFutures)
+
+	arbitrator := binancewebsocket.NewArbitrator(binancewebsocket.NewBinanceWebsocket(), binancewebsocket.NewBinanceWebsocket())
+	bookManager := simulatedManager(sim, arbitrator)
+	arbitrator.OnDisconnect = bookManager.HandleDisconnect
+	arbitrator.OnReconnected = bookManager.HandleReconnect
+	bL2LoB := openSimulatedBook(t, sim, sim.WebsocketURL(), bookManager)
+	assert.Eventually(func() bool { return sim.Connections() == 2 }, eventually, time.Millisecond)
+
+	sim.Publish("BTCUSDT", 50)
+	assertInSync(t, sim, bL2LoB)
+
+	// Every update is forwarded exactly once, from either connection
+	wins := arbitrator.Wins()
+	assert.Equal(int64(50), wins[0]+wins[1])
+
+	// The book stays live while one connection drops and comes back
+	sim.DisconnectN(1)
+	sim.Publish("BTCUSDT", 10)
+	assertInSync(t, sim, bL2LoB)
+	assert.Eventually(func() bool { return sim.Connections() == 2 }, eventually, time.Millisecond)
+	sim.Publish("BTCUSDT", 10)
+	assertInSync(t, sim, bL2LoB)
+	assert.Equal(1, sim.SnapshotRequests("BTCUSDT"), "Losing one connection must not cost a resync")
+
+	// Losing both is a disconnect
+	sim.Disconnect()
+	assert.Eventually(func() bool {
+		return sim.Connections() == 2 && len(sim.Subscriptions()) == 1
+	}, eventually, time.Millisecond)
+	sim.Publish("BTCUSDT", 1)
+	assert.Eventually(func() bool { return sim.SnapshotRequests("BTCUSDT") == 2 }, eventually, time.Millisecond)
+	sim.Publish("BTCUSDT", 10)
+	assertInSync(t, sim, bL2LoB)
+}
+
+func TestBinanceLoB_SimulatedCombinedStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	sim := newSimulator(t, binancewebsocket.MarketUSDMFutures)
+
+	// Arbitrating needs the update IDs from inside the wrapper
+	arbitrator := binancewebsocket.NewArbitrator(binancewebsocket.NewBinanceWebsocket(), binancewebsocket.NewBinanceWebsocket())
+	bookManager := simulatedManager(sim, arbitrator)
+	combinedURL := binancewebsocket.CombinedStreamURL(sim.WebsocketURL(), []string{"btcusdt@depth"})
+	bL2LoB := openSimulatedBook(t, sim, combinedURL, bookManager)
+
+	sim.Publish("BTCUSDT", 50)
+	assertInSync(t, sim, bL2LoB)
+	wins := arbitrator.Wins()
+	assert.Equal(int64(50), wins[0]+wins[1])
+
+	sim.PublishDuplicate("BTCUSDT")
+	sim.Publish("BTCUSDT", 10)
+	assertInSync(t, sim, bL2LoB)
+	assert.Equal(1, sim.SnapshotRequests("BTCUSDT"))
+}
+
+func TestBinanceLoB_SimulatedShardReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	sim := newSimulator(t, binancewebsocket.MarketUSDMFutures)
+	sim.AddSymbol("ETHUSDT")
+
+	binanceWebsocket := binancewebsocket.NewBinanceWebsocket()
+	binanceWebsocket.MaxStreams = 1
+	bookManager := simulatedManager(sim, binanceWebsocket)
+	binanceWebsocket.OnDisconnect = bookManager.HandleDisconnect
+	binanceWebsocket.OnReconnected = bookManager.HandleReconnect
+	btcBook := openSimulatedBook(t, sim, sim.WebsocketURL(), bookManager)
+	assert.NoError(bookManager.Subscribe("ETHUSDT"))
+	assert.Equal(2, sim.Connections())
+	ethBook, _ := bookManager.Book("ETHUSDT")
+
+	sim.Publish("BTCUSDT", 10)
+	sim.Publish("ETHUSDT", 10)
+	assertInSync(t, sim, btcBook)
+	assertInSync(t, sim, ethBook)
+
+	// Only the books of the shard that dropped resync
+	sim.DisconnectN(1)
+	assert.Eventually(func() bool {
+		return sim.Connections() == 2 && len(sim.Subscriptions()) == 2
+	}, eventually, time.Millisecond)
+	sim.Publish("BTCUSDT", 1)
+	sim.Publish("ETHUSDT", 1)
+	assert.Eventually(func() bool {
+		return sim.SnapshotRequests("BTCUSDT")+sim.SnapshotRequests("ETHUSDT") == 3
+	}, eventually, time.Millisecond)
+	sim.Publish("BTCUSDT", 10)
+	sim.Publish("ETHUSDT", 10)
+	assertInSync(t, sim, btcBook)
+	assertInSync(t, sim, ethBook)
+	assert.ElementsMatch([]int{1, 2}, []int{sim.SnapshotRequests("BTCUSDT"), sim.SnapshotRequests("ETHUSDT")}, "The other shard's book must stay live")
+}
@@ -1,13 +1,16 @@
 package limitorderbook
 
 import (
-	"io/ioutil"
+	"context"
 	"log"
-	"net/http"
-	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/metrics"
 	"github.com/google/btree"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/robaho/fixed"
@@ -17,25 +20,46 @@ var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 type BinanceL2LimitOrderBook struct {
 	*L2LimitOrderBook
+	Market                   binancewebsocket.MarketType
 	LastUpdateID             int64
+	LastEventTime            int64
 	DepthUpdateBufferChannel chan binancewebsocket.DepthUpdate
-	IsInSync                 bool
+	SnapshotFetcher          SnapshotFetcher
+	SnapshotRetryDelay       time.Duration
+	InlineSnapshots          bool // Fetch snapshots on the update goroutine, see fetchSnapshot
+
+	syncState           int32 // SyncState, accessed atomically
+	isUpdating          int32 // 1 while the update goroutine runs, accessed atomically
+	lastAppliedAt       int64 // Unix nanoseconds, accessed atomically
+	pendingDepthUpdates []binancewebsocket.DepthUpdate
+	syncGeneration      int64 // Bumped each time the procedure starts over, see fetchSnapshot
+	snapshotChannel     chan snapshotResult
+	resyncChannel       chan SyncState // The state to restart the procedure from
+	flushChannel        chan chan struct{}
+	stoppedChannel      chan struct{} // Closed when the update goroutine exits
+	metricsOnce         sync.Once
+	metrics             *bookMetrics
 }
 
-func NewBinanceL2LimitOrderBook() *BinanceL2LimitOrderBook {
+func NewBinanceL2LimitOrderBook(symbol string) *BinanceL2LimitOrderBook {
 	l2lob := NewL2LimitOrderBook(0)
 	bL2LoB := &BinanceL2LimitOrderBook{
 		L2LimitOrderBook:         l2lob,
 		LastUpdateID:             0,
 		DepthUpdateBufferChannel: make(chan binancewebsocket.DepthUpdate, 100),
+		SnapshotRetryDelay:       DefaultSnapshotRetryDelay,
+		snapshotChannel:          make(chan snapshotResult, 1),
+		resyncChannel:            make(chan SyncState, 1),
+		flushChannel:             make(chan chan struct{}),
+		stoppedChannel:           make(chan struct{}),
 	}
+	bL2LoB.SetMarket(binancewebsocket.MarketUSDMFutures)
+	bL2LoB.SetSnapshotFetcher(defaultSnapshotFetcher(bL2LoB.Market))
 
 	bL2LoB.Exchange = "binance"
-	bL2LoB.Symbol = "BTCUSDT"
+	bL2LoB.Symbol = strings.ToUpper(symbol)
 	bL2LoB.Bids = btree.New(2)
 	bL2LoB.Asks = btree.New(2)
-	bL2LoB.CumulativeBidLimitsMap = make(map[LoBFixed]float64)
-	bL2LoB.CumulativeAskLimitsMap = make(map[LoBFixed]float64)
 
 	return bL2LoB
 }
@@ -49,97 +73,245 @@ type DepthSnapshot struct {
 	Asks              [][2]string `json:"asks"`
 }
 
-// InitOrderBookFromSnapshot ...
-func (bL2LoB *BinanceL2LimitOrderBook) InitOrderBookFromSnapshot() error {
-	depthSnapshotURL := url.URL{Scheme: "https", Host: "testnet.binancefuture.com", Path: "/fapi/v1/depth", RawQuery: "symbol=BTCUSDT&limit=1000"}
-	response, err := http.Get(depthSnapshotURL.String())
-	if err != nil {
-		return err
-	}
+// SetMarket selects the market's sequencing rules. It leaves the snapshot
+// fetcher alone, see SetSnapshotFetcher.
+func (bL2LoB *BinanceL2LimitOrderBook) SetMarket(market binancewebsocket.MarketType) *BinanceL2LimitOrderBook {
+	bL2LoB.Market = market
+	return bL2LoB
+}
 
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return err
-	}
+// defaultSnapshotFetcher fetches from the market's testnet depth endpoint
+func defaultSnapshotFetcher(market binancewebsocket.MarketType) SnapshotFetcher {
+	return NewHTTPSnapshotFetcher(market.RESTBaseURL(true), market.DepthSnapshotEndpoint(), 1000, 10*time.Second)
+}
+
+// SetSnapshotFetcher ..
+func (bL2LoB *BinanceL2LimitOrderBook) SetSnapshotFetcher(snapshotFetcher SnapshotFetcher) *BinanceL2LimitOrderBook {
+	bL2LoB.SnapshotFetcher = snapshotFetcher
+	return bL2LoB
+}
+
+// FetchDepthSnapshot ...
+func (bL2LoB *BinanceL2LimitOrderBook) FetchDepthSnapshot() (*DepthSnapshot, error) {
+	return bL2LoB.SnapshotFetcher.FetchDepthSnapshot(bL2LoB.Symbol)
+}
 
-	var depthSnapshot DepthSnapshot
-	err = json.Unmarshal(data, &depthSnapshot)
+// InitOrderBookFromSnapshot replaces the book with a freshly fetched depth snapshot
+func (bL2LoB *BinanceL2LimitOrderBook) InitOrderBookFromSnapshot() error {
+	depthSnapshot, err := bL2LoB.FetchDepthSnapshot()
 	if err != nil {
 		return err
 	}
 
-	// Set the last update ID
-	bL2LoB.ProcessBidsAndAsks(depthSnapshot.Bids, "b") // b => bids
-	bL2LoB.ProcessBidsAndAsks(depthSnapshot.Asks, "a") // a => asks
-	bL2LoB.LastUpdateID = depthSnapshot.LastUpdateID
+	bL2LoB.resetFromSnapshot(depthSnapshot)
 
 	log.Printf("%s orderbook for %s initialised\n", bL2LoB.Exchange, bL2LoB.Symbol)
 
 	return nil
 }
 
-func (bL2LoB *BinanceL2LimitOrderBook) UpdateOrderBook(doneChannel <-chan struct{}) {
+// UpdateOrderBook starts the goroutine that keeps the book in sync with the
+// depth stream, see SyncState for the stages it goes through. Once ctx is
+// cancelled the goroutine applies the updates already buffered and exits.
+func (bL2LoB *BinanceL2LimitOrderBook) UpdateOrderBook(ctx context.Context) {
+	bL2LoB.setSyncState(SyncStateBuffering)
 
+	atomic.StoreInt32(&bL2LoB.isUpdating, 1)
 	go func() {
+		defer close(bL2LoB.stoppedChannel)
+		defer atomic.StoreInt32(&bL2LoB.isUpdating, 0)
+
+		doneChannel := ctx.Done()
+		batch := make([]binancewebsocket.DepthUpdate, 0, cap(bL2LoB.DepthUpdateBufferChannel))
 		for {
+			// Blocks until there is something to do
 			select {
 			case <-doneChannel:
-				log.Println("Exiting UpdateOrderBook goroutine")
+				bL2LoB.drain(batch, doneChannel)
+				log.Printf("[ORDERBOOK][%s] Exiting UpdateOrderBook goroutine\n", bL2LoB.Symbol)
 				return
 			case depthUpdate := <-bL2LoB.DepthUpdateBufferChannel:
-				log.Printf("[ORDERBOOK] u: %d | U: %d | pu: %d | local: %d\n", depthUpdate.LastUpdateID, depthUpdate.FirstUpdateID, depthUpdate.PreviousLastUpdateID, bL2LoB.LastUpdateID)
-
-				// If the LastUpdateID has been reset to 0, please wait for
-				if bL2LoB.LastUpdateID == 0 {
-					err := bL2LoB.InitOrderBookFromSnapshot()
-					if err != nil {
-						log.Println("Error initialising the orderbook from the depth snapshot: ", err)
-						break
-					}
+				// A restart requested before the update arrived goes first
+				select {
+				case state := <-bL2LoB.resyncChannel:
+					bL2LoB.restart(state)
+				default:
 				}
+				batch = bL2LoB.receiveBatch(append(batch[:0], depthUpdate))
+				bL2LoB.handleDepthUpdates(batch, doneChannel)
+			case result := <-bL2LoB.snapshotChannel:
+				bL2LoB.handleSnapshot(result, doneChannel)
+			case state := <-bL2LoB.resyncChannel:
+				bL2LoB.restart(state)
+			case flushed := <-bL2LoB.flushChannel:
+				bL2LoB.flush(batch, doneChannel)
+				close(flushed)
+			}
+		}
+	}()
 
-				// Drop any event where u is < lastUpdateId in the snapshot.
-				if depthUpdate.LastUpdateID < bL2LoB.LastUpdateID {
-					log.Printf("[ORDERBOOK] Skipping stale Depth Update ID. Received %d | local %d\n ", depthUpdate.LastUpdateID, bL2LoB.LastUpdateID)
-					break
-				}
+}
 
-				// The first processed event should have U <= lastUpdateId AND u >= lastUpdateId
-				if depthUpdate.FirstUpdateID <= bL2LoB.LastUpdateID && depthUpdate.LastUpdateID >= bL2LoB.LastUpdateID {
+// receiveBatch appends whatever else is already buffered, without blocking, up
+// to the capacity of the batch
+func (bL2LoB *BinanceL2LimitOrderBook) receiveBatch(batch []binancewebsocket.DepthUpdate) []binancewebsocket.DepthUpdate {
+	for len(batch) < cap(batch) {
+		select {
+		case depthUpdate := <-bL2LoB.DepthUpdateBufferChannel:
+			batch = append(batch, depthUpdate)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
 
-					log.Println("[ORDERBOOK] Processing first depth update event")
-					bL2LoB.ProcessBidsAndAsks(depthUpdate.BidDepthDelta, "b") // b => bids
-					bL2LoB.ProcessBidsAndAsks(depthUpdate.AskDepthDelta, "a") // a => asks
-					bL2LoB.LastUpdateID = depthUpdate.LastUpdateID
+// drain handles the depth updates still buffered, so none that were received are lost
+func (bL2LoB *BinanceL2LimitOrderBook) drain(batch []binancewebsocket.DepthUpdate, doneChannel <-chan struct{}) {
+	for {
+		batch = bL2LoB.receiveBatch(batch[:0])
+		if len(batch) == 0 {
+			return
+		}
+		bL2LoB.handleDepthUpdates(batch, doneChannel)
+	}
+}
 
-				} else if depthUpdate.PreviousLastUpdateID == bL2LoB.LastUpdateID {
+// flush handles the depth updates and the snapshot already received
+func (bL2LoB *BinanceL2LimitOrderBook) flush(batch []binancewebsocket.DepthUpdate, doneChannel <-chan struct{}) {
+	bL2LoB.drain(batch, doneChannel)
 
-					// While listening to the stream, each new event's pu should be equal to the previous event's u,
-					// otherwise re-initialize the process
-					log.Println("[ORDERBOOK] Processing in-sync depth update events")
-					bL2LoB.ProcessBidsAndAsks(depthUpdate.BidDepthDelta, "b") // b => bids
-					bL2LoB.ProcessBidsAndAsks(depthUpdate.AskDepthDelta, "a") // a => asks
-					bL2LoB.LastUpdateID = depthUpdate.LastUpdateID
+	select {
+	case result := <-bL2LoB.snapshotChannel:
+		bL2LoB.handleSnapshot(result, doneChannel)
+	default:
+	}
+}
 
-				} else {
-					log.Println("[ORDERBOOK] Updates/local copy not in-sync. Re-initialising")
-					bL2LoB.LastUpdateID = 0
-					break
-				}
-				//
-			default:
-				// Just so the select is non-blocking
+// Flush blocks until the update goroutine has handled every depth update
+// handed to it so far, or has exited. Safe to call from any goroutine.
+func (bL2LoB *BinanceL2LimitOrderBook) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case bL2LoB.flushChannel <- flushed:
+	case <-bL2LoB.stoppedChannel:
+		return
+	}
 
-			}
-		}
-	}()
+	select {
+	case <-flushed:
+	case <-bL2LoB.stoppedChannel:
+	}
+}
 
+// Resync makes the book fetch a fresh snapshot with the next depth update,
+// e.g. after the stream reconnected. Safe to call from any goroutine.
+func (bL2LoB *BinanceL2LimitOrderBook) Resync() {
+	bL2LoB.requestRestart(SyncStateBuffering)
+}
+
+// MarkUnsynced tells the book its stream dropped, so it is not live until it
+// has resynced. Safe to call from any goroutine.
+func (bL2LoB *BinanceL2LimitOrderBook) MarkUnsynced() {
+	bL2LoB.requestRestart(SyncStateUnsynced)
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) requestRestart(state SyncState) {
+	select {
+	case bL2LoB.resyncChannel <- state:
+	default:
+		// Already requested. Either state fetches a snapshot with the next update.
+	}
+}
+
+// Done is closed once the update goroutine has exited
+func (bL2LoB *BinanceL2LimitOrderBook) Done() <-chan struct{} {
+	return bL2LoB.stoppedChannel
+}
+
+// Wait blocks until the update goroutine has exited
+func (bL2LoB *BinanceL2LimitOrderBook) Wait() {
+	<-bL2LoB.stoppedChannel
+}
+
+// IsUpdating reports whether the update goroutine is running. Safe to call from any goroutine.
+func (bL2LoB *BinanceL2LimitOrderBook) IsUpdating() bool {
+	return atomic.LoadInt32(&bL2LoB.isUpdating) == 1
+}
+
+// LastAppliedAt returns when the book last applied a snapshot or depth update,
+// the zero time if never. Safe to call from any goroutine.
+func (bL2LoB *BinanceL2LimitOrderBook) LastAppliedAt() time.Time {
+	lastAppliedAt := atomic.LoadInt64(&bL2LoB.lastAppliedAt)
+	if lastAppliedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastAppliedAt)
+}
+
+// Snapshot returns an immutable copy of the book tagged with the last applied
+// update ID and event time. Readers can use it without holding the book's lock.
+func (bL2LoB *BinanceL2LimitOrderBook) Snapshot() *BookSnapshot {
+	bL2LoB.Lock()
+	defer bL2LoB.Unlock()
+
+	snapshot := bL2LoB.snapshot()
+	snapshot.LastUpdateID = bL2LoB.LastUpdateID
+	snapshot.EventTime = bL2LoB.LastEventTime
+
+	return snapshot
+}
+
+// resetFromSnapshot throws away every level and loads the snapshot
+func (bL2LoB *BinanceL2LimitOrderBook) resetFromSnapshot(depthSnapshot *DepthSnapshot) {
+	bL2LoB.record(bL2LoB.loadSnapshot(depthSnapshot))
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) loadSnapshot(depthSnapshot *DepthSnapshot) *bookObservation {
+	bL2LoB.Lock()
+	defer bL2LoB.Unlock()
+
+	bL2LoB.reset()
+	bL2LoB.processBidsAndAsks(depthSnapshot.Bids, "b") // b => bids
+	bL2LoB.processBidsAndAsks(depthSnapshot.Asks, "a") // a => asks
+	bL2LoB.LastUpdateID = depthSnapshot.LastUpdateID
+	bL2LoB.LastEventTime = depthSnapshot.MessageOutputTime
+	atomic.StoreInt64(&bL2LoB.lastAppliedAt, time.Now().UnixNano())
+	bL2LoB.notifyChanged()
+
+	return bL2LoB.observeLevels()
+}
+
+// applyDepth applies both sides and moves the update ID forward under a single
+// lock acquisition, so a Snapshot never sees a half-applied event
+func (bL2LoB *BinanceL2LimitOrderBook) applyDepth(bids, asks [][2]string, lastUpdateID, eventTime int64) {
+	bL2LoB.record(bL2LoB.applyDepthLocked(bids, asks, lastUpdateID, eventTime))
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) applyDepthLocked(bids, asks [][2]string, lastUpdateID, eventTime int64) *bookObservation {
+	bL2LoB.Lock()
+	defer bL2LoB.Unlock()
+
+	start := time.Now()
+	bL2LoB.processBidsAndAsks(bids, "b") // b => bids
+	bL2LoB.processBidsAndAsks(asks, "a") // a => asks
+	bL2LoB.LastUpdateID = lastUpdateID
+	bL2LoB.LastEventTime = eventTime
+	atomic.StoreInt64(&bL2LoB.lastAppliedAt, time.Now().UnixNano())
+	bL2LoB.notifyChanged()
+
+	return bL2LoB.observeApply(start)
 }
 
 func (bL2LoB *BinanceL2LimitOrderBook) ProcessBidsAndAsks(priceQuantityPairs [][2]string, side string) error {
 	bL2LoB.Lock()
 	defer bL2LoB.Unlock()
 
+	return bL2LoB.processBidsAndAsks(priceQuantityPairs, side)
+}
+
+// processBidsAndAsks expects the caller to hold the lock
+func (bL2LoB *BinanceL2LimitOrderBook) processBidsAndAsks(priceQuantityPairs [][2]string, side string) error {
 	for _, pqPair := range priceQuantityPairs {
 		p := pqPair[0] // Price
 		q := pqPair[1] // Quantity
@@ -148,6 +320,7 @@ func (bL2LoB *BinanceL2LimitOrderBook) ProcessBidsAndAsks(priceQuantityPairs [][
 		quantity, err := strconv.ParseFloat(q, 64)
 		if err != nil {
 			log.Printf("[ERROR] price %s with quantity %s. %s", p, q, err.Error())
+			metrics.ParseFailures.WithLabelValues(bL2LoB.Exchange, "price_level").Inc()
 			continue
 		}
 		// Remove the quantity if needed
@@ -0,0 +1,103 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package limitorderbook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+)
+
+// cpuTime is the user and system time the process has used so far
+func cpuTime() time.Duration {
+	var rusage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &rusage)
+	return time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+}
+
+// liveBook starts the update goroutine and waits for the book to go live at update 1
+func liveBook(b *testing.B) (*BinanceL2LimitOrderBook, context.CancelFunc) {
+	b.Helper()
+
+	levels := make([][2]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		levels = append(levels, [2]string{strconv.Itoa(10000 - i), "1"})
+	}
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 1, Bids: levels})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT").SetSnapshotFetcher(snapshotFetcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	bL2LoB.UpdateOrderBook(ctx)
+
+	bL2LoB.DepthUpdateBufferChannel <- depthUpdate(1, 1, 0, nil, nil)
+	for bL2LoB.SyncState() != SyncStateLive {
+		time.Sleep(time.Millisecond)
+	}
+	return bL2LoB, cancel
+}
+
+// BenchmarkBinanceLoB_UpdateOrderBook reports the throughput of the update
+// goroutine under a synthetic stream, and the CPU it uses both under load and
+// while the stream is quiet
+func BenchmarkBinanceLoB_UpdateOrderBook(b *testing.B) {
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(logOutput)
+
+	b.Run("load", func(b *testing.B) {
+		bL2LoB, cancel := liveBook(b)
+		defer cancel()
+
+		// Ten levels a side per event, like a busy futures depth stream
+		depthUpdates := make([]binancewebsocket.DepthUpdate, b.N)
+		for i := range depthUpdates {
+			u := int64(i) + 2
+			var bids, asks [][2]string
+			for level := 0; level < 10; level++ {
+				quantity := fmt.Sprintf("%d", (i+level)%5)
+				bids = append(bids, [2]string{strconv.Itoa(10000 - (i+level)%1000), quantity})
+				asks = append(asks, [2]string{strconv.Itoa(10001 + (i+level)%1000), quantity})
+			}
+			depthUpdates[i] = depthUpdate(u, u, u-1, bids, asks)
+		}
+		lastUpdateID := int64(b.N) + 1
+
+		b.ResetTimer()
+		start, startCPU := time.Now(), cpuTime()
+		for _, depthUpdate := range depthUpdates {
+			bL2LoB.DepthUpdateBufferChannel <- depthUpdate
+		}
+		for bL2LoB.Snapshot().LastUpdateID != lastUpdateID {
+			time.Sleep(100 * time.Microsecond)
+		}
+		elapsed, elapsedCPU := time.Since(start), cpuTime()-startCPU
+		b.StopTimer()
+
+		b.ReportMetric(float64(b.N)/elapsed.Seconds(), "updates/s")
+		b.ReportMetric(100*elapsedCPU.Seconds()/elapsed.Seconds(), "cpu-%")
+	})
+
+	b.Run("idle", func(b *testing.B) {
+		_, cancel := liveBook(b)
+		defer cancel()
+
+		b.ResetTimer()
+		start, startCPU := time.Now(), cpuTime()
+		for i := 0; i < b.N; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		elapsed, elapsedCPU := time.Since(start), cpuTime()-startCPU
+		b.StopTimer()
+
+		b.ReportMetric(100*elapsedCPU.Seconds()/elapsed.Seconds(), "cpu-%")
+	})
+}
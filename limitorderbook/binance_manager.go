@@ -0,0 +1,370 @@
+package limitorderbook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/metrics"
+)
+
+// DefaultCloseTimeout bounds the wait for Binance to confirm the
+// unsubscriptions of Close, well within a shutdown grace period
+const DefaultCloseTimeout = 2 * time.Second
+
+// BinanceL2LimitOrderBookManager owns one BinanceL2LimitOrderBook per symbol,
+// all fed from a single BinanceWebsocket connection, or from an Arbitrator of
+// several. Without a Websocket the manager only maintains the books, e.g. when
+// replaying captures.
+type BinanceL2LimitOrderBookManager struct {
+	Name               string // Returned by Exchange, "binance" unless several markets are served side by side
+	Websocket          binancewebsocket.Feed
+	Market             binancewebsocket.MarketType
+	StreamSuffix       string          // Appended to the lower-cased symbol, e.g. "@depth" or "@depth@100ms"
+	SnapshotFetcher    SnapshotFetcher // Used by every new book when set
+	SnapshotRetryDelay time.Duration   // Used by every new book when set
+	InlineSnapshots    bool            // Used by every new book, see BinanceL2LimitOrderBook.InlineSnapshots
+	CloseTimeout       time.Duration   // Wait for the unsubscriptions of Close, DefaultCloseTimeout if 0
+
+	router      *binancewebsocket.Router
+	books       map[string]*BinanceL2LimitOrderBook
+	cancelFuncs map[string]context.CancelFunc
+	sync.RWMutex
+}
+
+// NewBinanceL2LimitOrderBookManager ...
+func NewBinanceL2LimitOrderBookManager(feed binancewebsocket.Feed) *BinanceL2LimitOrderBookManager {
+	m := &BinanceL2LimitOrderBookManager{
+		Name:         "binance",
+		Websocket:    feed,
+		Market:       binancewebsocket.MarketUSDMFutures,
+		StreamSuffix: "@depth",
+		CloseTimeout: DefaultCloseTimeout,
+		books:        make(map[string]*BinanceL2LimitOrderBook),
+		cancelFuncs:  make(map[string]context.CancelFunc),
+	}
+
+	m.router = binancewebsocket.NewRouter().HandleDepthUpdate(m.handleDepthUpdate)
+	m.router.LiveResponseHandleFunc = m.handleLiveResponse
+	m.router.UnknownEventHandleFunc = m.handleUnknownEvent
+
+	return m
+}
+
+// Subscribe creates a book for every new symbol, starts its update goroutine
+// and subscribes to its depth stream. Symbols that already have a book are
+// ignored. The books are torn down again if Binance rejects the subscription,
+// but kept if it did not answer in time, as the streams are then resubscribed
+// on the next reconnect.
+func (m *BinanceL2LimitOrderBookManager) Subscribe(symbols ...string) error {
+	m.Lock()
+	var streamList []string
+	var newSymbols []string
+	for _, symbol := range symbols {
+		symbol = strings.ToUpper(symbol)
+		if _, ok := m.books[symbol]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		bL2LoB := NewBinanceL2LimitOrderBook(symbol).SetMarket(m.Market)
+		if m.SnapshotFetcher != nil {
+			bL2LoB.SetSnapshotFetcher(m.SnapshotFetcher)
+		} else {
+			bL2LoB.SetSnapshotFetcher(defaultSnapshotFetcher(m.Market))
+		}
+		if m.SnapshotRetryDelay > 0 {
+			bL2LoB.SnapshotRetryDelay = m.SnapshotRetryDelay
+		}
+		bL2LoB.InlineSnapshots = m.InlineSnapshots
+		bL2LoB.UpdateOrderBook(ctx)
+
+		m.books[symbol] = bL2LoB
+		m.cancelFuncs[symbol] = cancel
+		streamList = append(streamList, m.streamName(symbol))
+		newSymbols = append(newSymbols, symbol)
+	}
+	m.Unlock()
+
+	if len(streamList) == 0 || m.Websocket == nil {
+		return nil
+	}
+
+	// Not under the lock: the response may queue behind depth updates, which
+	// need it to reach their books
+	err := m.Websocket.Subscribe(streamList)
+	if err != nil {
+		log.Printf("[MANAGER] Error subscribing to %v: %s\n", streamList, err.Error())
+
+		var liveError *binancewebsocket.LiveError
+		if errors.As(err, &liveError) {
+			m.Lock()
+			books := m.removeBooks(newSymbols)
+			m.Unlock()
+
+			for _, bL2LoB := range books {
+				bL2LoB.Wait()
+				bL2LoB.deleteMetrics()
+			}
+		}
+		return err
+	}
+	log.Printf("[MANAGER] Subscribed to %v\n", streamList)
+
+	return nil
+}
+
+// Unsubscribe unsubscribes from the depth streams of the given symbols and tears
+// down their books once they have applied what was already buffered, deleting
+// their metrics. Unknown symbols are ignored.
+func (m *BinanceL2LimitOrderBookManager) Unsubscribe(symbols ...string) {
+	m.unsubscribe(context.Background(), symbols)
+}
+
+// Close unsubscribes from every stream and tears down every book. It waits no
+// longer than CloseTimeout for Binance to confirm, and not at all while the
+// connection is down, then returns once every update goroutine has exited.
+func (m *BinanceL2LimitOrderBookManager) Close() {
+	timeout := m.CloseTimeout
+	if timeout <= 0 {
+		timeout = DefaultCloseTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	m.unsubscribe(ctx, m.Symbols())
+}
+
+// unsubscribe stops the streams first, then the books, and waits for the books
+// to be torn down. The lock is not held while waiting for Binance to confirm,
+// see Subscribe.
+func (m *BinanceL2LimitOrderBookManager) unsubscribe(ctx context.Context, symbols []string) {
+	var streamList []string
+	var knownSymbols []string
+	m.RLock()
+	for _, symbol := range symbols {
+		symbol = strings.ToUpper(symbol)
+		if _, ok := m.books[symbol]; !ok {
+			continue
+		}
+		streamList = append(streamList, m.streamName(symbol))
+		knownSymbols = append(knownSymbols, symbol)
+	}
+	m.RUnlock()
+
+	if len(streamList) > 0 && m.Websocket != nil {
+		err := m.Websocket.UnsubscribeContext(ctx, streamList)
+		if err != nil {
+			log.Printf("[MANAGER] Error unsubscribing from %v: %s\n", streamList, err.Error())
+		} else {
+			log.Printf("[MANAGER] Unsubscribed from %v\n", streamList)
+		}
+	}
+
+	m.Lock()
+	books := m.removeBooks(knownSymbols)
+	m.Unlock()
+
+	for _, bL2LoB := range books {
+		bL2LoB.Wait()
+		bL2LoB.deleteMetrics()
+	}
+}
+
+// removeBooks cancels the books of the symbols and returns them. Expects the
+// caller to hold the lock.
+func (m *BinanceL2LimitOrderBookManager) removeBooks(symbols []string) []*BinanceL2LimitOrderBook {
+	var books []*BinanceL2LimitOrderBook
+	for _, symbol := range symbols {
+		bL2LoB, ok := m.books[symbol]
+		if !ok {
+			continue
+		}
+
+		m.cancelFuncs[symbol]()
+		delete(m.cancelFuncs, symbol)
+		delete(m.books, symbol)
+		books = append(books, bL2LoB)
+	}
+
+	return books
+}
+
+// HandleMessage is the BinanceWebsocket message handler, for the raw and the
+// combined stream endpoints. It routes depth updates to their books and logs
+// responses to live requests.
+func (m *BinanceL2LimitOrderBookManager) HandleMessage(msg []byte) error {
+	err := m.router.HandleMessage(msg)
+
+	var parseError *binancewebsocket.ParseError
+	if errors.As(err, &parseError) {
+		metrics.MessagesReceived.WithLabelValues(m.Exchange(), metrics.NoStream).Inc()
+		metrics.ParseFailures.WithLabelValues(m.Exchange(), "message").Inc()
+	}
+	return err
+}
+
+// handleDepthUpdate is given an empty stream on the raw stream endpoint
+func (m *BinanceL2LimitOrderBookManager) handleDepthUpdate(stream string, depthUpdate binancewebsocket.DepthUpdate) error {
+	if stream == "" {
+		stream = m.streamName(depthUpdate.Symbol)
+	}
+	metrics.MessagesReceived.WithLabelValues(m.Exchange(), stream).Inc()
+	return m.HandleDepthUpdate(depthUpdate)
+}
+
+func (m *BinanceL2LimitOrderBookManager) handleLiveResponse(liveResponse binancewebsocket.LiveResponse) error {
+	metrics.MessagesReceived.WithLabelValues(m.Exchange(), metrics.NoStream).Inc()
+	if liveResponse.ErrorCode != 0 || liveResponse.ErrorMessage != "" {
+		return fmt.Errorf("live request %d failed: %d %s", liveResponse.ID, liveResponse.ErrorCode, liveResponse.ErrorMessage)
+	}
+	log.Println("Live Response Received", liveResponse.ID, liveResponse.Result)
+
+	return nil
+}
+
+// handleUnknownEvent reports the events of streams the manager did not
+// subscribe to, which the books cannot use
+func (m *BinanceL2LimitOrderBookManager) handleUnknownEvent(eventType, stream string, data []byte) error {
+	if stream == "" {
+		stream = metrics.NoStream
+	}
+	metrics.MessagesReceived.WithLabelValues(m.Exchange(), stream).Inc()
+	metrics.ParseFailures.WithLabelValues(m.Exchange(), "unknown_event").Inc()
+	return fmt.Errorf("unexpected event %q from stream %q: %s", eventType, stream, data)
+}
+
+// HandleDisconnect is the BinanceWebsocket or Arbitrator OnDisconnect hook. The books of
+// the streams are marked unsynced until the streams are back, the others stay live.
+func (m *BinanceL2LimitOrderBookManager) HandleDisconnect(streams []string, err error) {
+	for _, bL2LoB := range m.streamBooks(streams) {
+		bL2LoB.MarkUnsynced()
+	}
+}
+
+// HandleReconnect is the BinanceWebsocket or Arbitrator OnReconnected hook. Events of the
+// streams may have been missed while disconnected, so their books fetch a fresh snapshot.
+func (m *BinanceL2LimitOrderBookManager) HandleReconnect(streams []string) {
+	for _, bL2LoB := range m.streamBooks(streams) {
+		bL2LoB.Resync()
+	}
+}
+
+// streamBooks returns the books fed by the streams
+func (m *BinanceL2LimitOrderBookManager) streamBooks(streams []string) []*BinanceL2LimitOrderBook {
+	wanted := make(map[string]bool, len(streams))
+	for _, stream := range streams {
+		wanted[stream] = true
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	var books []*BinanceL2LimitOrderBook
+	for symbol, bL2LoB := range m.books {
+		if wanted[m.streamName(symbol)] {
+			books = append(books, bL2LoB)
+		}
+	}
+	return books
+}
+
+// HandleDepthUpdate routes a depth update to the book of its symbol
+func (m *BinanceL2LimitOrderBookManager) HandleDepthUpdate(depthUpdate binancewebsocket.DepthUpdate) error {
+	symbol := strings.ToUpper(depthUpdate.Symbol)
+
+	m.RLock()
+	bL2LoB, ok := m.books[symbol]
+	m.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("no order book for symbol %s", depthUpdate.Symbol)
+	}
+
+	// The book may be torn down while we wait on a full buffer
+	select {
+	case bL2LoB.DepthUpdateBufferChannel <- depthUpdate:
+		return nil
+	case <-bL2LoB.Done():
+		return fmt.Errorf("order book for symbol %s was closed", depthUpdate.Symbol)
+	}
+}
+
+// Flush blocks until every book has handled the depth updates routed to it so far
+func (m *BinanceL2LimitOrderBookManager) Flush() {
+	m.RLock()
+	books := make([]*BinanceL2LimitOrderBook, 0, len(m.books))
+	for _, bL2LoB := range m.books {
+		books = append(books, bL2LoB)
+	}
+	m.RUnlock()
+
+	for _, bL2LoB := range books {
+		bL2LoB.Flush()
+	}
+}
+
+// CheckLiveness returns an error if the websocket or the update goroutine of
+// any book has stopped
+func (m *BinanceL2LimitOrderBookManager) CheckLiveness() error {
+	if m.Websocket != nil && !m.Websocket.IsRunning() {
+		return errors.New("the websocket connection is not running")
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	for symbol, bL2LoB := range m.books {
+		if !bL2LoB.IsUpdating() {
+			return fmt.Errorf("the update goroutine for %s is not running", symbol)
+		}
+	}
+	return nil
+}
+
+// Book returns the book for a symbol
+func (m *BinanceL2LimitOrderBookManager) Book(symbol string) (*BinanceL2LimitOrderBook, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	bL2LoB, ok := m.books[strings.ToUpper(symbol)]
+	return bL2LoB, ok
+}
+
+// OrderBook implements OrderBookSource
+func (m *BinanceL2LimitOrderBookManager) OrderBook(symbol string) (OrderBook, bool) {
+	bL2LoB, ok := m.Book(symbol)
+	if !ok {
+		return nil, false
+	}
+	return bL2LoB, true
+}
+
+// Exchange implements OrderBookSource
+func (m *BinanceL2LimitOrderBookManager) Exchange() string {
+	return m.Name
+}
+
+// Symbols returns the sorted list of symbols with a book
+func (m *BinanceL2LimitOrderBookManager) Symbols() []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	symbols := make([]string, 0, len(m.books))
+	for symbol := range m.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	return symbols
+}
+
+func (m *BinanceL2LimitOrderBookManager) streamName(symbol string) string {
+	return strings.ToLower(symbol) + m.StreamSuffix
+}
@@ -0,0 +1,330 @@
+package limitorderbook
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/metrics"
+)
+
+// SyncState is where a BinanceL2LimitOrderBook is in Binance's
+// "how to manage a local order book correctly" procedure
+type SyncState int32
+
+const (
+	// SyncStateUnsynced the update goroutine has not been started, or the stream dropped
+	SyncStateUnsynced SyncState = iota
+	// SyncStateBuffering waiting for the first depth update before fetching a snapshot
+	SyncStateBuffering
+	// SyncStateSnapshotting a snapshot fetch is in flight, depth updates are buffered
+	SyncStateSnapshotting
+	// SyncStateReplaying the snapshot is applied, waiting for the first event that straddles it
+	SyncStateReplaying
+	// SyncStateLive every event is applied as it arrives
+	SyncStateLive
+)
+
+const (
+	// maxBufferedDepthUpdates bounds the buffer while a snapshot is in flight.
+	// The oldest events are dropped beyond it, which at worst costs a refetch.
+	maxBufferedDepthUpdates = 10000
+	// DefaultSnapshotRetryDelay is the wait before refetching a snapshot that failed
+	DefaultSnapshotRetryDelay = 1 * time.Second
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SyncStateUnsynced:
+		return "unsynced"
+	case SyncStateBuffering:
+		return "buffering"
+	case SyncStateSnapshotting:
+		return "snapshotting"
+	case SyncStateReplaying:
+		return "replaying"
+	case SyncStateLive:
+		return "live"
+	}
+	return "unknown"
+}
+
+// MarshalText lets the state be used in JSON as its name
+func (s SyncState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// SyncState returns the current state of the book. Safe to call from any goroutine.
+func (bL2LoB *BinanceL2LimitOrderBook) SyncState() SyncState {
+	return SyncState(atomic.LoadInt32(&bL2LoB.syncState))
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) setSyncState(state SyncState) {
+	previous := SyncState(atomic.SwapInt32(&bL2LoB.syncState, int32(state)))
+	if previous != state {
+		log.Printf("[ORDERBOOK][%s] %s -> %s\n", bL2LoB.Symbol, previous, state)
+	}
+}
+
+// snapshotResult carries the outcome of a snapshot fetch back to the update
+// goroutine, stamped with the sync generation it was fetched for
+type snapshotResult struct {
+	depthSnapshot *DepthSnapshot
+	err           error
+	generation    int64
+}
+
+// handleDepthUpdate is only called from the update goroutine
+func (bL2LoB *BinanceL2LimitOrderBook) handleDepthUpdate(depthUpdate binancewebsocket.DepthUpdate, doneChannel <-chan struct{}) {
+	switch bL2LoB.SyncState() {
+	case SyncStateUnsynced, SyncStateBuffering:
+		// Fetch the snapshot only once the stream is buffering, so the snapshot
+		// is guaranteed to be newer than the first buffered event
+		bL2LoB.bufferDepthUpdate(depthUpdate)
+		bL2LoB.setSyncState(SyncStateSnapshotting)
+		bL2LoB.fetchSnapshot(0, doneChannel)
+
+	case SyncStateSnapshotting:
+		bL2LoB.bufferDepthUpdate(depthUpdate)
+
+	case SyncStateReplaying, SyncStateLive:
+		if !bL2LoB.applyDepthUpdate(depthUpdate) {
+			bL2LoB.resync(depthUpdate, doneChannel)
+		}
+	}
+}
+
+// handleDepthUpdates handles a batch of depth updates in order. While the book
+// is live, the whole batch is applied under a single lock acquisition. Only
+// called from the update goroutine.
+func (bL2LoB *BinanceL2LimitOrderBook) handleDepthUpdates(depthUpdates []binancewebsocket.DepthUpdate, doneChannel <-chan struct{}) {
+	for len(depthUpdates) > 0 {
+		if bL2LoB.SyncState() != SyncStateLive {
+			bL2LoB.handleDepthUpdate(depthUpdates[0], doneChannel)
+			depthUpdates = depthUpdates[1:]
+			continue
+		}
+
+		handled := bL2LoB.applyLiveDepthUpdates(depthUpdates)
+		depthUpdates = depthUpdates[handled:]
+		if len(depthUpdates) > 0 {
+			bL2LoB.resync(depthUpdates[0], doneChannel)
+			depthUpdates = depthUpdates[1:]
+		}
+	}
+}
+
+// handleSnapshot is only called from the update goroutine
+func (bL2LoB *BinanceL2LimitOrderBook) handleSnapshot(result snapshotResult, doneChannel <-chan struct{}) {
+	if bL2LoB.SyncState() != SyncStateSnapshotting {
+		return
+	}
+	if result.generation != bL2LoB.syncGeneration {
+		// Fetched before the procedure started over, its fetch is still in flight
+		log.Printf("[ORDERBOOK][%s] Ignoring a depth snapshot from a previous sync\n", bL2LoB.Symbol)
+		return
+	}
+
+	if result.err != nil {
+		log.Printf("[ORDERBOOK][%s] Error fetching the depth snapshot: %s\n", bL2LoB.Symbol, result.err.Error())
+		bL2LoB.fetchSnapshot(bL2LoB.SnapshotRetryDelay, doneChannel)
+		return
+	}
+
+	bL2LoB.resetFromSnapshot(result.depthSnapshot)
+	log.Printf("[ORDERBOOK][%s] Initialised from snapshot %d\n", bL2LoB.Symbol, result.depthSnapshot.LastUpdateID)
+	bL2LoB.setSyncState(SyncStateReplaying)
+
+	pendingDepthUpdates := bL2LoB.pendingDepthUpdates
+	bL2LoB.pendingDepthUpdates = nil
+
+	for i, depthUpdate := range pendingDepthUpdates {
+		if !bL2LoB.applyDepthUpdate(depthUpdate) {
+			// Either the snapshot is older than the buffered events or the
+			// buffer itself has a gap. Keep whatever is left and start over.
+			bL2LoB.setSyncState(SyncStateBuffering)
+			for _, remaining := range pendingDepthUpdates[i:] {
+				bL2LoB.handleDepthUpdate(remaining, doneChannel)
+			}
+			return
+		}
+	}
+}
+
+// applyDepthUpdate applies an event against the local LastUpdateID. Stale events
+// are skipped. It returns false if the event does not continue the local book.
+func (bL2LoB *BinanceL2LimitOrderBook) applyDepthUpdate(depthUpdate binancewebsocket.DepthUpdate) bool {
+	depthUpdate.Market = bL2LoB.Market
+
+	// Drop any event already contained in the snapshot
+	if depthUpdate.IsStale(bL2LoB.LastUpdateID) {
+		log.Printf("[ORDERBOOK][%s] Skipping stale Depth Update ID. Received %d | local %d\n", bL2LoB.Symbol, depthUpdate.LastUpdateID, bL2LoB.LastUpdateID)
+		bL2LoB.bookMetrics().staleUpdatesSkipped.Inc()
+		return true
+	}
+
+	switch bL2LoB.SyncState() {
+	case SyncStateReplaying:
+		if !depthUpdate.Straddles(bL2LoB.LastUpdateID) {
+			return false
+		}
+		bL2LoB.applyDepth(depthUpdate.BidDepthDelta, depthUpdate.AskDepthDelta, depthUpdate.LastUpdateID, depthUpdate.EventTime)
+		bL2LoB.setSyncState(SyncStateLive)
+
+	case SyncStateLive:
+		return bL2LoB.applyLiveDepthUpdates([]binancewebsocket.DepthUpdate{depthUpdate}) == 1
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// applyLiveDepthUpdates applies the events in order under a single lock
+// acquisition, skipping stale and already applied ones. It stops at the first
+// event that does not continue the local book and returns how many it handled.
+func (bL2LoB *BinanceL2LimitOrderBook) applyLiveDepthUpdates(depthUpdates []binancewebsocket.DepthUpdate) int {
+	handled, observation := bL2LoB.applyLiveDepthUpdatesLocked(depthUpdates)
+	bL2LoB.record(observation)
+	return handled
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) applyLiveDepthUpdatesLocked(depthUpdates []binancewebsocket.DepthUpdate) (handled int, observation *bookObservation) {
+	bL2LoB.Lock()
+	defer bL2LoB.Unlock()
+
+	start := time.Now()
+	applied := 0
+	staleUpdatesSkipped := 0
+	defer func() {
+		if applied > 0 {
+			atomic.StoreInt64(&bL2LoB.lastAppliedAt, time.Now().UnixNano())
+			bL2LoB.notifyChanged()
+			observation = bL2LoB.observeApply(start)
+		} else if staleUpdatesSkipped > 0 {
+			observation = bL2LoB.observeLevels()
+		}
+		if observation != nil {
+			observation.staleUpdatesSkipped = staleUpdatesSkipped
+		}
+	}()
+
+	for i, depthUpdate := range depthUpdates {
+		depthUpdate.Market = bL2LoB.Market
+
+		switch {
+		case depthUpdate.IsStale(bL2LoB.LastUpdateID):
+			log.Printf("[ORDERBOOK][%s] Skipping stale Depth Update ID. Received %d | local %d\n", bL2LoB.Symbol, depthUpdate.LastUpdateID, bL2LoB.LastUpdateID)
+			staleUpdatesSkipped++
+
+		case depthUpdate.LastUpdateID <= bL2LoB.LastUpdateID:
+			// Already applied, e.g. delivered twice
+
+		case !depthUpdate.Continues(bL2LoB.LastUpdateID):
+			// Re-initialize the process if the event does not follow the previous one
+			return i, nil
+
+		default:
+			bL2LoB.processBidsAndAsks(depthUpdate.BidDepthDelta, "b") // b => bids
+			bL2LoB.processBidsAndAsks(depthUpdate.AskDepthDelta, "a") // a => asks
+			bL2LoB.LastUpdateID = depthUpdate.LastUpdateID
+			bL2LoB.LastEventTime = depthUpdate.EventTime
+			applied++
+		}
+	}
+
+	return len(depthUpdates), nil
+}
+
+// resync starts the procedure over, with the event that broke the sequence as
+// the first buffered event
+func (bL2LoB *BinanceL2LimitOrderBook) resync(depthUpdate binancewebsocket.DepthUpdate, doneChannel <-chan struct{}) {
+	log.Printf("[ORDERBOOK][%s] Updates/local copy not in-sync. Re-initialising. U: %d | u: %d | pu: %d | local: %d\n", bL2LoB.Symbol, depthUpdate.FirstUpdateID, depthUpdate.LastUpdateID, depthUpdate.PreviousLastUpdateID, bL2LoB.LastUpdateID)
+
+	metrics.Resyncs.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol).Inc()
+
+	bL2LoB.syncGeneration++
+	bL2LoB.pendingDepthUpdates = nil
+	bL2LoB.setSyncState(SyncStateBuffering)
+	bL2LoB.handleDepthUpdate(depthUpdate, doneChannel)
+}
+
+// restart starts the procedure over from the next depth update, in state
+// SyncStateBuffering or SyncStateUnsynced, see Resync and MarkUnsynced
+func (bL2LoB *BinanceL2LimitOrderBook) restart(state SyncState) {
+	if bL2LoB.SyncState() == SyncStateUnsynced && state == SyncStateBuffering {
+		// Already restarted when the stream dropped
+		bL2LoB.setSyncState(state)
+		return
+	}
+
+	log.Printf("[ORDERBOOK][%s] Resync requested. Re-initialising. local: %d\n", bL2LoB.Symbol, bL2LoB.LastUpdateID)
+
+	metrics.Resyncs.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol).Inc()
+
+	bL2LoB.syncGeneration++
+	bL2LoB.pendingDepthUpdates = nil
+	bL2LoB.setSyncState(state)
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) bufferDepthUpdate(depthUpdate binancewebsocket.DepthUpdate) {
+	if len(bL2LoB.pendingDepthUpdates) >= maxBufferedDepthUpdates {
+		bL2LoB.pendingDepthUpdates = bL2LoB.pendingDepthUpdates[1:]
+	}
+	bL2LoB.pendingDepthUpdates = append(bL2LoB.pendingDepthUpdates, depthUpdate)
+}
+
+// fetchSnapshot fetches a depth snapshot in the background, after delay, and
+// hands it to the update goroutine over snapshotChannel.
+//
+// With InlineSnapshots the snapshot is fetched and applied right away, on the
+// update goroutine, and a failed fetch is retried with the next depth update
+// rather than after delay. Replays use it so the snapshot lands at the same
+// point of the stream on every run.
+//
+// The result is stamped with the current sync generation, so that a snapshot
+// still in flight when the procedure starts over is ignored once it lands.
+func (bL2LoB *BinanceL2LimitOrderBook) fetchSnapshot(delay time.Duration, doneChannel <-chan struct{}) {
+	generation := bL2LoB.syncGeneration
+	if bL2LoB.InlineSnapshots {
+		result := bL2LoB.timedFetchDepthSnapshot(generation)
+		if result.err != nil {
+			log.Printf("[ORDERBOOK][%s] Error fetching the depth snapshot: %s\n", bL2LoB.Symbol, result.err.Error())
+			bL2LoB.setSyncState(SyncStateBuffering)
+			return
+		}
+		bL2LoB.handleSnapshot(result, doneChannel)
+		return
+	}
+
+	go func() {
+		if delay > 0 {
+			select {
+			case <-doneChannel:
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		result := bL2LoB.timedFetchDepthSnapshot(generation)
+
+		select {
+		case <-doneChannel:
+		case bL2LoB.snapshotChannel <- result:
+		}
+	}()
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) timedFetchDepthSnapshot(generation int64) snapshotResult {
+	start := time.Now()
+	depthSnapshot, err := bL2LoB.FetchDepthSnapshot()
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.SnapshotFetchDuration.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol, result).Observe(time.Since(start).Seconds())
+
+	return snapshotResult{depthSnapshot: depthSnapshot, err: err, generation: generation}
+}
@@ -0,0 +1,326 @@
+package limitorderbook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/robaho/fixed"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustFixed(s string) fixed.Fixed {
+	return fixed.MustParse(s)
+}
+
+func depthUpdate(firstUpdateID, lastUpdateID, previousLastUpdateID int64, bids, asks [][2]string) binancewebsocket.DepthUpdate {
+	return binancewebsocket.DepthUpdate{
+		EventType:            "depthUpdate",
+		EventTime:            lastUpdateID * 10,
+		Symbol:               "BTCUSDT",
+		FirstUpdateID:        firstUpdateID,
+		LastUpdateID:         lastUpdateID,
+		PreviousLastUpdateID: previousLastUpdateID,
+		BidDepthDelta:        bids,
+		AskDepthDelta:        asks,
+	}
+}
+
+// deliverSnapshot hands the result of the in-flight fetch to the book, like the update goroutine would
+func deliverSnapshot(bL2LoB *BinanceL2LimitOrderBook, doneChannel <-chan struct{}) {
+	bL2LoB.handleSnapshot(<-bL2LoB.snapshotChannel, doneChannel)
+}
+
+func TestBinanceLoB_SyncReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	doneChannel := make(chan struct{})
+	defer close(doneChannel)
+
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("BTCUSDT", &DepthSnapshot{
+			LastUpdateID: 100,
+			Bids:         [][2]string{{"10.0", "1"}, {"9.5", "2"}},
+			Asks:         [][2]string{{"10.5", "1"}},
+		})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT").SetSnapshotFetcher(snapshotFetcher)
+	bL2LoB.setSyncState(SyncStateBuffering)
+
+	staleUpdatesSkipped := metrics.StaleUpdatesSkipped.WithLabelValues("binance", "BTCUSDT")
+	resyncs := metrics.Resyncs.WithLabelValues("binance", "BTCUSDT")
+	staleUpdatesSkippedBefore, resyncsBefore := testutil.ToFloat64(staleUpdatesSkipped), testutil.ToFloat64(resyncs)
+
+	// Buffered while the snapshot is in flight
+	bL2LoB.handleDepthUpdate(depthUpdate(90, 95, 89, [][2]string{{"9.0", "7"}}, nil), doneChannel)
+	assert.Equal(SyncStateSnapshotting, bL2LoB.SyncState())
+	bL2LoB.handleDepthUpdate(depthUpdate(96, 105, 95, [][2]string{{"10.0", "3"}}, nil), doneChannel)
+	bL2LoB.handleDepthUpdate(depthUpdate(106, 110, 105, nil, [][2]string{{"10.5", "0"}, {"11.0", "4"}}), doneChannel)
+	assert.Len(bL2LoB.pendingDepthUpdates, 3)
+
+	deliverSnapshot(bL2LoB, doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(int64(110), bL2LoB.LastUpdateID)
+	assert.Empty(bL2LoB.pendingDepthUpdates)
+	assert.Equal(1, snapshotFetcher.Calls("BTCUSDT"))
+	assert.Equal(staleUpdatesSkippedBefore+1, testutil.ToFloat64(staleUpdatesSkipped))
+	assert.Equal(2.0, testutil.ToFloat64(metrics.BookDepth.WithLabelValues("binance", "BTCUSDT", "bids")))
+	assert.Equal(1.0, testutil.ToFloat64(metrics.BookDepth.WithLabelValues("binance", "BTCUSDT", "asks")))
+	assert.Equal(1.0, testutil.ToFloat64(metrics.Spread.WithLabelValues("binance", "BTCUSDT")))
+
+	assert.Equal([]PriceLevel{{mustFixed("10.0"), 3}, {mustFixed("9.5"), 2}}, bL2LoB.TopN("b", 0), "The stale update must not be applied")
+	assert.Equal([]PriceLevel{{mustFixed("11.0"), 4}}, bL2LoB.TopN("a", 0))
+
+	// Live updates continue the sequence
+	bL2LoB.handleDepthUpdate(depthUpdate(111, 115, 110, [][2]string{{"9.5", "0"}}, nil), doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(int64(115), bL2LoB.LastUpdateID)
+
+	// A gap starts the procedure over with the offending event buffered
+	bL2LoB.handleDepthUpdate(depthUpdate(130, 135, 129, nil, nil), doneChannel)
+	assert.Equal(SyncStateSnapshotting, bL2LoB.SyncState())
+	assert.Len(bL2LoB.pendingDepthUpdates, 1)
+	assert.Equal(resyncsBefore+1, testutil.ToFloat64(resyncs))
+}
+
+func TestBinanceLoB_SyncStaleSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	doneChannel := make(chan struct{})
+	defer close(doneChannel)
+
+	// The first snapshot is older than the first buffered event
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 50, Bids: [][2]string{{"1.0", "1"}}}).
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 100, Bids: [][2]string{{"2.0", "1"}}})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT").SetSnapshotFetcher(snapshotFetcher)
+	bL2LoB.setSyncState(SyncStateBuffering)
+
+	bL2LoB.handleDepthUpdate(depthUpdate(96, 105, 95, nil, nil), doneChannel)
+	deliverSnapshot(bL2LoB, doneChannel)
+	assert.Equal(SyncStateSnapshotting, bL2LoB.SyncState(), "A stale snapshot must be refetched")
+	assert.Len(bL2LoB.pendingDepthUpdates, 1, "Buffered events must be kept for the next snapshot")
+
+	deliverSnapshot(bL2LoB, doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(int64(105), bL2LoB.LastUpdateID)
+	assert.Equal(2, snapshotFetcher.Calls("BTCUSDT"))
+
+	bestBid, _ := bL2LoB.BestBid()
+	assert.Equal("2", bestBid.Price.String(), "The stale snapshot's levels must be discarded")
+}
+
+func TestBinanceLoB_SyncPreviousGenerationSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	doneChannel := make(chan struct{})
+	defer close(doneChannel)
+
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 198, Bids: [][2]string{{"1.0", "1"}}}).
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 200, Bids: [][2]string{{"2.0", "1"}}})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT").SetSnapshotFetcher(snapshotFetcher)
+	bL2LoB.setSyncState(SyncStateBuffering)
+
+	bL2LoB.handleDepthUpdate(depthUpdate(96, 105, 95, nil, nil), doneChannel)
+	previous := <-bL2LoB.snapshotChannel
+
+	// The stream reconnected while the first snapshot was in flight. It would
+	// still straddle the next buffered event, but its levels are from before.
+	bL2LoB.restart(SyncStateBuffering)
+	bL2LoB.handleDepthUpdate(depthUpdate(196, 205, 195, nil, nil), doneChannel)
+
+	bL2LoB.handleSnapshot(previous, doneChannel)
+	assert.Equal(SyncStateSnapshotting, bL2LoB.SyncState(), "A snapshot from a previous sync must be ignored")
+	assert.Len(bL2LoB.pendingDepthUpdates, 1)
+
+	deliverSnapshot(bL2LoB, doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(int64(205), bL2LoB.LastUpdateID)
+	assert.Equal(2, snapshotFetcher.Calls("BTCUSDT"))
+
+	bestBid, _ := bL2LoB.BestBid()
+	assert.Equal("2", bestBid.Price.String())
+}
+
+func TestBinanceLoB_SyncSpot(t *testing.T) {
+	assert := assert.New(t)
+
+	doneChannel := make(chan struct{})
+	defer close(doneChannel)
+
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 100, Bids: [][2]string{{"10.0", "1"}}})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT").
+		SetSnapshotFetcher(snapshotFetcher).
+		SetMarket(binancewebsocket.MarketSpot)
+	assert.Equal(snapshotFetcher, bL2LoB.SnapshotFetcher, "SetMarket must keep the fetcher")
+	bL2LoB.setSyncState(SyncStateBuffering)
+
+	// Spot events carry no pu. u == lastUpdateId is already in the snapshot.
+	bL2LoB.handleDepthUpdate(depthUpdate(95, 100, 0, [][2]string{{"10.0", "9"}}, nil), doneChannel)
+	bL2LoB.handleDepthUpdate(depthUpdate(101, 104, 0, [][2]string{{"10.0", "2"}}, nil), doneChannel)
+	deliverSnapshot(bL2LoB, doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(int64(104), bL2LoB.LastUpdateID)
+
+	bestBid, _ := bL2LoB.BestBid()
+	assert.Equal(2.0, bestBid.Quantity)
+
+	// U == previous u + 1
+	bL2LoB.handleDepthUpdate(depthUpdate(105, 110, 0, nil, nil), doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(int64(110), bL2LoB.LastUpdateID)
+
+	bL2LoB.handleDepthUpdate(depthUpdate(112, 115, 0, nil, nil), doneChannel)
+	assert.Equal(SyncStateSnapshotting, bL2LoB.SyncState(), "A skipped update ID must trigger a resync")
+}
+
+func TestBinanceLoB_SyncBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	doneChannel := make(chan struct{})
+	defer close(doneChannel)
+
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 100, Bids: [][2]string{{"10.0", "1"}}})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT").SetSnapshotFetcher(snapshotFetcher)
+	bL2LoB.setSyncState(SyncStateBuffering)
+
+	bL2LoB.handleDepthUpdate(depthUpdate(96, 105, 95, nil, nil), doneChannel)
+	deliverSnapshot(bL2LoB, doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+
+	changed := bL2LoB.Changed()
+	bL2LoB.handleDepthUpdates([]binancewebsocket.DepthUpdate{
+		depthUpdate(106, 110, 105, [][2]string{{"10.0", "2"}}, nil),
+		depthUpdate(106, 110, 105, [][2]string{{"10.0", "9"}}, nil), // Delivered twice
+		depthUpdate(111, 115, 110, [][2]string{{"10.0", "3"}}, nil),
+	}, doneChannel)
+	assert.Equal(int64(115), bL2LoB.LastUpdateID)
+	assert.Equal([]PriceLevel{{mustFixed("10.0"), 3}}, bL2LoB.TopN("b", 0))
+	<-changed
+
+	// The events before a gap are applied, the gap starts the procedure over
+	bL2LoB.handleDepthUpdates([]binancewebsocket.DepthUpdate{
+		depthUpdate(116, 120, 115, [][2]string{{"10.0", "4"}}, nil),
+		depthUpdate(130, 135, 129, nil, nil),
+		depthUpdate(136, 140, 135, nil, nil),
+	}, doneChannel)
+	assert.Equal(int64(120), bL2LoB.LastUpdateID)
+	assert.Equal(SyncStateSnapshotting, bL2LoB.SyncState())
+	assert.Len(bL2LoB.pendingDepthUpdates, 2)
+}
+
+func TestBinanceLoB_UpdateOrderBookDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("BTCUSDT", &DepthSnapshot{LastUpdateID: 100, Bids: [][2]string{{"10.0", "1"}}})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT").SetSnapshotFetcher(snapshotFetcher)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bL2LoB.UpdateOrderBook(ctx)
+
+	bL2LoB.DepthUpdateBufferChannel <- depthUpdate(96, 105, 95, nil, nil)
+	assert.Eventually(func() bool { return bL2LoB.SyncState() == SyncStateLive }, time.Second, time.Millisecond)
+
+	// Whatever is buffered when the context is cancelled is still applied
+	for u := int64(106); u <= 110; u++ {
+		bL2LoB.DepthUpdateBufferChannel <- depthUpdate(u, u, u-1, [][2]string{{"10.0", "2"}}, nil)
+	}
+	cancel()
+	bL2LoB.Wait()
+
+	assert.False(bL2LoB.IsUpdating())
+	assert.Equal(int64(110), bL2LoB.LastUpdateID)
+	assert.Empty(bL2LoB.DepthUpdateBufferChannel)
+}
+
+func TestBinanceLoB_SyncDuplicate(t *testing.T) {
+	assert := assert.New(t)
+
+	bL2LoB := NewBinanceL2LimitOrderBook("BTCUSDT")
+	bL2LoB.resetFromSnapshot(&DepthSnapshot{LastUpdateID: 100, Bids: [][2]string{{"10.0", "1"}}})
+	bL2LoB.setSyncState(SyncStateLive)
+
+	assert.True(bL2LoB.applyDepthUpdate(depthUpdate(101, 105, 100, [][2]string{{"10.0", "2"}}, nil)))
+	// Delivered twice, e.g. by the exchange or across a reconnect
+	assert.True(bL2LoB.applyDepthUpdate(depthUpdate(101, 105, 100, [][2]string{{"10.0", "5"}}, nil)), "A duplicate must not break the sequence")
+	assert.Equal(int64(105), bL2LoB.LastUpdateID)
+	assert.Equal([]PriceLevel{{mustFixed("10.0"), 2}}, bL2LoB.TopN("b", 0))
+}
+
+func TestBinanceLoBManager_MessagesReceived(t *testing.T) {
+	assert := assert.New(t)
+
+	bookManager := NewBinanceL2LimitOrderBookManager(nil)
+	noStream := metrics.MessagesReceived.WithLabelValues("binance", metrics.NoStream)
+	noStreamBefore := testutil.ToFloat64(noStream)
+
+	assert.NoError(bookManager.HandleMessage([]byte(`{"result":null,"id":1}`)))
+	assert.Error(bookManager.HandleMessage([]byte(`{"e":`)))
+	assert.Equal(noStreamBefore+2, testutil.ToFloat64(noStream), "Every message is counted, not only depth updates")
+}
+
+func TestBinanceLoB_SpreadOneSided(t *testing.T) {
+	assert := assert.New(t)
+
+	doneChannel := make(chan struct{})
+	defer close(doneChannel)
+
+	snapshotFetcher := NewMemorySnapshotFetcher().
+		AddSnapshot("ETHUSDT", &DepthSnapshot{
+			LastUpdateID: 100,
+			Bids:         [][2]string{{"10.0", "1"}},
+			Asks:         [][2]string{{"10.5", "1"}},
+		})
+
+	bL2LoB := NewBinanceL2LimitOrderBook("ETHUSDT").SetSnapshotFetcher(snapshotFetcher)
+	bL2LoB.InlineSnapshots = true
+	bL2LoB.setSyncState(SyncStateBuffering)
+	spread := metrics.Spread.WithLabelValues("binance", "ETHUSDT")
+
+	bL2LoB.handleDepthUpdate(depthUpdate(100, 101, 99, [][2]string{{"10.0", "2"}}, nil), doneChannel)
+	assert.Equal(SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(0.5, testutil.ToFloat64(spread))
+
+	bL2LoB.handleDepthUpdate(depthUpdate(102, 102, 101, nil, [][2]string{{"10.5", "0"}}), doneChannel)
+	assert.Equal(0.0, testutil.ToFloat64(spread), "The spread must not outlive the ask side")
+	assert.Equal(0.0, testutil.ToFloat64(metrics.BookDepth.WithLabelValues("binance", "ETHUSDT", "asks")))
+}
+
+func TestBinanceLoBManager_UnsubscribeDeletesMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	bookManager := NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.SnapshotFetcher = NewMemorySnapshotFetcher().
+		AddSnapshot("XRPUSDT", &DepthSnapshot{
+			LastUpdateID: 100,
+			Bids:         [][2]string{{"0.5", "1"}},
+			Asks:         [][2]string{{"0.6", "1"}},
+		})
+	bookManager.InlineSnapshots = true
+	assert.NoError(bookManager.Subscribe("XRPUSDT"))
+
+	liveUpdate := depthUpdate(100, 101, 99, [][2]string{{"0.5", "2"}}, nil)
+	liveUpdate.Symbol = "XRPUSDT"
+	assert.NoError(bookManager.HandleDepthUpdate(liveUpdate))
+	bookBefore, _ := bookManager.OrderBook("XRPUSDT")
+	bookBefore.(*BinanceL2LimitOrderBook).Flush()
+
+	spreads, depths := testutil.CollectAndCount(metrics.Spread), testutil.CollectAndCount(metrics.BookDepth)
+	bookManager.Unsubscribe("XRPUSDT")
+	assert.Equal(spreads-1, testutil.CollectAndCount(metrics.Spread))
+	assert.Equal(depths-2, testutil.CollectAndCount(metrics.BookDepth))
+	assert.False(metrics.ApplyDuration.DeleteLabelValues("binance", "XRPUSDT"), "A torn down book must not be exported")
+	assert.False(metrics.SnapshotFetchDuration.DeleteLabelValues("binance", "XRPUSDT", "success"))
+}
@@ -0,0 +1,117 @@
+package limitorderbook
+
+import (
+	"sort"
+	"time"
+
+	"github.com/robaho/fixed"
+)
+
+// Follow calls fn with a fresh snapshot whenever the book may have changed while
+// it is live, until doneChannel is closed or fn returns false. Books that are not
+// a ChangeNotifier are polled every pollInterval.
+func Follow(orderBook OrderBook, pollInterval time.Duration, doneChannel <-chan struct{}, fn func(snapshot *BookSnapshot) bool) {
+	notifier, isNotifier := orderBook.(ChangeNotifier)
+
+	var ticker *time.Ticker
+	if !isNotifier {
+		ticker = time.NewTicker(pollInterval)
+		defer ticker.Stop()
+	}
+
+	for {
+		var changed <-chan struct{}
+		var tick <-chan time.Time
+		if isNotifier {
+			// Ask before reading the book, so no change can slip in between
+			changed = notifier.Changed()
+		} else {
+			tick = ticker.C
+		}
+
+		if orderBook.SyncState() == SyncStateLive {
+			if !fn(orderBook.Snapshot()) {
+				return
+			}
+		}
+
+		select {
+		case <-doneChannel:
+			return
+		case <-changed:
+		case <-tick:
+		}
+	}
+}
+
+// DepthTracker remembers the top depth levels last handed out for a book, so
+// only the levels that changed since need to be sent on
+type DepthTracker struct {
+	Depth int // 0 for all levels
+
+	bids map[string]string // price -> quantity
+	asks map[string]string
+}
+
+// NewDepthTracker ...
+func NewDepthTracker(depth int) *DepthTracker {
+	return &DepthTracker{Depth: depth}
+}
+
+// Levels returns the top levels of the snapshot and remembers them
+func (t *DepthTracker) Levels(snapshot *BookSnapshot) (bids, asks []PriceLevel) {
+	bids = snapshot.TopN("b", t.Depth)
+	asks = snapshot.TopN("a", t.Depth)
+
+	t.bids = toQuantities(bids)
+	t.asks = toQuantities(asks)
+	return bids, asks
+}
+
+// Changes returns the levels that changed since the last call, best price first,
+// followed by the levels that dropped out at quantity 0. Both are empty if
+// nothing changed within Depth.
+func (t *DepthTracker) Changes(snapshot *BookSnapshot) (bids, asks []PriceLevel) {
+	bids, t.bids = changedLevels(t.bids, snapshot.TopN("b", t.Depth), false)
+	asks, t.asks = changedLevels(t.asks, snapshot.TopN("a", t.Depth), true)
+	return bids, asks
+}
+
+func changedLevels(previous map[string]string, priceLevels []PriceLevel, ascending bool) ([]PriceLevel, map[string]string) {
+	current := toQuantities(priceLevels)
+
+	var removed []fixed.Fixed
+	for price := range previous {
+		if _, ok := current[price]; !ok {
+			removed = append(removed, fixed.NewS(price))
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		if ascending {
+			return removed[i].LessThan(removed[j])
+		}
+		return removed[i].GreaterThan(removed[j])
+	})
+
+	changes := []PriceLevel{}
+	for _, priceLevel := range priceLevels {
+		pair := priceLevel.Strings()
+		if previous[pair[0]] != pair[1] {
+			changes = append(changes, priceLevel)
+		}
+	}
+	for _, price := range removed {
+		changes = append(changes, PriceLevel{Price: price})
+	}
+
+	return changes, current
+}
+
+func toQuantities(priceLevels []PriceLevel) map[string]string {
+	quantities := make(map[string]string, len(priceLevels))
+	for _, priceLevel := range priceLevels {
+		pair := priceLevel.Strings()
+		quantities[pair[0]] = pair[1]
+	}
+	return quantities
+}
@@ -1,6 +1,7 @@
 package limitorderbook
 
 import (
+	"strconv"
 	"sync"
 
 	"github.com/google/btree"
@@ -9,13 +10,12 @@ import (
 
 // L2LimitOrderBook
 type L2LimitOrderBook struct {
-	Exchange               string
-	Symbol                 string
-	Bids                   *btree.BTree
-	Asks                   *btree.BTree
-	PriceScale             float64
-	CumulativeBidLimitsMap map[LoBFixed]float64
-	CumulativeAskLimitsMap map[LoBFixed]float64
+	Exchange   string
+	Symbol     string
+	Bids       *btree.BTree // Of LoBLevel
+	Asks       *btree.BTree // Of LoBLevel
+	PriceScale float64
+	changed    chan struct{}
 	sync.Mutex
 }
 
@@ -44,13 +44,24 @@ func (a LoBFixed) Less(b btree.Item) bool {
 	return fixed.Fixed(a).LessThan(fixed.Fixed(b.(LoBFixed)))
 }
 
+// LoBLevel is the item of the price trees: a price and the quantity resting at
+// it, ordered by price. With the quantity in the item, a Clone of the tree is
+// a full copy of its side.
+type LoBLevel struct {
+	Price    LoBFixed
+	Quantity float64
+}
+
+// Less returns true if a is priced lower than b
+func (a LoBLevel) Less(b btree.Item) bool {
+	return a.Price.Less(b.(LoBLevel).Price)
+}
+
 func NewL2LimitOrderBook(pricePrecision float64) *L2LimitOrderBook {
 	return &L2LimitOrderBook{
-		Bids:                   btree.New(2),
-		Asks:                   btree.New(2),
-		PriceScale:             pricePrecision,
-		CumulativeBidLimitsMap: make(map[LoBFixed]float64),
-		CumulativeAskLimitsMap: make(map[LoBFixed]float64),
+		Bids:       btree.New(2),
+		Asks:       btree.New(2),
+		PriceScale: pricePrecision,
 	}
 }
 
@@ -70,38 +81,161 @@ func (l2lob *L2LimitOrderBook) UpdateOrAdd(price LoBFixed, quantity float64, sid
 	// adjustedPrice := LoBInt64(price * math.Pow(10, l2lob.PriceScale))
 
 	if side == "a" {
+		l2lob.Asks.ReplaceOrInsert(LoBLevel{Price: price, Quantity: quantity})
+	} else if side == "b" {
+		l2lob.Bids.ReplaceOrInsert(LoBLevel{Price: price, Quantity: quantity})
+	}
+}
 
-		if _, ok := l2lob.CumulativeAskLimitsMap[price]; !ok {
-			l2lob.Asks.ReplaceOrInsert(price)
-		}
-		l2lob.CumulativeAskLimitsMap[price] = quantity
+func (l2lob *L2LimitOrderBook) Remove(price LoBFixed, side string) {
+	// adjustedPrice := LoBInt64(price * math.Pow(10, l2lob.PriceScale))
 
+	if side == "a" {
+		l2lob.Asks.Delete(LoBLevel{Price: price})
 	} else if side == "b" {
+		l2lob.Bids.Delete(LoBLevel{Price: price})
+	}
+}
+
+// reset empties both sides. It expects the caller to hold the lock. Fresh trees
+// are allocated rather than cleared, as snapshots may still share their nodes.
+func (l2lob *L2LimitOrderBook) reset() {
+	l2lob.Bids = btree.New(2)
+	l2lob.Asks = btree.New(2)
+}
 
-		if _, ok := l2lob.CumulativeBidLimitsMap[price]; !ok {
-			l2lob.Bids.ReplaceOrInsert(price)
-		}
-		l2lob.CumulativeBidLimitsMap[price] = quantity
+// Changed returns a channel that is closed the next time the book changes.
+// Any number of goroutines can wait on it.
+func (l2lob *L2LimitOrderBook) Changed() <-chan struct{} {
+	l2lob.Lock()
+	defer l2lob.Unlock()
 
+	if l2lob.changed == nil {
+		l2lob.changed = make(chan struct{})
 	}
+	return l2lob.changed
 }
 
-func (l2lob *L2LimitOrderBook) Remove(price LoBFixed, side string) {
-	// adjustedPrice := LoBInt64(price * math.Pow(10, l2lob.PriceScale))
+// notifyChanged wakes up everyone waiting on Changed. It expects the caller to hold the lock.
+func (l2lob *L2LimitOrderBook) notifyChanged() {
+	if l2lob.changed != nil {
+		close(l2lob.changed)
+		l2lob.changed = nil
+	}
+}
 
-	if side == "a" {
+// PriceLevel is a copy of a single price level of the book
+type PriceLevel struct {
+	Price    fixed.Fixed
+	Quantity float64
+}
+
+// Strings formats the level the way Binance does, as a [price, quantity] pair
+// of decimal strings
+func (pl PriceLevel) Strings() [2]string {
+	return [2]string{pl.Price.String(), strconv.FormatFloat(pl.Quantity, 'f', -1, 64)}
+}
+
+// BestBid returns the highest bid level. ok is false if there are no bids.
+func (l2lob *L2LimitOrderBook) BestBid() (level PriceLevel, ok bool) {
+	l2lob.Lock()
+	defer l2lob.Unlock()
+
+	return l2lob.bestLevel("b")
+}
+
+// BestAsk returns the lowest ask level. ok is false if there are no asks.
+func (l2lob *L2LimitOrderBook) BestAsk() (level PriceLevel, ok bool) {
+	l2lob.Lock()
+	defer l2lob.Unlock()
+
+	return l2lob.bestLevel("a")
+}
+
+// Spread returns best ask - best bid. ok is false if either side is empty.
+func (l2lob *L2LimitOrderBook) Spread() (spread fixed.Fixed, ok bool) {
+	l2lob.Lock()
+	defer l2lob.Unlock()
+
+	return spreadOf(l2lob.topN("b", 1), l2lob.topN("a", 1))
+}
+
+// MidPrice returns (best bid + best ask) / 2. ok is false if either side is empty.
+func (l2lob *L2LimitOrderBook) MidPrice() (midPrice fixed.Fixed, ok bool) {
+	l2lob.Lock()
+	defer l2lob.Unlock()
+
+	return midPriceOf(l2lob.topN("b", 1), l2lob.topN("a", 1))
+}
 
-		if _, ok := l2lob.CumulativeAskLimitsMap[price]; ok {
-			l2lob.Asks.Delete(price)
-		}
-		delete(l2lob.CumulativeAskLimitsMap, price)
+// TopN returns up to n levels of the given side ("b" or "a"), best price first.
+// n <= 0 returns every level.
+func (l2lob *L2LimitOrderBook) TopN(side string, n int) []PriceLevel {
+	l2lob.Lock()
+	defer l2lob.Unlock()
 
+	return l2lob.topN(side, n)
+}
+
+// bestLevel expects the caller to hold the lock
+func (l2lob *L2LimitOrderBook) bestLevel(side string) (PriceLevel, bool) {
+	return firstLevel(l2lob.topN(side, 1))
+}
+
+// topN expects the caller to hold the lock
+func (l2lob *L2LimitOrderBook) topN(side string, n int) []PriceLevel {
+	if side == "a" {
+		return topLevels(l2lob.Asks, true, n)
 	} else if side == "b" {
+		return topLevels(l2lob.Bids, false, n)
+	}
+	return nil
+}
 
-		if _, ok := l2lob.CumulativeBidLimitsMap[price]; ok {
-			l2lob.Bids.Delete(price)
-		}
-		delete(l2lob.CumulativeBidLimitsMap, price)
+// topLevels copies up to n levels out of tree, lowest price first if ascending.
+// n <= 0 copies every level.
+func topLevels(tree *btree.BTree, ascending bool, n int) []PriceLevel {
+	capacity := tree.Len()
+	if n > 0 && n < capacity {
+		capacity = n
+	}
+	levels := make([]PriceLevel, 0, capacity)
+
+	iterator := func(item btree.Item) bool {
+		level := item.(LoBLevel)
+		levels = append(levels, PriceLevel{Price: fixed.Fixed(level.Price), Quantity: level.Quantity})
+		return n <= 0 || len(levels) < n
+	}
+
+	// Best bids are at the top of the tree, best asks at the bottom
+	if ascending {
+		tree.Ascend(iterator)
+	} else {
+		tree.Descend(iterator)
+	}
+
+	return levels
+}
+
+func firstLevel(levels []PriceLevel) (PriceLevel, bool) {
+	if len(levels) == 0 {
+		return PriceLevel{}, false
+	}
+	return levels[0], true
+}
+
+// spreadOf takes the top level of each side
+func spreadOf(topBid, topAsk []PriceLevel) (fixed.Fixed, bool) {
+	if len(topBid) == 0 || len(topAsk) == 0 {
+		return fixed.ZERO, false
+	}
+	return topAsk[0].Price.Sub(topBid[0].Price), true
+}
 
+// midPriceOf takes the top level of each side
+func midPriceOf(topBid, topAsk []PriceLevel) (fixed.Fixed, bool) {
+	if len(topBid) == 0 || len(topAsk) == 0 {
+		return fixed.ZERO, false
 	}
+	return topBid[0].Price.Add(topAsk[0].Price).Div(fixed.NewI(2, 0)), true
 }
@@ -48,19 +48,79 @@ func TestLoB_UpdateOrAdd_Small(t *testing.T) {
 		}
 		actual := []float64{}
 		l2lob.Bids.Ascend(func(price btree.Item) bool {
-			fPrice := fixed.Fixed(price.(LoBFixed))
+			fPrice := fixed.Fixed(price.(LoBLevel).Price)
 			actual = append(actual, fPrice.Float())
 			return true
 		})
 		assert.Equalf(test.expectedBidsOrder, actual, "The prices must be in ascending order!")
 
 		// Max
-		max := fixed.Fixed(l2lob.Bids.Max().(LoBFixed))
+		max := fixed.Fixed(l2lob.Bids.Max().(LoBLevel).Price)
 		assert.Equalf(test.expectedMax, max.Float(), "The max bid price must be: %.2f", test.expectedMax)
 
 		// Min
-		min := fixed.Fixed(l2lob.Bids.Min().(LoBFixed))
+		min := fixed.Fixed(l2lob.Bids.Min().(LoBLevel).Price)
 		assert.Equalf(test.expectedMin, min.Float(), "The min bid price must be: %.2f", test.expectedMin)
 	}
 
 }
+
+func TestLoB_TopOfBook(t *testing.T) {
+	assert := assert.New(t)
+
+	l2lob := NewL2LimitOrderBook(0)
+
+	// Empty book
+	_, ok := l2lob.BestBid()
+	assert.False(ok, "An empty book must not have a best bid")
+	_, ok = l2lob.Spread()
+	assert.False(ok, "An empty book must not have a spread")
+
+	bids := [][2]float64{{9.21, 12}, {8.23, 98}, {7.54, 1}, {9.5, 3}}
+	asks := [][2]float64{{10.5, 4}, {9.75, 2}, {11.25, 7}}
+	for _, pq := range bids {
+		l2lob.UpdateOrAdd(LoBFixed(fixed.NewF(pq[0])), pq[1], "b")
+	}
+	for _, pq := range asks {
+		l2lob.UpdateOrAdd(LoBFixed(fixed.NewF(pq[0])), pq[1], "a")
+	}
+
+	bestBid, ok := l2lob.BestBid()
+	assert.True(ok)
+	assert.Equal(9.5, bestBid.Price.Float())
+	assert.Equal(3.0, bestBid.Quantity)
+
+	bestAsk, ok := l2lob.BestAsk()
+	assert.True(ok)
+	assert.Equal(9.75, bestAsk.Price.Float())
+	assert.Equal(2.0, bestAsk.Quantity)
+
+	spread, ok := l2lob.Spread()
+	assert.True(ok)
+	assert.Equal("0.25", spread.String())
+
+	midPrice, ok := l2lob.MidPrice()
+	assert.True(ok)
+	assert.Equal("9.625", midPrice.String())
+
+	topBids := l2lob.TopN("b", 3)
+	assert.Equal([]PriceLevel{
+		{fixed.NewF(9.5), 3},
+		{fixed.NewF(9.21), 12},
+		{fixed.NewF(8.23), 98},
+	}, topBids, "Bids must be returned best (highest) first")
+
+	topAsks := l2lob.TopN("a", 0)
+	assert.Equal([]PriceLevel{
+		{fixed.NewF(9.75), 2},
+		{fixed.NewF(10.5), 4},
+		{fixed.NewF(11.25), 7},
+	}, topAsks, "Asks must be returned best (lowest) first")
+
+	// The returned levels are copies
+	topAsks[0].Quantity = 100
+	bestAsk, _ = l2lob.BestAsk()
+	assert.Equal(2.0, bestAsk.Quantity)
+
+	assert.Nil(l2lob.TopN("x", 5), "Unknown sides return nothing")
+}
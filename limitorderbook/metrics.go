@@ -0,0 +1,117 @@
+package limitorderbook
+
+import (
+	"time"
+
+	"github.com/bensooraj/h-lob-service/metrics"
+	"github.com/google/btree"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robaho/fixed"
+)
+
+// bookMetrics holds the collectors of one book, looked up once rather than
+// on every update
+type bookMetrics struct {
+	applyDuration       prometheus.Observer
+	eventLag            prometheus.Observer
+	bidDepth            prometheus.Gauge
+	askDepth            prometheus.Gauge
+	spread              prometheus.Gauge
+	staleUpdatesSkipped prometheus.Counter
+}
+
+// bookObservation is what an update leaves to be recorded. It is captured
+// under the lock, cheaply, and recorded once the lock is released.
+type bookObservation struct {
+	isApply             bool // Of depth updates rather than a snapshot
+	applyDuration       time.Duration
+	eventTime           int64 // Milliseconds since epoch, 0 if unknown
+	appliedAt           time.Time
+	bidLevels           int
+	askLevels           int
+	bestBid             btree.Item // nil if there are no bids
+	bestAsk             btree.Item // nil if there are no asks
+	staleUpdatesSkipped int
+}
+
+func (bL2LoB *BinanceL2LimitOrderBook) bookMetrics() *bookMetrics {
+	bL2LoB.metricsOnce.Do(func() {
+		bL2LoB.metrics = &bookMetrics{
+			applyDuration:       metrics.ApplyDuration.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol),
+			eventLag:            metrics.EventLag.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol),
+			bidDepth:            metrics.BookDepth.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol, "bids"),
+			askDepth:            metrics.BookDepth.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol, "asks"),
+			spread:              metrics.Spread.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol),
+			staleUpdatesSkipped: metrics.StaleUpdatesSkipped.WithLabelValues(bL2LoB.Exchange, bL2LoB.Symbol),
+		}
+	})
+	return bL2LoB.metrics
+}
+
+// observeApply captures how long an update took to apply and the levels it
+// left. Expects the caller to hold the lock.
+func (bL2LoB *BinanceL2LimitOrderBook) observeApply(start time.Time) *bookObservation {
+	observation := bL2LoB.observeLevels()
+	observation.isApply = true
+	observation.applyDuration = observation.appliedAt.Sub(start)
+	return observation
+}
+
+// observeLevels captures the depth of each side and the best levels. Expects
+// the caller to hold the lock.
+func (bL2LoB *BinanceL2LimitOrderBook) observeLevels() *bookObservation {
+	return &bookObservation{
+		eventTime: bL2LoB.LastEventTime,
+		appliedAt: time.Now(),
+		bidLevels: bL2LoB.Bids.Len(),
+		askLevels: bL2LoB.Asks.Len(),
+		bestBid:   bL2LoB.Bids.Max(),
+		bestAsk:   bL2LoB.Asks.Min(),
+	}
+}
+
+// record records an observation. It must be called without the lock held.
+func (bL2LoB *BinanceL2LimitOrderBook) record(observation *bookObservation) {
+	if observation == nil {
+		return
+	}
+	bookMetrics := bL2LoB.bookMetrics()
+
+	if observation.staleUpdatesSkipped > 0 {
+		bookMetrics.staleUpdatesSkipped.Add(float64(observation.staleUpdatesSkipped))
+	}
+	if observation.isApply {
+		bookMetrics.applyDuration.Observe(observation.applyDuration.Seconds())
+		if observation.eventTime > 0 {
+			lag := observation.appliedAt.Sub(time.Unix(0, observation.eventTime*int64(time.Millisecond)))
+			bookMetrics.eventLag.Observe(lag.Seconds())
+		}
+	}
+
+	bookMetrics.bidDepth.Set(float64(observation.bidLevels))
+	bookMetrics.askDepth.Set(float64(observation.askLevels))
+	if observation.bestBid != nil && observation.bestAsk != nil {
+		bestBid := fixed.Fixed(observation.bestBid.(LoBLevel).Price)
+		bestAsk := fixed.Fixed(observation.bestAsk.(LoBLevel).Price)
+		bookMetrics.spread.Set(bestAsk.Sub(bestBid).Float())
+	} else {
+		// Rather than the spread from before the side emptied
+		bookMetrics.spread.Set(0)
+	}
+}
+
+// deleteMetrics deletes every series of the book, so a torn down book is not
+// exported with its last values. Call it once the update goroutine has exited.
+func (bL2LoB *BinanceL2LimitOrderBook) deleteMetrics() {
+	exchange, symbol := bL2LoB.Exchange, bL2LoB.Symbol
+
+	metrics.ApplyDuration.DeleteLabelValues(exchange, symbol)
+	metrics.EventLag.DeleteLabelValues(exchange, symbol)
+	metrics.BookDepth.DeleteLabelValues(exchange, symbol, "bids")
+	metrics.BookDepth.DeleteLabelValues(exchange, symbol, "asks")
+	metrics.Spread.DeleteLabelValues(exchange, symbol)
+	metrics.StaleUpdatesSkipped.DeleteLabelValues(exchange, symbol)
+	metrics.Resyncs.DeleteLabelValues(exchange, symbol)
+	metrics.SnapshotFetchDuration.DeleteLabelValues(exchange, symbol, "success")
+	metrics.SnapshotFetchDuration.DeleteLabelValues(exchange, symbol, "failure")
+}
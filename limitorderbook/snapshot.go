@@ -0,0 +1,74 @@
+package limitorderbook
+
+import (
+	"github.com/google/btree"
+	"github.com/robaho/fixed"
+)
+
+// BookSnapshot is an immutable, point-in-time view of an order book. The price
+// trees, quantities included, are copy-on-write clones of the live book's, so
+// taking a snapshot costs the same at any depth and it can be read from any
+// number of goroutines without taking the book's lock.
+type BookSnapshot struct {
+	Exchange     string
+	Symbol       string
+	LastUpdateID int64
+	EventTime    int64 // Milliseconds since epoch of the last applied event
+
+	bids *btree.BTree
+	asks *btree.BTree
+}
+
+// Snapshot returns an immutable copy of the book
+func (l2lob *L2LimitOrderBook) Snapshot() *BookSnapshot {
+	l2lob.Lock()
+	defer l2lob.Unlock()
+
+	return l2lob.snapshot()
+}
+
+// snapshot expects the caller to hold the lock
+func (l2lob *L2LimitOrderBook) snapshot() *BookSnapshot {
+	return &BookSnapshot{
+		Exchange: l2lob.Exchange,
+		Symbol:   l2lob.Symbol,
+		bids:     l2lob.Bids.Clone(),
+		asks:     l2lob.Asks.Clone(),
+	}
+}
+
+// BestBid returns the highest bid level. ok is false if there are no bids.
+func (bs *BookSnapshot) BestBid() (level PriceLevel, ok bool) {
+	return firstLevel(bs.TopN("b", 1))
+}
+
+// BestAsk returns the lowest ask level. ok is false if there are no asks.
+func (bs *BookSnapshot) BestAsk() (level PriceLevel, ok bool) {
+	return firstLevel(bs.TopN("a", 1))
+}
+
+// Spread returns best ask - best bid. ok is false if either side is empty.
+func (bs *BookSnapshot) Spread() (spread fixed.Fixed, ok bool) {
+	return spreadOf(bs.TopN("b", 1), bs.TopN("a", 1))
+}
+
+// MidPrice returns (best bid + best ask) / 2. ok is false if either side is empty.
+func (bs *BookSnapshot) MidPrice() (midPrice fixed.Fixed, ok bool) {
+	return midPriceOf(bs.TopN("b", 1), bs.TopN("a", 1))
+}
+
+// TopN returns up to n levels of the given side ("b" or "a"), best price first.
+// n <= 0 returns every level.
+func (bs *BookSnapshot) TopN(side string, n int) []PriceLevel {
+	if side == "a" {
+		return topLevels(bs.asks, true, n)
+	} else if side == "b" {
+		return topLevels(bs.bids, false, n)
+	}
+	return nil
+}
+
+// Depth returns the number of levels on each side
+func (bs *BookSnapshot) Depth() (bidLevels, askLevels int) {
+	return bs.bids.Len(), bs.asks.Len()
+}
@@ -0,0 +1,152 @@
+package limitorderbook
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSnapshot is returned by MemorySnapshotFetcher for symbols it has no snapshot for
+var ErrNoSnapshot = errors.New("no depth snapshot available")
+
+// SnapshotFetcher fetches the REST depth snapshot a Binance book is initialised from
+type SnapshotFetcher interface {
+	FetchDepthSnapshot(symbol string) (*DepthSnapshot, error)
+}
+
+// SnapshotRecorder is handed the body of every successful snapshot response
+type SnapshotRecorder interface {
+	RecordSnapshot(symbol string, receivedAt time.Time, body []byte) error
+}
+
+// HTTPSnapshotFetcher fetches depth snapshots from a Binance REST API
+type HTTPSnapshotFetcher struct {
+	BaseURL  string // e.g. https://testnet.binancefuture.com
+	Endpoint string // e.g. /fapi/v1/depth
+	Limit    int
+	Client   *http.Client
+	Recorder SnapshotRecorder // Optional
+}
+
+// NewHTTPSnapshotFetcher ...
+func NewHTTPSnapshotFetcher(baseURL, endpoint string, limit int, timeout time.Duration) *HTTPSnapshotFetcher {
+	return &HTTPSnapshotFetcher{
+		BaseURL:  strings.TrimRight(baseURL, "/"),
+		Endpoint: endpoint,
+		Limit:    limit,
+		Client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// FetchDepthSnapshot ...
+func (f *HTTPSnapshotFetcher) FetchDepthSnapshot(symbol string) (*DepthSnapshot, error) {
+	depthSnapshotURL, err := url.Parse(f.BaseURL + f.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"symbol": {strings.ToUpper(symbol)}}
+	if f.Limit > 0 {
+		query.Set("limit", strconv.Itoa(f.Limit))
+	}
+	depthSnapshotURL.RawQuery = query.Encode()
+
+	response, err := f.Client.Get(depthSnapshotURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("depth snapshot request for %s failed with status %d: %s", symbol, response.StatusCode, data)
+	}
+
+	if f.Recorder != nil {
+		err = f.Recorder.RecordSnapshot(strings.ToUpper(symbol), time.Now(), data)
+		if err != nil {
+			log.Printf("[SNAPSHOT][%s] Error recording the depth snapshot: %s\n", symbol, err.Error())
+		}
+	}
+
+	var depthSnapshot DepthSnapshot
+	err = json.Unmarshal(data, &depthSnapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &depthSnapshot, nil
+}
+
+// MemorySnapshotFetcher serves queued snapshots from memory, for tests. Each
+// fetch pops the oldest queued snapshot of the symbol; the last one is kept and
+// served to every later fetch.
+type MemorySnapshotFetcher struct {
+	Err error // When set, every fetch fails with it
+
+	snapshots map[string][]*DepthSnapshot
+	calls     map[string]int
+	sync.Mutex
+}
+
+// NewMemorySnapshotFetcher ...
+func NewMemorySnapshotFetcher() *MemorySnapshotFetcher {
+	return &MemorySnapshotFetcher{
+		snapshots: make(map[string][]*DepthSnapshot),
+		calls:     make(map[string]int),
+	}
+}
+
+// AddSnapshot queues a snapshot for a symbol
+func (f *MemorySnapshotFetcher) AddSnapshot(symbol string, depthSnapshot *DepthSnapshot) *MemorySnapshotFetcher {
+	f.Lock()
+	defer f.Unlock()
+
+	symbol = strings.ToUpper(symbol)
+	f.snapshots[symbol] = append(f.snapshots[symbol], depthSnapshot)
+	return f
+}
+
+// Calls returns how many times a symbol has been fetched
+func (f *MemorySnapshotFetcher) Calls(symbol string) int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.calls[strings.ToUpper(symbol)]
+}
+
+// FetchDepthSnapshot ...
+func (f *MemorySnapshotFetcher) FetchDepthSnapshot(symbol string) (*DepthSnapshot, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	symbol = strings.ToUpper(symbol)
+	f.calls[symbol]++
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	queue := f.snapshots[symbol]
+	if len(queue) == 0 {
+		return nil, ErrNoSnapshot
+	}
+
+	depthSnapshot := queue[0]
+	if len(queue) > 1 {
+		f.snapshots[symbol] = queue[1:]
+	}
+
+	return depthSnapshot, nil
+}
@@ -0,0 +1,38 @@
+package limitorderbook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSnapshotFetcher(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("symbol") != "BTCUSDT" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":-1121,"msg":"Invalid symbol."}`))
+			return
+		}
+		assert.Equal("/fapi/v1/depth", r.URL.Path)
+		assert.Equal("5", r.URL.Query().Get("limit"))
+		w.Write([]byte(`{"lastUpdateId":1027024,"E":1589436922972,"T":1589436922959,"bids":[["4.00000000","431.00000000"]],"asks":[["4.00000200","12.00000000"]]}`))
+	}))
+	defer server.Close()
+
+	snapshotFetcher := NewHTTPSnapshotFetcher(server.URL+"/", "/fapi/v1/depth", 5, time.Second)
+
+	depthSnapshot, err := snapshotFetcher.FetchDepthSnapshot("btcusdt")
+	assert.NoError(err)
+	assert.Equal(int64(1027024), depthSnapshot.LastUpdateID)
+	assert.Equal([][2]string{{"4.00000000", "431.00000000"}}, depthSnapshot.Bids)
+
+	_, err = snapshotFetcher.FetchDepthSnapshot("NOPE")
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+	assert.Contains(err.Error(), "Invalid symbol")
+}
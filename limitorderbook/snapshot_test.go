@@ -0,0 +1,52 @@
+package limitorderbook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinanceLoB_Snapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	bL2LoB := NewBinanceL2LimitOrderBook("btcusdt")
+	bL2LoB.applyDepth(
+		[][2]string{{"100.10", "1.5"}, {"100.00", "2"}},
+		[][2]string{{"100.20", "0.5"}, {"100.30", "3"}},
+		10, 1000,
+	)
+
+	snapshot := bL2LoB.Snapshot()
+	assert.Equal(int64(10), snapshot.LastUpdateID)
+	assert.Equal(int64(1000), snapshot.EventTime)
+	assert.Equal("BTCUSDT", snapshot.Symbol)
+
+	// Keep updating the live book after the snapshot was taken
+	bL2LoB.applyDepth(
+		[][2]string{{"100.10", "0"}, {"100.15", "4"}},
+		[][2]string{{"100.20", "9"}},
+		11, 1001,
+	)
+
+	bestBid, ok := snapshot.BestBid()
+	assert.True(ok)
+	assert.Equal("100.1", bestBid.Price.String(), "The snapshot must not see later updates")
+	assert.Equal(1.5, bestBid.Quantity)
+
+	bestAsk, ok := snapshot.BestAsk()
+	assert.True(ok)
+	assert.Equal(0.5, bestAsk.Quantity, "The snapshot must not see later updates")
+
+	bidLevels, askLevels := snapshot.Depth()
+	assert.Equal(2, bidLevels)
+	assert.Equal(2, askLevels)
+
+	// The live book has moved on
+	liveBestBid, _ := bL2LoB.BestBid()
+	assert.Equal("100.15", liveBestBid.Price.String())
+	assert.Equal(int64(11), bL2LoB.Snapshot().LastUpdateID)
+
+	spread, ok := snapshot.Spread()
+	assert.True(ok)
+	assert.Equal("0.1", spread.String())
+}
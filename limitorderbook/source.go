@@ -0,0 +1,34 @@
+package limitorderbook
+
+import "time"
+
+// OrderBook is the read side of a book, whatever the exchange
+type OrderBook interface {
+	Snapshot() *BookSnapshot
+	SyncState() SyncState
+}
+
+// ChangeNotifier is implemented by books that can signal changes, so readers
+// do not have to poll
+type ChangeNotifier interface {
+	Changed() <-chan struct{}
+}
+
+// Freshness is implemented by books that know when they last applied an update
+type Freshness interface {
+	LastAppliedAt() time.Time
+}
+
+// OrderBookSource lists the books of a single exchange
+type OrderBookSource interface {
+	Exchange() string
+	Symbols() []string
+	OrderBook(symbol string) (OrderBook, bool)
+}
+
+var (
+	_ OrderBook       = (*BinanceL2LimitOrderBook)(nil)
+	_ ChangeNotifier  = (*BinanceL2LimitOrderBook)(nil)
+	_ Freshness       = (*BinanceL2LimitOrderBook)(nil)
+	_ OrderBookSource = (*BinanceL2LimitOrderBookManager)(nil)
+)
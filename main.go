@@ -1,75 +1,341 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
-	"net/url"
+	"net/http"
 	"os"
 	"os/signal"
-	"time"
+	"path/filepath"
+	"sort"
+	"syscall"
 
 	"github.com/bensooraj/h-lob-service/binancewebsocket"
+	"github.com/bensooraj/h-lob-service/capture"
+	"github.com/bensooraj/h-lob-service/config"
+	"github.com/bensooraj/h-lob-service/grpcapi"
+	"github.com/bensooraj/h-lob-service/health"
+	"github.com/bensooraj/h-lob-service/hwebsocket"
 	"github.com/bensooraj/h-lob-service/limitorderbook"
-	jsoniter "github.com/json-iterator/go"
+	"github.com/bensooraj/h-lob-service/replay"
+	"github.com/bensooraj/h-lob-service/restapi"
+	"github.com/bensooraj/h-lob-service/streamserver"
 )
 
-var json = jsoniter.ConfigCompatibleWithStandardLibrary
+var (
+	configPath  = flag.String("config", "", "YAML configuration file, see config.example.yaml")
+	replayGlob  = flag.String("replay", "", "Replay the capture files matching this glob instead of connecting to Binance. The config must have a single exchange")
+	replaySpeed = flag.Float64("replay-speed", replay.AsFastAsPossible, "1 replays at the original pace, 10 ten times faster, 0 as fast as possible")
+	overrides   = config.RegisterFlags(flag.CommandLine)
+)
 
 func main() {
 	flag.Parse()
 	log.SetFlags(1)
 
-	doneChannel := make(chan struct{}, 0)
-
-	binanceL2LoB := limitorderbook.NewBinanceL2LimitOrderBook()
-	binanceL2LoB.UpdateOrderBook(doneChannel)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	wsConnectionURL := url.URL{Scheme: "wss", Host: "stream.binancefuture.com", Path: "/ws/"}
+	if *replayGlob != "" {
+		runReplay(cfg.Exchanges[0])
+		return
+	}
 
-	binanceWebsocket := binancewebsocket.NewBinanceWebsocket(doneChannel)
-	binanceWebsocket.Open(wsConnectionURL.String(), func(msg []byte) error {
-		var err error
-		// Check if it's a depth update event
-		var depthUpdate binancewebsocket.DepthUpdate
-		err = json.Unmarshal(msg, &depthUpdate)
-		if err == nil && depthUpdate.EventType == "depthUpdate" {
-			log.Println("DEPTH Update Received", depthUpdate.Symbol)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-			binanceL2LoB.DepthUpdateBufferChannel <- depthUpdate
+	var exchanges []*openedExchange
+	var bookManagers []*limitorderbook.BinanceL2LimitOrderBookManager
+	for _, exchange := range cfg.Exchanges {
+		opened, err := openExchange(ctx, exchange, cfg.Capture, cfg.Shutdown)
+		if err != nil {
+			log.Fatalf("Error opening %s: %s\n", exchange.Name, err)
+		}
+		exchanges = append(exchanges, opened)
+		bookManagers = append(bookManagers, opened.bookManager)
+	}
 
-			return nil
+	var servers []server
+	if cfg.Servers.HTTPAddr != "" {
+		checker := health.New(cfg.Health.StalenessWindow)
+		restServer := restapi.New()
+		for i, bookManager := range bookManagers {
+			checker.AddSource(bookManager, cfg.Exchanges[i].Symbols...).AddLivenessCheck(bookManager.Exchange(), bookManager)
+			restServer.AddSource(bookManager)
 		}
+		restServer.Handle("/healthz", checker.LivenessHandler()).Handle("/readyz", checker.ReadinessHandler())
 
-		// Else check if it's a response to a live subscribe unsubscribe request
-		var liveResponse binancewebsocket.LiveResponse
-		err = json.Unmarshal(msg, &liveResponse)
-		if err == nil && liveResponse.ID > 0 {
-			log.Println("Live Response Received", liveResponse.ID, liveResponse.Result)
+		servers = append(servers, restServer)
+		go func() {
+			err := restServer.ListenAndServe(cfg.Servers.HTTPAddr)
+			if err != http.ErrServerClosed {
+				log.Println("HTTP server stopped: ", err)
+			}
+		}()
+	}
 
-			return nil
+	if cfg.Servers.StreamAddr != "" {
+		streamServer := streamserver.New()
+		for _, bookManager := range bookManagers {
+			streamServer.AddSource(bookManager)
 		}
 
-		return err
-	}, func(err error) {
-		log.Println("WALLA WALLA WALLA: ", err.Error())
-	})
+		servers = append(servers, streamServer)
+		go func() {
+			err := streamServer.ListenAndServe(cfg.Servers.StreamAddr)
+			if err != http.ErrServerClosed {
+				log.Println("Stream server stopped: ", err)
+			}
+		}()
+	}
 
-	streamList := []string{"btcusdt@depth"}
-	binanceWebsocket.Subscribe(1, streamList)
+	if cfg.Servers.GRPCAddr != "" {
+		grpcServer := grpcapi.New()
+		for _, bookManager := range bookManagers {
+			grpcServer.AddSource(bookManager)
+		}
+
+		servers = append(servers, grpcServer)
+		go func() {
+			err := grpcServer.ListenAndServe(cfg.Servers.GRPCAddr)
+			if err != nil {
+				log.Println("gRPC server stopped: ", err)
+			}
+		}()
+	}
 
 	signalInterrupt := make(chan os.Signal, 1)
-	signal.Notify(signalInterrupt, os.Interrupt)
+	signal.Notify(signalInterrupt, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signalInterrupt
+	log.Printf("Received %s, shutting down\n", sig)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Shutdown.GracePeriod)
+	defer shutdownCancel()
 
-	for {
-		select {
-		case <-signalInterrupt:
+	stoppedChannel := make(chan struct{})
+	go func() {
+		shutdown(shutdownCtx, servers, exchanges)
+		close(stoppedChannel)
+	}()
 
-			binanceWebsocket.Unsubscribe(1, streamList)
-			<-time.After(7 * time.Second)
+	select {
+	case <-stoppedChannel:
+		log.Println("Shutdown complete")
+	case <-shutdownCtx.Done():
+		log.Fatalf("Shutdown did not complete within %s\n", cfg.Shutdown.GracePeriod)
+	}
+}
 
-			close(doneChannel)
-			<-time.After(7 * time.Second)
-			return
+// server is implemented by the REST, stream and gRPC servers
+type server interface {
+	Shutdown(ctx context.Context) error
+}
+
+// openedExchange is what openExchange started and shutdown stops
+type openedExchange struct {
+	name        string
+	bookManager *limitorderbook.BinanceL2LimitOrderBookManager
+	feed        binancewebsocket.Feed
+	recorder    *capture.Recorder // nil unless capturing
+}
+
+// shutdown stops the servers first, so no client reads a book being torn
+// down, then unsubscribes and drains the books, so no buffered update is lost,
+// then closes the connections and finally flushes the captures
+func shutdown(ctx context.Context, servers []server, exchanges []*openedExchange) {
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Println("Error stopping a server: ", err)
+		}
+	}
+
+	for _, exchange := range exchanges {
+		exchange.bookManager.Close()
+	}
+
+	for _, exchange := range exchanges {
+		exchange.feed.Close()
+		exchange.feed.Wait()
+	}
+
+	for _, exchange := range exchanges {
+		if exchange.recorder == nil {
+			continue
 		}
+		err := exchange.recorder.Close()
+		if err != nil {
+			log.Printf("[%s] Error closing the capture: %s\n", exchange.name, err.Error())
+		}
+	}
+}
+
+// loadConfig layers the file, the environment and the flags, then validates.
+// Replays are of a single exchange.
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.ApplyEnv(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = overrides.Apply(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// Capture files do not say which exchange they were recorded from
+	if *replayGlob != "" && len(cfg.Exchanges) > 1 {
+		return nil, fmt.Errorf("replay takes a single exchange, the config has %d", len(cfg.Exchanges))
+	}
+
+	return cfg, nil
+}
+
+// openExchange connects to the exchange's depth streams and subscribes its
+// symbols. The connection stops when ctx is cancelled.
+func openExchange(ctx context.Context, exchange config.Exchange, captureConfig config.Capture, shutdownConfig config.Shutdown) (*openedExchange, error) {
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.Name = exchange.Name
+	bookManager.Market = exchange.Market
+	bookManager.StreamSuffix = exchange.StreamSuffix()
+	bookManager.SnapshotRetryDelay = exchange.Retry.SnapshotRetryDelay
+	bookManager.CloseTimeout = shutdownConfig.RequestTimeout
+
+	snapshotFetcher := limitorderbook.NewHTTPSnapshotFetcher(exchange.RESTEndpoint(), exchange.Market.DepthSnapshotEndpoint(), exchange.SnapshotLimit, exchange.SnapshotTimeout)
+	bookManager.SnapshotFetcher = snapshotFetcher
+
+	opened := &openedExchange{
+		name:        exchange.Name,
+		bookManager: bookManager,
+	}
+
+	var recorder hwebsocket.FrameRecorder
+	if captureConfig.Dir != "" {
+		var err error
+		opened.recorder, err = capture.NewRecorder(captureConfig.Dir, exchange.Name, captureConfig.MaxBytes, captureConfig.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshotFetcher.Recorder = opened.recorder
+		recorder = opened.recorder
+	}
+
+	opened.feed = newFeed(exchange, bookManager, recorder)
+	bookManager.Websocket = opened.feed
+
+	err := opened.feed.Open(ctx, exchange.WebsocketEndpoint(), bookManager.HandleMessage, func(err error) {
+		log.Printf("[%s] Websocket error: %s\n", exchange.Name, err.Error())
+	})
+	if err != nil {
+		if opened.recorder != nil {
+			opened.recorder.Close()
+		}
+		return nil, err
+	}
+
+	// A subscription Binance did not answer in time is kept, and replayed on
+	// the next reconnect. One it rejected, e.g. for a bad symbol, is fatal.
+	err = bookManager.Subscribe(exchange.Symbols...)
+	var liveError *binancewebsocket.LiveError
+	if errors.As(err, &liveError) {
+		opened.feed.Close()
+		opened.feed.Wait()
+		if opened.recorder != nil {
+			opened.recorder.Close()
+		}
+		return nil, err
+	}
+
+	return opened, nil
+}
+
+// newFeed returns a single connection, or an Arbitrator of exchange.Connections
+// redundant ones, with the book manager's hooks set
+func newFeed(exchange config.Exchange, bookManager *limitorderbook.BinanceL2LimitOrderBookManager, recorder hwebsocket.FrameRecorder) binancewebsocket.Feed {
+	newConnection := func() *binancewebsocket.BinanceWebsocket {
+		binanceWebsocket := binancewebsocket.NewBinanceWebsocket()
+		binanceWebsocket.Name = exchange.Name
+		binanceWebsocket.ReconnectPolicy = exchange.Retry.ReconnectPolicy()
+		binanceWebsocket.RotationInterval = exchange.RotationInterval
+		binanceWebsocket.MessageRateLimit = exchange.RateLimit()
+		binanceWebsocket.MessageBurst = exchange.MessageBurst
+		binanceWebsocket.MaxStreams = exchange.StreamsPerConnection()
+		binanceWebsocket.OnDisconnect = bookManager.HandleDisconnect
+		binanceWebsocket.OnReconnected = bookManager.HandleReconnect
+		binanceWebsocket.Recorder = recorder
+		return binanceWebsocket
+	}
+
+	if exchange.Connections <= 1 {
+		return newConnection()
+	}
+
+	connections := make([]*binancewebsocket.BinanceWebsocket, exchange.Connections)
+	for i := range connections {
+		connections[i] = newConnection()
+	}
+	arbitrator := binancewebsocket.NewArbitrator(connections...)
+	arbitrator.Name = exchange.Name
+	arbitrator.OnDisconnect = bookManager.HandleDisconnect
+	arbitrator.OnReconnected = bookManager.HandleReconnect
+	arbitrator.Recorder = recorder
+	return arbitrator
+}
+
+// runReplay replays captures of the exchange into fresh books and logs where they end up
+func runReplay(exchange config.Exchange) {
+	files, err := filepath.Glob(*replayGlob)
+	if err != nil || len(files) == 0 {
+		log.Fatalln("No capture files match", *replayGlob, err)
+	}
+	sort.Strings(files)
+
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.Name = exchange.Name
+	bookManager.Market = exchange.Market
+	// Snapshots are applied at the same point of the stream on every run
+	bookManager.InlineSnapshots = true
+	replayer := replay.New(bookManager.HandleMessage, *replaySpeed)
+	replayer.FlushFunc = bookManager.Flush
+	bookManager.SnapshotFetcher = replayer.SnapshotFetcher
+	bookManager.Subscribe(exchange.Symbols...)
+	defer bookManager.Close()
+
+	doneChannel := make(chan struct{})
+	signalInterrupt := make(chan os.Signal, 1)
+	signal.Notify(signalInterrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalInterrupt
+		close(doneChannel)
+	}()
+
+	err = replayer.Run(doneChannel, files...)
+	if err != nil {
+		log.Println("Replay stopped: ", err)
+	}
+
+	for _, symbol := range bookManager.Symbols() {
+		bL2LoB, _ := bookManager.Book(symbol)
+		snapshot := bL2LoB.Snapshot()
+		bestBid, _ := snapshot.BestBid()
+		bestAsk, _ := snapshot.BestAsk()
+		log.Printf("[replay] %s %s | u: %d | bid %s x %v | ask %s x %v\n", symbol, bL2LoB.SyncState(), snapshot.LastUpdateID, bestBid.Price, bestBid.Quantity, bestAsk.Price, bestAsk.Quantity)
 	}
 }
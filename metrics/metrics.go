@@ -0,0 +1,147 @@
+/*
+  Package metrics holds the Prometheus collectors of the service. They are
+  registered with the default registry and served by Handler. The series of a
+  book are deleted when it is torn down.
+*/
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "hlob"
+
+// NoStream is the stream label of the messages that belong to no stream
+const NoStream = "none"
+
+var (
+	// MessagesReceived counts every message received, by stream, e.g.
+	// btcusdt@depth. Messages of no stream, such as live responses and
+	// messages that could not be parsed, are counted under NoStream.
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received per stream.",
+	}, []string{"exchange", "stream"})
+
+	// ParseFailures counts messages and price levels that could not be decoded
+	ParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_failures_total",
+		Help:      "Messages or price levels that could not be parsed.",
+	}, []string{"exchange", "kind"})
+
+	// ReconnectAttempts counts every attempt made by hwebsocket to reconnect
+	ReconnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_reconnect_attempts_total",
+		Help:      "Websocket reconnect attempts by outcome.",
+	}, []string{"exchange", "result"})
+
+	// ConnectionRotations counts the connections replaced make-before-break by
+	// hwebsocket. result is "switched" once the replacement caught up on every
+	// stream, "forced" after the overlap, "failover" if the old connection
+	// failed first, or "failure".
+	ConnectionRotations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_rotations_total",
+		Help:      "Websocket connections replaced before the exchange cuts them off, by outcome.",
+	}, []string{"exchange", "result"})
+
+	// RateLimitedMessages counts the messages hwebsocket held back to stay
+	// within the connection's rate limit
+	RateLimitedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_rate_limited_messages_total",
+		Help:      "Outbound websocket messages delayed by the rate limit.",
+	}, []string{"exchange"})
+
+	// ArbitrationWins counts, per connection of a binancewebsocket.Arbitrator,
+	// the depth updates it delivered before the others
+	ArbitrationWins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_arbitration_wins_total",
+		Help:      "Depth updates a redundant connection delivered first.",
+	}, []string{"exchange", "connection"})
+
+	// Resyncs counts the times a book lost the sequence and started over
+	Resyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "book_resyncs_total",
+		Help:      "Times a book fell out of sync with its depth stream and was re-initialised.",
+	}, []string{"exchange", "symbol"})
+
+	// StaleUpdatesSkipped counts depth updates already contained in the book
+	StaleUpdatesSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "book_stale_updates_skipped_total",
+		Help:      "Depth updates skipped because the book already contains them.",
+	}, []string{"exchange", "symbol"})
+
+	// SnapshotFetchDuration ...
+	SnapshotFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "book_snapshot_fetch_duration_seconds",
+		Help:      "Time taken to fetch a depth snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"exchange", "symbol", "result"})
+
+	// ApplyDuration is the time the book is locked to apply a batch of depth
+	// updates, see BinanceL2LimitOrderBook.handleDepthUpdates
+	ApplyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "book_apply_duration_seconds",
+		Help:      "Time taken to apply a batch of depth updates to a book.",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 10),
+	}, []string{"exchange", "symbol"})
+
+	// EventLag is the time between the exchange's event time and the update
+	// being applied. It includes any clock skew between the two hosts.
+	EventLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "book_event_lag_seconds",
+		Help:      "Time from the exchange event time to the update being applied.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"exchange", "symbol"})
+
+	// BookDepth is the number of price levels held per side
+	BookDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "book_depth_levels",
+		Help:      "Price levels held per side of a book.",
+	}, []string{"exchange", "symbol", "side"})
+
+	// Spread is the best ask less the best bid, 0 while either side is empty
+	Spread = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "book_spread",
+		Help:      "Best ask less best bid, in quote currency. 0 while either side is empty.",
+	}, []string{"exchange", "symbol"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		MessagesReceived,
+		ParseFailures,
+		ReconnectAttempts,
+		ConnectionRotations,
+		RateLimitedMessages,
+		ArbitrationWins,
+		Resyncs,
+		StaleUpdatesSkipped,
+		SnapshotFetchDuration,
+		ApplyDuration,
+		EventLag,
+		BookDepth,
+		Spread,
+	)
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,137 @@
+/*
+  Package replay feeds capture files back through a websocket message handler,
+  with the recorded REST depth snapshots standing in for the exchange's.
+*/
+
+package replay
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/capture"
+)
+
+// AsFastAsPossible replays without waiting between frames
+const AsFastAsPossible = 0
+
+// ErrStopped is returned by Run when doneChannel is closed mid-replay
+var ErrStopped = errors.New("replay: stopped")
+
+// Replayer ...
+type Replayer struct {
+	// Speed 1 replays at the original pace, 10 ten times faster, AsFastAsPossible without waiting
+	Speed             float64
+	MessageHandleFunc func([]byte) error
+	SnapshotFetcher   *SnapshotFetcher
+	// FlushFunc, when set, is called after every record and must return once
+	// the record has been applied, keeping the consumer in step with the capture
+	FlushFunc func()
+
+	firstReceivedAt time.Time
+	startedAt       time.Time
+}
+
+// New ...
+func New(messageHandleFunc func([]byte) error, speed float64) *Replayer {
+	return &Replayer{
+		Speed:             speed,
+		MessageHandleFunc: messageHandleFunc,
+		SnapshotFetcher:   NewSnapshotFetcher(),
+	}
+}
+
+// Run replays the files in order. Frames are handed to MessageHandleFunc and
+// snapshots to SnapshotFetcher. Once every file has been replayed the
+// SnapshotFetcher is closed, so books still waiting for a snapshot give up.
+func (r *Replayer) Run(doneChannel <-chan struct{}, files ...string) error {
+	defer r.SnapshotFetcher.Close()
+
+	for _, name := range files {
+		err := r.runFile(doneChannel, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) runFile(doneChannel <-chan struct{}, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := capture.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = r.wait(doneChannel, record.ReceivedAt)
+		if err != nil {
+			return err
+		}
+
+		switch record.Kind {
+		case capture.KindFrame:
+			err = r.MessageHandleFunc(record.Payload)
+			if err != nil {
+				log.Printf("[replay][%s] Error processing the message: %s", name, err.Error())
+			}
+		case capture.KindSnapshot:
+			r.SnapshotFetcher.Add(record.Source, record.Payload)
+		}
+
+		if r.FlushFunc != nil {
+			r.FlushFunc()
+		}
+	}
+}
+
+// wait sleeps until the record is due, relative to the first record replayed
+func (r *Replayer) wait(doneChannel <-chan struct{}, receivedAt time.Time) error {
+	select {
+	case <-doneChannel:
+		return ErrStopped
+	default:
+	}
+
+	if r.firstReceivedAt.IsZero() {
+		r.firstReceivedAt = receivedAt
+		r.startedAt = time.Now()
+		return nil
+	}
+
+	if r.Speed <= AsFastAsPossible {
+		return nil
+	}
+
+	dueAt := r.startedAt.Add(time.Duration(float64(receivedAt.Sub(r.firstReceivedAt)) / r.Speed))
+	delay := time.Until(dueAt)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-doneChannel:
+		return ErrStopped
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,110 @@
+package replay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/capture"
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/robaho/fixed"
+	"github.com/stretchr/testify/assert"
+)
+
+func record(kind capture.Kind, receivedAt time.Time, source string, payload []byte) capture.Record {
+	return capture.Record{Kind: kind, ReceivedAt: receivedAt, Source: source, Payload: payload}
+}
+
+func writeCapture(t *testing.T, dir string, records []capture.Record) string {
+	name := filepath.Join(dir, "test.cap.gz")
+	file, err := os.Create(name)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	writer := capture.NewWriter(file)
+	for _, record := range records {
+		assert.NoError(t, writer.Write(record))
+	}
+	assert.NoError(t, writer.Close())
+
+	return name
+}
+
+func TestReplay_IntoOrderBook(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "replay")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1600000000, 0)
+	name := writeCapture(t, dir, []capture.Record{
+		record(capture.KindFrame, start, "wss://stream.binancefuture.com/ws/", []byte(`{"result":null,"id":1}`)),
+		record(capture.KindFrame, start.Add(1*time.Millisecond), "wss://stream.binancefuture.com/ws/", []byte(`{"e":"depthUpdate","E":1,"s":"BTCUSDT","U":96,"u":105,"pu":95,"b":[["10.0","3"]],"a":[]}`)),
+		record(capture.KindSnapshot, start.Add(2*time.Millisecond), "BTCUSDT", []byte(`{"lastUpdateId":100,"bids":[["10.0","1"],["9.5","2"]],"asks":[["10.5","1"]]}`)),
+		record(capture.KindFrame, start.Add(3*time.Millisecond), "wss://stream.binancefuture.com/ws/", []byte(`{"e":"depthUpdate","E":2,"s":"BTCUSDT","U":106,"u":110,"pu":105,"b":[["9.5","0"]],"a":[["10.5","4"]]}`)),
+	})
+
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.InlineSnapshots = true
+	replayer := New(bookManager.HandleMessage, AsFastAsPossible)
+	replayer.FlushFunc = bookManager.Flush
+	bookManager.SnapshotFetcher = replayer.SnapshotFetcher
+	bookManager.Subscribe("BTCUSDT")
+	defer bookManager.Close()
+
+	assert.NoError(replayer.Run(make(chan struct{}), name))
+
+	// Every record has been applied by the time Run returns
+	bL2LoB, _ := bookManager.Book("BTCUSDT")
+	assert.Equal(limitorderbook.SyncStateLive, bL2LoB.SyncState())
+	assert.Equal(int64(110), bL2LoB.Snapshot().LastUpdateID)
+
+	snapshot := bL2LoB.Snapshot()
+	assert.Equal([]limitorderbook.PriceLevel{{Price: mustParse("10.0"), Quantity: 3}}, snapshot.TopN("b", 0))
+	assert.Equal([]limitorderbook.PriceLevel{{Price: mustParse("10.5"), Quantity: 4}}, snapshot.TopN("a", 0))
+
+	// Nothing more was recorded
+	_, err = replayer.SnapshotFetcher.FetchDepthSnapshot("BTCUSDT")
+	assert.Equal(ErrReplayFinished, err)
+}
+
+func TestReplay_Speed(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "replay")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1600000000, 0)
+	name := writeCapture(t, dir, []capture.Record{
+		record(capture.KindFrame, start, "", []byte(`{}`)),
+		record(capture.KindFrame, start.Add(400*time.Millisecond), "", []byte(`{}`)),
+	})
+
+	frames := 0
+	handler := func(msg []byte) error {
+		frames++
+		return nil
+	}
+
+	began := time.Now()
+	assert.NoError(New(handler, 4).Run(make(chan struct{}), name))
+	elapsed := time.Since(began)
+	assert.Equal(2, frames)
+	assert.True(elapsed >= 100*time.Millisecond && elapsed < 400*time.Millisecond, "4x speed must take about 100ms, took %s", elapsed)
+
+	began = time.Now()
+	assert.NoError(New(handler, AsFastAsPossible).Run(make(chan struct{}), name))
+	assert.True(time.Since(began) < 100*time.Millisecond)
+
+	doneChannel := make(chan struct{})
+	close(doneChannel)
+	assert.Equal(ErrStopped, New(handler, 1).Run(doneChannel, name))
+}
+
+func mustParse(s string) fixed.Fixed {
+	return fixed.MustParse(s)
+}
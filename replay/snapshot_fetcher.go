@@ -0,0 +1,77 @@
+package replay
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// ErrReplayFinished is returned for snapshot requests the capture cannot satisfy
+var ErrReplayFinished = errors.New("replay: no more recorded snapshots")
+
+// ErrSnapshotNotReplayed is returned for snapshot requests made before the
+// replay reached the next recorded snapshot of the symbol
+var ErrSnapshotNotReplayed = errors.New("replay: the next snapshot has not been replayed yet")
+
+// SnapshotFetcher is a limitorderbook.SnapshotFetcher serving the recorded
+// snapshots. A fetch never blocks: it fails with ErrSnapshotNotReplayed until
+// the replay reaches the next recorded snapshot of the symbol, so books fetching
+// inline retry with the next depth update, see
+// limitorderbook.BinanceL2LimitOrderBook.InlineSnapshots.
+type SnapshotFetcher struct {
+	pending  map[string][][]byte
+	isClosed bool
+	sync.Mutex
+}
+
+// NewSnapshotFetcher ...
+func NewSnapshotFetcher() *SnapshotFetcher {
+	return &SnapshotFetcher{pending: make(map[string][][]byte)}
+}
+
+// Add queues a recorded snapshot body
+func (f *SnapshotFetcher) Add(symbol string, body []byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	symbol = strings.ToUpper(symbol)
+	f.pending[symbol] = append(f.pending[symbol], body)
+}
+
+// Close makes every fetch that has no queued snapshot fail with ErrReplayFinished
+func (f *SnapshotFetcher) Close() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.isClosed = true
+}
+
+// FetchDepthSnapshot ...
+func (f *SnapshotFetcher) FetchDepthSnapshot(symbol string) (*limitorderbook.DepthSnapshot, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	symbol = strings.ToUpper(symbol)
+	if len(f.pending[symbol]) == 0 {
+		if f.isClosed {
+			return nil, ErrReplayFinished
+		}
+		return nil, ErrSnapshotNotReplayed
+	}
+
+	body := f.pending[symbol][0]
+	f.pending[symbol] = f.pending[symbol][1:]
+
+	var depthSnapshot limitorderbook.DepthSnapshot
+	err := json.Unmarshal(body, &depthSnapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &depthSnapshot, nil
+}
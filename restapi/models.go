@@ -0,0 +1,84 @@
+package restapi
+
+import (
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/robaho/fixed"
+)
+
+// Prices and quantities are strings, the way Binance sends them, so no
+// precision is lost to float64 on either end
+
+// BookSummary ...
+type BookSummary struct {
+	Exchange     string                   `json:"exchange"`
+	Symbol       string                   `json:"symbol"`
+	LastUpdateID int64                    `json:"lastUpdateId"`
+	EventTime    int64                    `json:"eventTime"`
+	SyncState    limitorderbook.SyncState `json:"syncState"`
+	BidLevels    int                      `json:"bidLevels"`
+	AskLevels    int                      `json:"askLevels"`
+}
+
+// BookList ...
+type BookList struct {
+	Books []BookSummary `json:"books"`
+}
+
+// BookDepth ...
+type BookDepth struct {
+	Exchange     string                   `json:"exchange"`
+	Symbol       string                   `json:"symbol"`
+	LastUpdateID int64                    `json:"lastUpdateId"`
+	EventTime    int64                    `json:"eventTime"`
+	SyncState    limitorderbook.SyncState `json:"syncState"`
+	Bids         [][2]string              `json:"bids"`
+	Asks         [][2]string              `json:"asks"`
+}
+
+// PriceLevel ...
+type PriceLevel struct {
+	Price    string `json:"price"`
+	Quantity string `json:"quantity"`
+}
+
+// TopOfBook ...
+type TopOfBook struct {
+	Exchange     string                   `json:"exchange"`
+	Symbol       string                   `json:"symbol"`
+	LastUpdateID int64                    `json:"lastUpdateId"`
+	EventTime    int64                    `json:"eventTime"`
+	SyncState    limitorderbook.SyncState `json:"syncState"`
+	BestBid      *PriceLevel              `json:"bestBid"`
+	BestAsk      *PriceLevel              `json:"bestAsk"`
+	Spread       *string                  `json:"spread"`
+	MidPrice     *string                  `json:"midPrice"`
+}
+
+// ErrorResponse ...
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func toLevels(priceLevels []limitorderbook.PriceLevel) [][2]string {
+	levels := make([][2]string, 0, len(priceLevels))
+	for _, priceLevel := range priceLevels {
+		levels = append(levels, priceLevel.Strings())
+	}
+	return levels
+}
+
+func toPriceLevel(priceLevel limitorderbook.PriceLevel, ok bool) *PriceLevel {
+	if !ok {
+		return nil
+	}
+	pair := priceLevel.Strings()
+	return &PriceLevel{Price: pair[0], Quantity: pair[1]}
+}
+
+func toPrice(price fixed.Fixed, ok bool) *string {
+	if !ok {
+		return nil
+	}
+	formatted := price.String()
+	return &formatted
+}
@@ -0,0 +1,259 @@
+/*
+  Package restapi serves the live order books over HTTP as JSON:
+
+    GET /books                            every book with its update ID and sync state
+    GET /books/{exchange}/{symbol}?depth=N  up to N levels per side (default 100, 0 for all)
+    GET /books/{exchange}/{symbol}/top      best bid/ask, spread and mid price
+    GET /metrics                          Prometheus metrics, see package metrics
+
+  ListenAndServe also serves any endpoint added with Handle, until Shutdown.
+*/
+
+package restapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/bensooraj/h-lob-service/metrics"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// DefaultDepth is the number of levels per side returned without ?depth
+const DefaultDepth = 100
+
+// Server ...
+type Server struct {
+	sources    map[string]limitorderbook.OrderBookSource
+	handlers   map[string]http.Handler
+	httpServer *http.Server // Set by Serve
+	isShutdown bool
+	sync.RWMutex
+}
+
+// New ...
+func New(sources ...limitorderbook.OrderBookSource) *Server {
+	s := &Server{
+		sources:  make(map[string]limitorderbook.OrderBookSource),
+		handlers: make(map[string]http.Handler),
+	}
+	for _, source := range sources {
+		s.AddSource(source)
+	}
+	return s
+}
+
+// AddSource serves the books of another exchange
+func (s *Server) AddSource(source limitorderbook.OrderBookSource) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sources[strings.ToLower(source.Exchange())] = source
+}
+
+// Handle serves another endpoint next to the API from ListenAndServe, e.g. /healthz
+func (s *Server) Handle(pattern string, handler http.Handler) *Server {
+	s.Lock()
+	defer s.Unlock()
+
+	s.handlers[pattern] = handler
+	return s
+}
+
+// ServeHTTP ...
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "books" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		s.handleList(w, r)
+	case len(parts) == 3:
+		s.handleDepth(w, r, parts[1], parts[2])
+	case len(parts) == 4 && parts[3] == "top":
+		s.handleTop(w, r, parts[1], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// ListenAndServe serves the API on addr until it fails or Shutdown is called
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[restapi] Listening on %s\n", addr)
+	return s.Serve(listener)
+}
+
+// Serve serves the API on listener until it fails or Shutdown is called, when
+// it returns http.ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/books", s)
+	mux.Handle("/books/", s)
+	mux.Handle("/metrics", metrics.Handler())
+
+	s.Lock()
+	for pattern, handler := range s.handlers {
+		mux.Handle(pattern, handler)
+	}
+	if s.isShutdown {
+		s.Unlock()
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	httpServer := &http.Server{Handler: mux}
+	s.httpServer = httpServer
+	s.Unlock()
+
+	return httpServer.Serve(listener)
+}
+
+// Shutdown stops accepting connections and waits for the requests in flight,
+// until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	s.isShutdown = true
+	httpServer := s.httpServer
+	s.Unlock()
+
+	if httpServer == nil {
+		return nil
+	}
+	return httpServer.Shutdown(ctx)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	sources := make([]limitorderbook.OrderBookSource, 0, len(s.sources))
+	for _, source := range s.sources {
+		sources = append(sources, source)
+	}
+	s.RUnlock()
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Exchange() < sources[j].Exchange() })
+
+	bookList := BookList{Books: []BookSummary{}}
+	for _, source := range sources {
+		exchange := strings.ToLower(source.Exchange())
+		for _, symbol := range source.Symbols() {
+			orderBook, ok := source.OrderBook(symbol)
+			if !ok {
+				continue
+			}
+
+			snapshot := orderBook.Snapshot()
+			bidLevels, askLevels := snapshot.Depth()
+			bookList.Books = append(bookList.Books, BookSummary{
+				Exchange:     exchange,
+				Symbol:       snapshot.Symbol,
+				LastUpdateID: snapshot.LastUpdateID,
+				EventTime:    snapshot.EventTime,
+				SyncState:    orderBook.SyncState(),
+				BidLevels:    bidLevels,
+				AskLevels:    askLevels,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, bookList)
+}
+
+func (s *Server) handleDepth(w http.ResponseWriter, r *http.Request, exchange, symbol string) {
+	depth := DefaultDepth
+	if value := r.URL.Query().Get("depth"); value != "" {
+		var err error
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid depth %q", value))
+			return
+		}
+	}
+
+	orderBook, ok := s.orderBook(exchange, symbol)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no book for %s %s", exchange, symbol))
+		return
+	}
+
+	snapshot := orderBook.Snapshot()
+	writeJSON(w, http.StatusOK, BookDepth{
+		Exchange:     strings.ToLower(exchange),
+		Symbol:       snapshot.Symbol,
+		LastUpdateID: snapshot.LastUpdateID,
+		EventTime:    snapshot.EventTime,
+		SyncState:    orderBook.SyncState(),
+		Bids:         toLevels(snapshot.TopN("b", depth)),
+		Asks:         toLevels(snapshot.TopN("a", depth)),
+	})
+}
+
+func (s *Server) handleTop(w http.ResponseWriter, r *http.Request, exchange, symbol string) {
+	orderBook, ok := s.orderBook(exchange, symbol)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no book for %s %s", exchange, symbol))
+		return
+	}
+
+	snapshot := orderBook.Snapshot()
+	writeJSON(w, http.StatusOK, TopOfBook{
+		Exchange:     strings.ToLower(exchange),
+		Symbol:       snapshot.Symbol,
+		LastUpdateID: snapshot.LastUpdateID,
+		EventTime:    snapshot.EventTime,
+		SyncState:    orderBook.SyncState(),
+		BestBid:      toPriceLevel(snapshot.BestBid()),
+		BestAsk:      toPriceLevel(snapshot.BestAsk()),
+		Spread:       toPrice(snapshot.Spread()),
+		MidPrice:     toPrice(snapshot.MidPrice()),
+	})
+}
+
+func (s *Server) orderBook(exchange, symbol string) (limitorderbook.OrderBook, bool) {
+	s.RLock()
+	source, ok := s.sources[strings.ToLower(exchange)]
+	s.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	return source.OrderBook(symbol)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[restapi] Error marshalling the response: %s\n", err.Error())
+		status = http.StatusInternalServerError
+		data = []byte(`{"error":"internal error"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message})
+}
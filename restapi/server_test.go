@@ -0,0 +1,127 @@
+package restapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/robaho/fixed"
+	"github.com/stretchr/testify/assert"
+)
+
+type testOrderBook struct {
+	*limitorderbook.L2LimitOrderBook
+}
+
+func (tob testOrderBook) SyncState() limitorderbook.SyncState {
+	return limitorderbook.SyncStateLive
+}
+
+type testSource map[string]testOrderBook
+
+func (ts testSource) Exchange() string  { return "Binance" }
+func (ts testSource) Symbols() []string { return []string{"BTCUSDT"} }
+func (ts testSource) OrderBook(symbol string) (limitorderbook.OrderBook, bool) {
+	orderBook, ok := ts[symbol]
+	return orderBook, ok
+}
+
+func newTestServer() *Server {
+	l2lob := limitorderbook.NewL2LimitOrderBook(0).SetExchange("binance").SetSymbol("BTCUSDT")
+	for _, level := range [][2]string{{"100.10", "1.5"}, {"100.00", "2"}, {"99.90", "0.25"}} {
+		l2lob.UpdateOrAdd(limitorderbook.LoBFixed(fixed.NewS(level[0])), mustFloat(level[1]), "b")
+	}
+	l2lob.UpdateOrAdd(limitorderbook.LoBFixed(fixed.NewS("100.25")), 3, "a")
+
+	return New(testSource{"BTCUSDT": testOrderBook{l2lob}})
+}
+
+func mustFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+func get(server *Server, target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	return recorder
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestServer()
+
+	testCases := []struct {
+		target         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			"/books",
+			http.StatusOK,
+			`{"books":[{"exchange":"binance","symbol":"BTCUSDT","lastUpdateId":0,"eventTime":0,"syncState":"live","bidLevels":3,"askLevels":1}]}`,
+		},
+		{
+			"/books/binance/BTCUSDT?depth=2",
+			http.StatusOK,
+			`{"exchange":"binance","symbol":"BTCUSDT","lastUpdateId":0,"eventTime":0,"syncState":"live","bids":[["100.1","1.5"],["100","2"]],"asks":[["100.25","3"]]}`,
+		},
+		{
+			"/books/BINANCE/BTCUSDT/top",
+			http.StatusOK,
+			`{"exchange":"binance","symbol":"BTCUSDT","lastUpdateId":0,"eventTime":0,"syncState":"live","bestBid":{"price":"100.1","quantity":"1.5"},"bestAsk":{"price":"100.25","quantity":"3"},"spread":"0.15","midPrice":"100.175"}`,
+		},
+		{"/books/binance/BTCUSDT?depth=-1", http.StatusBadRequest, `{"error":"invalid depth \"-1\""}`},
+		{"/books/binance/ETHUSDT", http.StatusNotFound, `{"error":"no book for binance ETHUSDT"}`},
+		{"/books/kraken/BTCUSDT/top", http.StatusNotFound, `{"error":"no book for kraken BTCUSDT"}`},
+		{"/books/binance/BTCUSDT/bottom", http.StatusNotFound, `{"error":"not found"}`},
+	}
+
+	for _, test := range testCases {
+		response := get(server, test.target)
+		assert.Equalf(test.expectedStatus, response.Code, "GET %s", test.target)
+		assert.JSONEqf(test.expectedBody, response.Body.String(), "GET %s", test.target)
+		assert.Equal("application/json", response.Header().Get("Content-Type"))
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestServer()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servedChannel := make(chan error, 1)
+	go func() { servedChannel <- server.Serve(listener) }()
+
+	url := "http://" + listener.Addr().String() + "/books"
+	assert.Eventually(func() bool {
+		response, err := http.Get(url)
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return response.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(server.Shutdown(ctx))
+	assert.Equal(http.ErrServerClosed, <-servedChannel)
+	_, err = http.Get(url)
+	assert.Error(err)
+
+	// Serving after Shutdown stops at once
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(http.ErrServerClosed, server.Serve(listener))
+}
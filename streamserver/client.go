@@ -0,0 +1,213 @@
+package streamserver
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxRequestSize = 4096
+	pingInterval   = 30 * time.Second
+	pongWait       = 60 * time.Second
+)
+
+// client is a single downstream websocket connection
+type client struct {
+	server        *Server
+	conn          *websocket.Conn
+	sendChannel   chan interface{}
+	doneChannel   chan struct{}
+	subscriptions map[string]*subscription
+
+	closeOnce sync.Once
+	sync.Mutex
+}
+
+func newClient(server *Server, conn *websocket.Conn) *client {
+	return &client{
+		server:        server,
+		conn:          conn,
+		sendChannel:   make(chan interface{}, server.SendBufferSize),
+		doneChannel:   make(chan struct{}),
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// send queues a message without blocking. A client whose queue is full is too
+// slow to keep up and gets disconnected. It returns false if the client is gone.
+func (c *client) send(msg interface{}) bool {
+	select {
+	case <-c.doneChannel:
+		return false
+	default:
+	}
+
+	select {
+	case c.sendChannel <- msg:
+		return true
+	default:
+		log.Printf("[streamserver][%s] Slow consumer, %d messages queued. Disconnecting", c.conn.RemoteAddr(), len(c.sendChannel))
+		c.closeWithReason(websocket.ClosePolicyViolation, "slow consumer")
+		return false
+	}
+}
+
+// closeWithReason tries to tell the client why before dropping the connection
+func (c *client) closeWithReason(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.Lock()
+		close(c.doneChannel)
+		for key, s := range c.subscriptions {
+			close(s.doneChannel)
+			delete(c.subscriptions, key)
+		}
+		c.Unlock()
+
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		c.conn.Close()
+	})
+}
+
+func (c *client) close() {
+	c.closeWithReason(websocket.CloseNormalClosure, "")
+}
+
+// readLoop handles requests until the connection fails
+func (c *client) readLoop() {
+	defer c.close()
+
+	c.conn.SetReadLimit(maxRequestSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		var request Request
+		err = json.Unmarshal(msg, &request)
+		if err != nil {
+			c.send(Response{Error: "invalid request: " + err.Error()})
+			continue
+		}
+		response, started := c.handleRequest(request)
+		// The ack goes out before the subscription's first snapshot
+		c.send(response)
+		if started != nil {
+			c.server.waitGroup.Add(1)
+			go func() {
+				defer c.server.waitGroup.Done()
+				started.run(c.server.PollInterval)
+			}()
+		}
+	}
+}
+
+// writeLoop is the only writer of data frames on the connection
+func (c *client) writeLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	defer c.close()
+
+	for {
+		select {
+		case <-c.doneChannel:
+			return
+
+		case msg := <-c.sendChannel:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("[streamserver][%s] Error marshalling message: %s", c.conn.RemoteAddr(), err.Error())
+				continue
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+			err = c.conn.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				log.Printf("[streamserver][%s] Error writing message: %s", c.conn.RemoteAddr(), err.Error())
+				return
+			}
+
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.server.WriteTimeout))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleRequest returns the response and, for a SUBSCRIBE, the subscription
+// to run once the response is queued
+func (c *client) handleRequest(request Request) (Response, *subscription) {
+	response := Response{ID: request.ID}
+	key := subscriptionKey(request.Exchange, request.Symbol)
+
+	switch strings.ToUpper(request.Method) {
+	case "SUBSCRIBE":
+		if request.Depth < 0 {
+			response.Error = "depth must be >= 0"
+			return response, nil
+		}
+
+		orderBook, ok := c.server.orderBook(request.Exchange, request.Symbol)
+		if !ok {
+			response.Error = "no book for " + request.Exchange + " " + request.Symbol
+			return response, nil
+		}
+
+		c.Lock()
+		defer c.Unlock()
+
+		select {
+		case <-c.doneChannel:
+			response.Error = "connection closed"
+			return response, nil
+		default:
+		}
+
+		if existing, ok := c.subscriptions[key]; ok {
+			close(existing.doneChannel)
+		}
+		s := &subscription{
+			exchange:     strings.ToLower(request.Exchange),
+			orderBook:    orderBook,
+			client:       c,
+			depthTracker: limitorderbook.NewDepthTracker(request.Depth),
+			doneChannel:  make(chan struct{}),
+		}
+		c.subscriptions[key] = s
+
+		response.Result = "subscribed"
+		return response, s
+
+	case "UNSUBSCRIBE":
+		c.Lock()
+		defer c.Unlock()
+
+		existing, ok := c.subscriptions[key]
+		if !ok {
+			response.Error = "not subscribed to " + request.Exchange + " " + request.Symbol
+			return response, nil
+		}
+		close(existing.doneChannel)
+		delete(c.subscriptions, key)
+
+		response.Result = "unsubscribed"
+
+	default:
+		response.Error = "unknown method " + request.Method
+	}
+
+	return response, nil
+}
@@ -0,0 +1,42 @@
+package streamserver
+
+// Request is sent by clients to manage their subscriptions
+//
+//	{"method":"SUBSCRIBE","exchange":"binance","symbol":"BTCUSDT","depth":20,"id":1}
+//	{"method":"UNSUBSCRIBE","exchange":"binance","symbol":"BTCUSDT","id":2}
+type Request struct {
+	ID       int64  `json:"id"`
+	Method   string `json:"method"`
+	Exchange string `json:"exchange"`
+	Symbol   string `json:"symbol"`
+	Depth    int    `json:"depth"`
+}
+
+// Response acknowledges a Request. Error is empty on success.
+type Response struct {
+	ID     int64  `json:"id"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	// MessageTypeSnapshot replaces everything the client holds for the book
+	MessageTypeSnapshot = "snapshot"
+	// MessageTypeDelta carries the levels that changed since the previous message.
+	// A quantity of "0" removes the level.
+	MessageTypeDelta = "delta"
+)
+
+// BookUpdate is pushed to subscribed clients. Sequence is the book's
+// LastUpdateID; PreviousSequence is the Sequence of the previous message on the
+// same subscription, so clients can check they missed nothing.
+type BookUpdate struct {
+	Type             string      `json:"type"`
+	Exchange         string      `json:"exchange"`
+	Symbol           string      `json:"symbol"`
+	Sequence         int64       `json:"sequence"`
+	PreviousSequence int64       `json:"previousSequence"`
+	EventTime        int64       `json:"eventTime"`
+	Bids             [][2]string `json:"bids"`
+	Asks             [][2]string `json:"asks"`
+}
@@ -0,0 +1,191 @@
+/*
+  Package streamserver pushes normalized book updates to websocket clients.
+
+  Clients connect to /ws and send a Request per book they want:
+
+    {"method":"SUBSCRIBE","exchange":"binance","symbol":"BTCUSDT","depth":20,"id":1}
+
+  Once the book is live they get a snapshot of up to depth levels per side
+  (0 for all), followed by deltas holding only the levels that changed. Each
+  BookUpdate carries the sequence of the message before it, so a client that
+  sees a gap can resubscribe for a fresh snapshot. Clients that can't keep up
+  with the updates are disconnected, as is every client on Shutdown.
+*/
+
+package streamserver
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+const (
+	// DefaultSendBufferSize is the number of messages queued per client before
+	// it is considered too slow
+	DefaultSendBufferSize = 256
+	// DefaultWriteTimeout ...
+	DefaultWriteTimeout = 10 * time.Second
+	// DefaultPollInterval is how often books that can't notify of changes are checked
+	DefaultPollInterval = 100 * time.Millisecond
+)
+
+// Server ...
+type Server struct {
+	SendBufferSize int
+	WriteTimeout   time.Duration
+	PollInterval   time.Duration
+
+	sources    map[string]limitorderbook.OrderBookSource
+	upgrader   websocket.Upgrader
+	httpServer *http.Server // Set by Serve
+	clients    map[*client]struct{}
+	isShutdown bool
+	waitGroup  sync.WaitGroup // The clients and their subscriptions
+	sync.RWMutex
+}
+
+// New ...
+func New(sources ...limitorderbook.OrderBookSource) *Server {
+	s := &Server{
+		SendBufferSize: DefaultSendBufferSize,
+		WriteTimeout:   DefaultWriteTimeout,
+		PollInterval:   DefaultPollInterval,
+		sources:        make(map[string]limitorderbook.OrderBookSource),
+		clients:        make(map[*client]struct{}),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     func(r *http.Request) bool { return true },
+		},
+	}
+	for _, source := range sources {
+		s.AddSource(source)
+	}
+	return s
+}
+
+// AddSource streams the books of another exchange
+func (s *Server) AddSource(source limitorderbook.OrderBookSource) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sources[strings.ToLower(source.Exchange())] = source
+}
+
+// ServeHTTP upgrades the connection and serves the client until it disconnects
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[streamserver] Error upgrading the connection: %s\n", err.Error())
+		return
+	}
+
+	c := newClient(s, conn)
+	s.Lock()
+	if s.isShutdown {
+		s.Unlock()
+		c.closeWithReason(websocket.CloseGoingAway, "server shutting down")
+		return
+	}
+	s.clients[c] = struct{}{}
+	s.waitGroup.Add(1)
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		delete(s.clients, c)
+		s.Unlock()
+		s.waitGroup.Done()
+	}()
+
+	go c.writeLoop()
+	c.readLoop()
+}
+
+// ListenAndServe serves clients on addr until it fails or Shutdown is called
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[streamserver] Listening on %s\n", addr)
+	return s.Serve(listener)
+}
+
+// Serve serves clients on listener until it fails or Shutdown is called, when
+// it returns http.ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", s)
+
+	s.Lock()
+	if s.isShutdown {
+		s.Unlock()
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	httpServer := &http.Server{Handler: mux}
+	s.httpServer = httpServer
+	s.Unlock()
+
+	return httpServer.Serve(listener)
+}
+
+// Shutdown stops accepting connections, disconnects every client and waits for
+// their subscriptions to stop, until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	s.isShutdown = true
+	httpServer := s.httpServer
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.Unlock()
+
+	var err error
+	if httpServer != nil {
+		// The upgraded connections are not the http.Server's to close
+		err = httpServer.Shutdown(ctx)
+	}
+	for _, c := range clients {
+		c.closeWithReason(websocket.CloseGoingAway, "server shutting down")
+	}
+
+	stoppedChannel := make(chan struct{})
+	go func() {
+		s.waitGroup.Wait()
+		close(stoppedChannel)
+	}()
+	select {
+	case <-stoppedChannel:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+func (s *Server) orderBook(exchange, symbol string) (limitorderbook.OrderBook, bool) {
+	s.RLock()
+	source, ok := s.sources[strings.ToLower(exchange)]
+	s.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	return source.OrderBook(symbol)
+}
@@ -0,0 +1,154 @@
+package streamserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestServer_Stream(t *testing.T) {
+	assert := assert.New(t)
+
+	snapshotFetcher := limitorderbook.NewMemorySnapshotFetcher().AddSnapshot("BTCUSDT", &limitorderbook.DepthSnapshot{
+		LastUpdateID: 100,
+		Bids:         [][2]string{{"100.10", "1.5"}, {"100.00", "2"}},
+		Asks:         [][2]string{{"100.25", "3"}, {"100.50", "1"}},
+	})
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.SnapshotFetcher = snapshotFetcher
+	bookManager.Subscribe("BTCUSDT")
+	defer bookManager.Close()
+
+	server := httptest.NewServer(New(bookManager))
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Close()
+
+	var response Response
+	var update BookUpdate
+
+	// Kick off the sync; the snapshot is only sent once the book is live
+	assert.NoError(bookManager.HandleMessage([]byte(`{"e":"depthUpdate","E":1,"s":"BTCUSDT","U":95,"u":105,"pu":94,"b":[["100.10","1"]],"a":[]}`)))
+
+	assert.NoError(conn.WriteJSON(Request{ID: 1, Method: "SUBSCRIBE", Exchange: "binance", Symbol: "btcusdt", Depth: 1}))
+	assert.NoError(conn.ReadJSON(&response))
+	assert.Equal(Response{ID: 1, Result: "subscribed"}, response)
+
+	assert.NoError(conn.ReadJSON(&update))
+	assert.Equal(BookUpdate{
+		Type:      MessageTypeSnapshot,
+		Exchange:  "binance",
+		Symbol:    "BTCUSDT",
+		Sequence:  105,
+		EventTime: 1,
+		Bids:      [][2]string{{"100.1", "1"}},
+		Asks:      [][2]string{{"100.25", "3"}},
+	}, update)
+
+	// Below depth: no delta
+	assert.NoError(bookManager.HandleMessage([]byte(`{"e":"depthUpdate","E":2,"s":"BTCUSDT","U":106,"u":107,"pu":105,"b":[["100.00","5"]],"a":[]}`)))
+	// New best bid, best ask removed
+	assert.NoError(bookManager.HandleMessage([]byte(`{"e":"depthUpdate","E":3,"s":"BTCUSDT","U":108,"u":110,"pu":107,"b":[["100.20","4"]],"a":[["100.25","0"]]}`)))
+
+	assert.Eventually(func() bool {
+		update = BookUpdate{}
+		return assert.NoError(conn.ReadJSON(&update)) && update.Sequence == 110
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(MessageTypeDelta, update.Type)
+	assert.Equal(int64(3), update.EventTime)
+	assert.Equal([][2]string{{"100.2", "4"}, {"100.1", "0"}}, update.Bids)
+	assert.Equal([][2]string{{"100.5", "1"}, {"100.25", "0"}}, update.Asks)
+
+	assert.NoError(conn.WriteJSON(Request{ID: 2, Method: "SUBSCRIBE", Exchange: "kraken", Symbol: "BTCUSDT"}))
+	response = Response{}
+	assert.NoError(conn.ReadJSON(&response))
+	assert.Equal(Response{ID: 2, Error: "no book for kraken BTCUSDT"}, response)
+
+	assert.NoError(conn.WriteJSON(Request{ID: 3, Method: "UNSUBSCRIBE", Exchange: "binance", Symbol: "BTCUSDT"}))
+	response = Response{}
+	assert.NoError(conn.ReadJSON(&response))
+	assert.Equal(Response{ID: 3, Result: "unsubscribed"}, response)
+}
+
+func TestServer_SlowConsumer(t *testing.T) {
+	assert := assert.New(t)
+
+	streamServer := New()
+	streamServer.SendBufferSize = 1
+
+	sendResults := make(chan []bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := streamServer.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Nothing drains the queue, as if the client stopped reading
+		c := newClient(streamServer, conn)
+		sendResults <- []bool{c.send(Response{ID: 1}), c.send(Response{ID: 2}), c.send(Response{ID: 3})}
+	}))
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	assert.Equal([]bool{true, false, false}, <-sendResults)
+
+	_, _, err := conn.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	bookManager := limitorderbook.NewBinanceL2LimitOrderBookManager(nil)
+	bookManager.SnapshotFetcher = limitorderbook.NewMemorySnapshotFetcher().AddSnapshot("BTCUSDT", &limitorderbook.DepthSnapshot{LastUpdateID: 100})
+	bookManager.Subscribe("BTCUSDT")
+	defer bookManager.Close()
+
+	streamServer := New(bookManager)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servedChannel := make(chan error, 1)
+	go func() { servedChannel <- streamServer.Serve(listener) }()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var response Response
+	assert.NoError(conn.WriteJSON(Request{ID: 1, Method: "SUBSCRIBE", Exchange: "binance", Symbol: "BTCUSDT"}))
+	assert.NoError(conn.ReadJSON(&response))
+	assert.Equal(Response{ID: 1, Result: "subscribed"}, response)
+
+	// The client and its subscription are stopped, not left to the books
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(streamServer.Shutdown(ctx))
+	assert.Equal(http.ErrServerClosed, <-servedChannel)
+
+	_, _, err = conn.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
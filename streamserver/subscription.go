@@ -0,0 +1,85 @@
+package streamserver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bensooraj/h-lob-service/limitorderbook"
+)
+
+// subscription streams one book, cut to depth levels per side, to one client
+type subscription struct {
+	exchange  string
+	orderBook limitorderbook.OrderBook
+	client    *client
+
+	depthTracker *limitorderbook.DepthTracker
+	lastSequence int64
+	doneChannel  chan struct{}
+}
+
+func subscriptionKey(exchange, symbol string) string {
+	return strings.ToLower(exchange) + "/" + strings.ToUpper(symbol)
+}
+
+// run sends the initial snapshot, then a delta whenever the book changes,
+// until the subscription is closed or the client is gone
+func (s *subscription) run(pollInterval time.Duration) {
+	isSnapshotSent := false
+	limitorderbook.Follow(s.orderBook, pollInterval, s.doneChannel, func(snapshot *limitorderbook.BookSnapshot) bool {
+		if !isSnapshotSent {
+			isSnapshotSent = true
+			return s.sendSnapshot(snapshot)
+		}
+		return s.sendDelta(snapshot)
+	})
+}
+
+func (s *subscription) sendSnapshot(snapshot *limitorderbook.BookSnapshot) bool {
+	bids, asks := s.depthTracker.Levels(snapshot)
+
+	update := s.newUpdate(MessageTypeSnapshot, snapshot)
+	update.Bids = toLevels(bids)
+	update.Asks = toLevels(asks)
+
+	return s.client.send(update)
+}
+
+func (s *subscription) sendDelta(snapshot *limitorderbook.BookSnapshot) bool {
+	if snapshot.LastUpdateID == s.lastSequence {
+		return true
+	}
+
+	bids, asks := s.depthTracker.Changes(snapshot)
+	if len(bids) == 0 && len(asks) == 0 {
+		// Nothing changed within depth
+		return true
+	}
+
+	update := s.newUpdate(MessageTypeDelta, snapshot)
+	update.Bids = toLevels(bids)
+	update.Asks = toLevels(asks)
+
+	return s.client.send(update)
+}
+
+func (s *subscription) newUpdate(updateType string, snapshot *limitorderbook.BookSnapshot) *BookUpdate {
+	update := &BookUpdate{
+		Type:             updateType,
+		Exchange:         s.exchange,
+		Symbol:           snapshot.Symbol,
+		Sequence:         snapshot.LastUpdateID,
+		PreviousSequence: s.lastSequence,
+		EventTime:        snapshot.EventTime,
+	}
+	s.lastSequence = snapshot.LastUpdateID
+	return update
+}
+
+func toLevels(priceLevels []limitorderbook.PriceLevel) [][2]string {
+	levels := make([][2]string, 0, len(priceLevels))
+	for _, priceLevel := range priceLevels {
+		levels = append(levels, priceLevel.Strings())
+	}
+	return levels
+}